@@ -4,10 +4,13 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strings"
 
+	"github.com/containerd/containerd/pkg/epoch"
 	"github.com/containerd/containerd/reference"
 	"github.com/google/go-containerregistry/pkg/crane"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/nubificus/bima/internal/ctr"
 	"github.com/nubificus/bima/internal/image"
 	"github.com/nubificus/bima/internal/utils"
@@ -16,6 +19,12 @@ import (
 )
 
 func bimaBuild(ctx *cli.Context) error {
+	return buildImages(ctx, "")
+}
+
+// buildImages builds the images of the context and saves them as requested
+// by the output flags, or writes them as the OCI runtime bundle in bundleDir
+func buildImages(ctx *cli.Context, bundleDir string) error {
 	// Parse CLI flags
 	buildContext := ctx.Args().First()
 	namespace := ctx.String("namespace")
@@ -25,6 +34,25 @@ func bimaBuild(ctx *cli.Context) error {
 	tag := ctx.String("tag")
 	tarOutput := ctx.Bool("tar")
 	file := ctx.String("file")
+	estargz := ctx.Bool("estargz")
+	noCache := ctx.Bool("no-cache")
+	cacheDir := ctx.String("cache-dir")
+	jobs := ctx.Int("jobs")
+	platformFlag := ctx.String("platform")
+	mediaTypes := ctx.String("media-types")
+	labelFlags := ctx.StringSlice("label")
+	annotationFlags := ctx.StringSlice("annotation")
+	author := ctx.String("author")
+	rootfsFormat := ctx.String("rootfs-format")
+	initrdCompression := ctx.String("initrd-compression")
+	maxImageSizeFlag := ctx.String("max-image-size")
+	maxLayerSizeFlag := ctx.String("max-layer-size")
+	sizeReport := ctx.String("size-report")
+	compatFile := ctx.String("compat-file")
+	uruncJSONSchema := ctx.String("urunc-json-schema")
+	annotationEncoding := ctx.String("annotation-encoding")
+	launchConfig := ctx.Bool("launch-config")
+	stripDebug := ctx.Bool("strip-debug")
 	if tarOutput {
 		output = "tar"
 	}
@@ -41,6 +69,26 @@ func bimaBuild(ctx *cli.Context) error {
 	log.Tracef("Got tarOutput %v", tarOutput)
 	log.Tracef("Got tag %q", tag)
 	log.Tracef("Got file %q", file)
+	log.Tracef("Got estargz %v", estargz)
+	log.Tracef("Got noCache %v", noCache)
+	log.Tracef("Got cacheDir %q", cacheDir)
+	log.Tracef("Got jobs %v", jobs)
+	log.Tracef("Got platform %q", platformFlag)
+	log.Tracef("Got rootfsFormat %q", rootfsFormat)
+	log.Tracef("Got initrdCompression %q", initrdCompression)
+	log.Tracef("Got maxImageSize %q", maxImageSizeFlag)
+	log.Tracef("Got maxLayerSize %q", maxLayerSizeFlag)
+	log.Tracef("Got sizeReport %q", sizeReport)
+	log.Tracef("Got compatFile %q", compatFile)
+	log.Tracef("Got uruncJSONSchema %q", uruncJSONSchema)
+	log.Tracef("Got annotationEncoding %q", annotationEncoding)
+	log.Tracef("Got launchConfig %v", launchConfig)
+	log.Tracef("Got stripDebug %v", stripDebug)
+	log.Tracef("Got mediaTypes %q", mediaTypes)
+	log.Tracef("Got labels %v", labelFlags)
+	log.Tracef("Got annotations %v", annotationFlags)
+	log.Tracef("Got author %q", author)
+	log.Tracef("Got bundleDir %q", bundleDir)
 
 	// Verify tag
 	spec, err := reference.Parse(tag)
@@ -96,31 +144,272 @@ func bimaBuild(ctx *cli.Context) error {
 		log.Infof("Could not find %q, will use %q", ctx.String("file"), file)
 	}
 
-	// verify given output is supported
-	if output != "tar" && output != "ctr" {
+	// verify given output is supported. Bundles are written instead of any output.
+	if bundleDir == "" && output != "tar" && output != "ctr" {
 		log.Fatal("ERROR: invalid output type")
 	}
 
-	// create image based on context and containerfile
-	img, err := buildImage(buildContext, file)
+	// verify given media types are supported
+	supported := false
+	for _, m := range image.SupportedMediaTypes() {
+		if m == mediaTypes {
+			supported = true
+		}
+	}
+	if !supported {
+		log.Fatal("ERROR: invalid media types")
+	}
+
+	// verify given rootfs format is supported
+	if rootfsFormat != "" {
+		supported = false
+		for _, f := range image.SupportedRootfsFormats() {
+			if f == rootfsFormat {
+				supported = true
+			}
+		}
+		if !supported {
+			log.Fatal("ERROR: invalid rootfs format")
+		}
+	}
+	supported = false
+	for _, c := range image.SupportedInitrdCompressions() {
+		if c == initrdCompression {
+			supported = true
+		}
+	}
+	if !supported {
+		log.Fatal("ERROR: invalid initrd compression")
+	}
+
+	// verify given urunc.json schema is supported
+	supported = false
+	for _, s := range image.SupportedUruncJSONSchemas() {
+		if s == uruncJSONSchema {
+			supported = true
+		}
+	}
+	if !supported {
+		log.Fatal("ERROR: invalid urunc.json schema")
+	}
+
+	// verify given annotation encoding is supported
+	supported = false
+	for _, e := range image.SupportedAnnotationEncodings() {
+		if e == annotationEncoding {
+			supported = true
+		}
+	}
+	if !supported {
+		log.Fatal("ERROR: invalid annotation encoding")
+	}
+
+	// verify given size limits and size report format
+	var maxImageSize, maxLayerSize int64
+	if maxImageSizeFlag != "" {
+		maxImageSize, err = utils.ParseSize(maxImageSizeFlag)
+		if err != nil {
+			log.Fatalf("ERROR: invalid maximum image size - %q", err.Error())
+		}
+	}
+	if maxLayerSizeFlag != "" {
+		maxLayerSize, err = utils.ParseSize(maxLayerSizeFlag)
+		if err != nil {
+			log.Fatalf("ERROR: invalid maximum layer size - %q", err.Error())
+		}
+	}
+	if sizeReport != "" {
+		supported = false
+		for _, f := range image.SupportedSizeReportFormats() {
+			if f == sizeReport {
+				supported = true
+			}
+		}
+		if !supported {
+			log.Fatal("ERROR: invalid size report format")
+		}
+	}
+
+	// load the compatibility matrix. The default file is optional, unlike a given one.
+	if compatFile == "" {
+		defaultFile, err := image.DefaultCompatibilityFile()
+		if err == nil {
+			if _, err := os.Stat(defaultFile); err == nil {
+				compatFile = defaultFile
+			}
+		}
+	}
+	compatibility := image.DefaultCompatibilityMatrix()
+	if compatFile != "" {
+		compatibility, err = image.LoadCompatibilityMatrix(compatFile)
+		if err != nil {
+			log.Fatalf("ERROR: failed to load compatibility matrix - %q", err.Error())
+		}
+		log.Debugf("Loaded compatibility matrix from %q", compatFile)
+	}
+
+	// verify given platforms are valid. Multi-platform builds produce an OCI index,
+	// so they require OCI media types.
+	platforms := []v1.Platform{}
+	if platformFlag != "" {
+		for _, p := range strings.Split(platformFlag, ",") {
+			platform, err := v1.ParsePlatform(strings.TrimSpace(p))
+			if err != nil {
+				log.Fatalf("ERROR: invalid platform %q - %v", p, err.Error())
+			}
+			if platform.OS != "linux" {
+				log.Fatalf("ERROR: unsupported platform OS %q", platform.OS)
+			}
+			platforms = append(platforms, *platform)
+		}
+	}
+	if len(platforms) > 1 && bundleDir != "" {
+		log.Fatal("ERROR: a bundle holds the image of a single platform")
+	}
+	if len(platforms) > 1 && mediaTypes != image.MediaTypesOCI {
+		if ctx.IsSet("media-types") {
+			log.Fatal("ERROR: multi-platform builds require OCI media types")
+		}
+		log.Info("Using OCI media types for multi-platform build")
+		mediaTypes = image.MediaTypesOCI
+	}
+	// debug artifacts refer to their image as OCI artifacts, which Docker
+	// archives can not hold. Bundles only hold the stripped binary.
+	if stripDebug && bundleDir != "" {
+		log.Warn("The debug files of stripped binaries are not written to bundles")
+	} else if stripDebug && mediaTypes != image.MediaTypesOCI {
+		if ctx.IsSet("media-types") {
+			log.Fatal("ERROR: --strip-debug requires OCI media types")
+		}
+		log.Info("Using OCI media types for the debug artifact")
+		mediaTypes = image.MediaTypesOCI
+	}
+
+	// verify given number of jobs is valid
+	if jobs < 0 {
+		log.Fatal("ERROR: invalid number of jobs")
+	}
+
+	// verify given labels and annotations
+	labels, err := image.ParseKeyValues(labelFlags)
+	if err != nil {
+		log.Fatalf("ERROR: invalid label - %q", err.Error())
+	}
+	annotations, err := image.ParseKeyValues(annotationFlags)
+	if err != nil {
+		log.Fatalf("ERROR: invalid annotation - %q", err.Error())
+	}
+	metadata, err := image.NewMetadata(buildContext, tag, author, epoch.SourceDateEpochOrNow(), annotations)
 	if err != nil {
-		log.Fatal(err.Error())
+		log.Fatalf("ERROR: failed to create image metadata - %q", err.Error())
+	}
+	log.Debugf("Got metadata %v", metadata)
+
+	opts := image.BuildOptions{
+		EStargz:            estargz,
+		Jobs:               jobs,
+		MediaTypes:         mediaTypes,
+		RootfsFormat:       rootfsFormat,
+		InitrdCompression:  initrdCompression,
+		Compatibility:      compatibility,
+		UruncJSONSchema:    uruncJSONSchema,
+		AnnotationEncoding: annotationEncoding,
+		LaunchConfig:       launchConfig,
+		StripDebug:         stripDebug,
+	}
+	if !noCache {
+		if cacheDir == "" {
+			cacheDir, err = image.DefaultCacheDir()
+			if err != nil {
+				log.Fatalf("ERROR: could not find the default cache directory - %q", err.Error())
+			}
+		}
+		cacheDir, err = filepath.Abs(cacheDir)
+		if err != nil {
+			log.Fatalf("ERROR: invalid cache directory path - %q", err.Error())
+		}
+		opts.Cache, err = image.NewLayerCache(cacheDir)
+		if err != nil {
+			log.Fatalf("ERROR: error creating cache directory %q - %v", cacheDir, err.Error())
+		}
+		log.Debugf("Using build cache at %q", cacheDir)
+	}
+
+	// create one image per target platform, based on context and containerfile.
+	// If no platform is given, the architecture is extracted from the unikernel binary.
+	images := []*image.BimaImage{}
+	if len(platforms) == 0 {
+		hostPlatform := v1.Platform{OS: "linux", Architecture: runtime.GOARCH}
+		img, err := buildImage(buildContext, file, image.PlatformArgs(hostPlatform), labels, metadata, opts)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		images = append(images, img)
+	}
+	for _, platform := range platforms {
+		platform := platform
+		log.Infof("Building image for platform %q", platform.String())
+		opts.Platform = &platform
+		img, err := buildImage(buildContext, file, image.PlatformArgs(platform), labels, metadata, opts)
+		if err != nil {
+			log.Fatalf("ERROR: failed to build image for platform %q - %v", platform.String(), err.Error())
+		}
+		images = append(images, img)
+	}
+	log.Debugf("Built images %v", images)
+
+	// check the size of the images against the given limits
+	reports := []image.SizeReport{}
+	if maxImageSize > 0 || maxLayerSize > 0 || sizeReport != "" {
+		for _, img := range images {
+			report, err := img.SizeReport()
+			if err != nil {
+				log.Fatalf("ERROR: failed to read image size - %v", err.Error())
+			}
+			err = report.CheckLimits(maxImageSize, maxLayerSize)
+			if err != nil {
+				log.Fatalf("ERROR: %v", err.Error())
+			}
+			reports = append(reports, report)
+		}
 	}
-	log.Debugf("Built image %v", img)
 
 	// chdir to previous workdir to properly save image
 	err = os.Chdir(wd)
 	if err != nil {
 		return err
 	}
+	if bundleDir != "" {
+		return writeBundle(images, bundleDir, reports, sizeReport)
+	}
 	targetPathParts := strings.Split(tag, "/")
 	targetPath := targetPathParts[len(targetPathParts)-1]
 	targetPath, err = filepath.Abs(targetPath)
 	if err != nil {
 		return err
 	}
-	// save image to tarball
-	err = crane.Save(*img.Image, tag, targetPath)
+	// the debug artifacts of the stripped binaries are saved along with the images
+	referrers, err := debugReferrers(images)
+	if err != nil {
+		log.Fatalf("ERROR: failed to create debug artifact - %v", err.Error())
+	}
+	// save image to tarball. Docker archives can not hold OCI media types
+	// or indexes, so OCI images are saved as OCI image layouts.
+	switch {
+	case len(images) > 1:
+		index, err := image.NewIndex(images)
+		if err != nil {
+			return err
+		}
+		err = image.SaveOCIIndexArchive(index, tag, targetPath, referrers...)
+		if err != nil {
+			return err
+		}
+	case mediaTypes == image.MediaTypesOCI:
+		err = image.SaveOCIArchive(*images[0].Image, tag, targetPath, referrers...)
+	default:
+		err = crane.Save(*images[0].Image, tag, targetPath)
+	}
 	if err != nil {
 		return err
 	}
@@ -143,37 +432,44 @@ func bimaBuild(ctx *cli.Context) error {
 		}
 	}
 
+	if sizeReport != "" {
+		err = image.WriteSizeReports(os.Stdout, reports, sizeReport)
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-func getOperations(contextDir string, containerFile string) ([]image.BimaOperation, error) {
+func getOperations(contextDir string, containerFile string, args map[string]string) ([]image.BimaOperation, error) {
 	// chdir to context directory
 	err := os.Chdir(contextDir)
 	if err != nil {
 		log.Fatalf("ERROR: error changing directory - %q", err.Error())
 	}
 	log.Debugf("Changed directory to %q", contextDir)
-	lines, err := utils.SplitFileToLines(containerFile)
+	lines, err := utils.SplitFileToNumberedLines(containerFile)
 	if err != nil {
 		return nil, err
 	}
 	log.Tracef("Read following lines from Containerfile: %v", lines)
 	operations := []image.BimaOperation{}
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
+	buildArgs := image.NewBuildArgs(args)
+	for _, numbered := range lines {
+		line := strings.TrimSpace(numbered.Text)
 		if line == "" {
 			continue
 		}
-		for strings.Contains(line, "  ") {
-			line = strings.ReplaceAll(line, "  ", " ")
+		log.Tracef("Creating bima operation from line %d %q", numbered.Number, line)
+		instruction, err := buildArgs.Expand(image.NewInstructionLine(line))
+		if err != nil {
+			return nil, fmt.Errorf("Containerfile line %d: %v", numbered.Number, err)
 		}
-		log.Tracef("Creating bima operation from line %q", line)
-		instruction := image.NewInstructionLine(line)
 		operation, err := instruction.ToBimaOperation()
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("Containerfile line %d: %v", numbered.Number, err)
 		}
-		operations = append(operations, operation)
+		operations = append(operations, image.WithLineNumber(operation, numbered.Number))
 	}
 	log.Debugf("Found %v operations in file %q", len(operations), containerFile)
 	validOps := []image.BimaOperation{}
@@ -186,12 +482,40 @@ func getOperations(contextDir string, containerFile string) ([]image.BimaOperati
 	return validOps, nil
 }
 
-func buildImage(buildContext string, file string) (*image.BimaImage, error) {
+// debugReferrers returns the debug artifacts of the images, named after the
+// image tag with a "-debug" suffix, followed by the platform of multi-platform
+// images
+func debugReferrers(images []*image.BimaImage) ([]image.Referrer, error) {
+	referrers := []image.Referrer{}
+	for _, img := range images {
+		artifact, err := img.DebugArtifact()
+		if err != nil {
+			return nil, err
+		}
+		if artifact == nil {
+			continue
+		}
+		suffix := "-debug"
+		if len(images) > 1 {
+			platform, err := img.Platform()
+			if err != nil {
+				return nil, err
+			}
+			suffix += "-" + strings.ReplaceAll(platform.String(), "/", "-")
+		}
+		referrers = append(referrers, image.Referrer{Artifact: artifact, Suffix: suffix})
+	}
+	return referrers, nil
+}
+
+func buildImage(buildContext string, file string, args map[string]string, labels map[string]string, metadata image.Metadata, opts image.BuildOptions) (*image.BimaImage, error) {
 	// Parse containerfile to find all operations
-	operations, err := getOperations(buildContext, file)
+	operations, err := getOperations(buildContext, file, args)
 	if err != nil {
 		return nil, fmt.Errorf("ERROR: failed to convert Containerfile to bima operations - %q", err.Error())
 	}
+	// labels given from the CLI override the ones of the Containerfile
+	operations = image.OverrideLabels(operations, labels)
 	if logrus.DebugLevel == log.GetLevel() {
 		for _, op := range operations {
 			log.Debugf("Got %q operation: %v", op.Type(), op)
@@ -199,18 +523,14 @@ func buildImage(buildContext string, file string) (*image.BimaImage, error) {
 	}
 
 	// create new bima image
-	img, err := image.NewBimaImage()
+	img, err := image.NewBimaImage(opts)
 	if err != nil {
 		return nil, err
 	}
 	log.Debug("Created new empty image")
-	for _, op := range operations {
-		err := img.ApplyOperation(op)
-		if err != nil {
-			return nil, fmt.Errorf("ERROR: failed to add operation %v to image - %q", op, err.Error())
-		}
-		log.Debug(op.Info())
-		log.Infof("Appending layer %q", op.Line())
+	err = img.ApplyOperations(operations)
+	if err != nil {
+		return nil, err
 	}
 
 	// verify all mandatory labels are set
@@ -225,6 +545,18 @@ func buildImage(buildContext string, file string) (*image.BimaImage, error) {
 		return nil, err
 	}
 
+	// assemble the copied files in a filesystem image, if requested
+	err = img.AddRootfs()
+	if err != nil {
+		return nil, err
+	}
+
+	// generate the launch configuration of the hypervisor, if requested
+	err = img.AddLaunchConfig()
+	if err != nil {
+		return nil, err
+	}
+
 	// add cmd
 	err = img.AddCmd()
 	if err != nil {
@@ -237,5 +569,17 @@ func buildImage(buildContext string, file string) (*image.BimaImage, error) {
 		return nil, err
 	}
 
+	// set the manifest annotations of the labels in the requested encoding
+	err = img.EncodeAnnotations()
+	if err != nil {
+		return nil, err
+	}
+
+	// add author, creation time and standard OCI annotations
+	err = img.AddMetadata(metadata)
+	if err != nil {
+		return nil, err
+	}
+
 	return img, nil
 }
@@ -0,0 +1,86 @@
+// Copyright 2023 Nubificus LTD.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/nubificus/bima/internal/image"
+	"github.com/urfave/cli/v2"
+)
+
+// bimaBundle writes an OCI runtime bundle, either from an image built from
+// the given context or from an image archive given with --image
+func bimaBundle(ctx *cli.Context) error {
+	imagePath := ctx.String("image")
+	bundleDir := ctx.String("bundle")
+	if bundleDir == "" {
+		log.Fatal("ERROR: empty bundle directory")
+	}
+	if imagePath == "" {
+		return buildImages(ctx, bundleDir)
+	}
+	platformFlag := ctx.String("platform")
+	log.Tracef("Got image %q", imagePath)
+	log.Tracef("Got bundleDir %q", bundleDir)
+	log.Tracef("Got platform %q", platformFlag)
+
+	var platform *v1.Platform
+	if platformFlag != "" {
+		var err error
+		platform, err = v1.ParsePlatform(platformFlag)
+		if err != nil {
+			log.Fatalf("ERROR: invalid platform %q - %v", platformFlag, err.Error())
+		}
+	}
+	img, cleanup, err := image.LoadImage(imagePath, platform)
+	defer cleanup()
+	if err != nil {
+		log.Fatalf("ERROR: failed to load image %q - %v", imagePath, err.Error())
+	}
+	bundleDir, err = filepath.Abs(bundleDir)
+	if err != nil {
+		log.Fatalf("ERROR: invalid bundle directory path - %q", err.Error())
+	}
+	err = image.WriteBundle(img, bundleDir)
+	if err != nil {
+		return err
+	}
+	log.Infof("Wrote bundle at %q", bundleDir)
+	fmt.Println(bundleDir)
+	return nil
+}
+
+// writeBundle writes the built image as an OCI runtime bundle,
+// instead of saving it, and prints its size reports if requested
+func writeBundle(images []*image.BimaImage, bundleDir string, reports []image.SizeReport, sizeReport string) error {
+	bundleDir, err := filepath.Abs(bundleDir)
+	if err != nil {
+		log.Fatalf("ERROR: invalid bundle directory path - %q", err.Error())
+	}
+	err = image.WriteBundle(*images[0].Image, bundleDir)
+	if err != nil {
+		return err
+	}
+	log.Infof("Wrote bundle at %q", bundleDir)
+	fmt.Println(bundleDir)
+	if sizeReport != "" {
+		return image.WriteSizeReports(os.Stdout, reports, sizeReport)
+	}
+	return nil
+}
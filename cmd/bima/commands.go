@@ -39,5 +39,17 @@ func extraBimaCommands() []*cli.Command {
 			},
 			Flags:  buildFlags(),
 			Action: bimaBuild,
+		},
+		{
+			Name:  "bundle",
+			Usage: "build a container image, or load a built one, and write it as an OCI runtime bundle",
+			Before: func(ctx *cli.Context) error {
+				if ctx.Args().Len() == 0 && !ctx.IsSet("image") {
+					return cli.Exit("ERROR: \"bima bundle\" requires exactly 1 argument (the context for the build process), unless --image is given.", 1)
+				}
+				return nil
+			},
+			Flags:  bundleFlags(),
+			Action: bimaBundle,
 		}}
 }
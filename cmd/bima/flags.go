@@ -66,5 +66,152 @@ func buildFlags() []cli.Flag {
 			Usage:   "Name of the `CONTAINERFILE` ",
 			Value:   "./Containerfile",
 		},
+		&cli.BoolFlag{
+			Name:     "estargz",
+			Usage:    "[Optional] Write layers as eStargz to enable lazy pulling",
+			Required: false,
+		},
+		&cli.BoolFlag{
+			Name:     "no-cache",
+			Usage:    "[Optional] Do not use the build cache when building the image",
+			Required: false,
+		},
+		&cli.StringFlag{
+			Name:     "cache-dir",
+			Usage:    "[Optional] `DIRECTORY` of the build cache. Empty value stands for the user's cache directory",
+			Required: false,
+			EnvVars:  []string{"BIMA_CACHE_DIR"},
+			Value:    "",
+		},
+		&cli.IntFlag{
+			Name:     "jobs",
+			Aliases:  []string{"j"},
+			Usage:    "[Optional] Number of `JOBS` creating layers concurrently. Zero stands for the number of CPUs",
+			Required: false,
+			Value:    0,
+		},
+		&cli.StringFlag{
+			Name:     "media-types",
+			Usage:    "[Optional] `MEDIA_TYPES` of the produced image manifest, config and layers. Possible values: [\"docker\", \"oci\"]",
+			Required: false,
+			Value:    "docker",
+		},
+		&cli.StringFlag{
+			Name:     "rootfs-format",
+			Usage:    "[Optional] Assemble the copied files, except the unikernel binary, in a filesystem image of the given `FORMAT`, referenced by the com.urunc.unikernel.block or com.urunc.unikernel.initrd annotation. ext2 images can also be mounted as ext4. Possible values: [\"ext2\", \"squashfs\", \"erofs\", \"initrd\"]",
+			Required: false,
+			Value:    "",
+		},
+		&cli.StringFlag{
+			Name:     "initrd-compression",
+			Usage:    "[Optional] `COMPRESSION` of initrd images. Possible values: [\"none\", \"gzip\", \"lz4\"]",
+			Required: false,
+			Value:    "none",
+		},
+		&cli.StringFlag{
+			Name:     "max-image-size",
+			Usage:    "[Optional] Fail the build if the unpacked size of the image exceeds `SIZE` (format: bytes, optionally followed by a unit, e.g. \"64MiB\")",
+			Required: false,
+			Value:    "",
+		},
+		&cli.StringFlag{
+			Name:     "max-layer-size",
+			Usage:    "[Optional] Fail the build if the unpacked size of any layer exceeds `SIZE` (format: bytes, optionally followed by a unit, e.g. \"16MiB\")",
+			Required: false,
+			Value:    "",
+		},
+		&cli.StringFlag{
+			Name:     "size-report",
+			Usage:    "[Optional] Print a report of the size of each layer and its largest files in the given `FORMAT`. Possible values: [\"text\", \"json\"]",
+			Required: false,
+			Value:    "",
+		},
+		&cli.StringFlag{
+			Name:     "urunc-json-schema",
+			Usage:    "[Optional] `SCHEMA` of the urunc.json file. \"legacy\" stands for the flat label map read by urunc releases, while \"1\" stands for the versioned document. Possible values: [\"legacy\", \"1\"]",
+			Required: false,
+			Value:    "legacy",
+		},
+		&cli.StringFlag{
+			Name:     "annotation-encoding",
+			Usage:    "[Optional] `ENCODING` of the label values in the image manifest annotations. \"both\" keeps the base64 values and adds plain copies under keys with a \".plain\" suffix. Possible values: [\"base64\", \"plain\", \"both\"]",
+			Required: false,
+			Value:    "base64",
+		},
+		&cli.BoolFlag{
+			Name:     "launch-config",
+			Usage:    "[Optional] Generate the launch configuration of the unikernel for its hypervisor (firecracker JSON or qemu arguments) in a dedicated layer",
+			Required: false,
+		},
+		&cli.BoolFlag{
+			Name:     "strip-debug",
+			Usage:    "[Optional] Strip the debug sections of the ELF unikernel binary, storing them along with its build-id in an OCI artifact referring to the image. Requires OCI media types",
+			Required: false,
+		},
+		&cli.StringFlag{
+			Name:     "compat-file",
+			Usage:    "[Optional] JSON `FILE` extending the built-in unikernel and hypervisor compatibility matrix. Empty value stands for compatibility.json in the user's bima config directory, if it exists",
+			Required: false,
+			Value:    "",
+			EnvVars:  []string{"BIMA_COMPAT_FILE"},
+		},
+		&cli.StringFlag{
+			Name:     "platform",
+			Usage:    "[Optional] Comma separated target `PLATFORMS` (format: \"os/arch[/variant]\"). Multiple platforms produce an OCI image index",
+			Required: false,
+			Value:    "",
+		},
+		&cli.StringSliceFlag{
+			Name:     "label",
+			Usage:    "[Optional] Set a `KEY=VALUE` label, overriding any LABEL instruction with the same key",
+			Required: false,
+		},
+		&cli.StringSliceFlag{
+			Name:     "annotation",
+			Usage:    "[Optional] Set a `KEY=VALUE` annotation in the image manifest, overriding the derived org.opencontainers.image.* annotations and the annotations of labels",
+			Required: false,
+		},
+		&cli.StringFlag{
+			Name:     "author",
+			Usage:    "[Optional] `AUTHOR` of the image",
+			Required: false,
+			Value:    "",
+		},
+	}
+}
+
+// bundleFlags returns the flags of the build command that apply to bundles,
+// along with the bundle specific ones
+func bundleFlags() []cli.Flag {
+	flags := []cli.Flag{
+		&cli.StringFlag{
+			Name:     "bundle",
+			Aliases:  []string{"b"},
+			Usage:    "[Optional] `DIRECTORY` of the produced bundle. It is created if it does not exist and must be empty otherwise",
+			Required: false,
+			Value:    "bundle",
+		},
+		&cli.StringFlag{
+			Name:     "image",
+			Aliases:  []string{"i"},
+			Usage:    "[Optional] Write the bundle of an image `ARCHIVE` produced by \"bima build --output=tar\", instead of building one",
+			Required: false,
+			Value:    "",
+		},
+		&cli.StringFlag{
+			Name:     "tag",
+			Aliases:  []string{"t"},
+			Usage:    "[Optional] Image `NAME` and optionally a tag (format: \"name:tag\")",
+			Required: false,
+			Value:    "bima/bundle:latest",
+		},
+	}
+	for _, flag := range buildFlags() {
+		switch flag.Names()[0] {
+		case "namespace", "address", "snapshotter", "output", "tar", "tag":
+			continue
+		}
+		flags = append(flags, flag)
 	}
+	return flags
 }
@@ -43,6 +43,8 @@ func main() {
 			return nil
 		},
 		Commands: extraBimaCommands(),
+		// label and annotation values may contain commas
+		DisableSliceFlagSeparator: true,
 	}
 
 	if err := app.Run(os.Args); err != nil {
@@ -24,21 +24,26 @@ import (
 
 // ArchOperation holds the information of the target architecture
 type ArchOperation struct {
-	Arch string
+	Arch    string
+	Variant string
 }
 
 // newCopyOperation creates a new label operation
-// based on the provided architecture
-func newArchOperation(architecture string) (ArchOperation, error) {
+// based on the provided architecture and variant
+func newArchOperation(architecture string, variant string) (ArchOperation, error) {
 	// TODO: Add verification based on valid architectures
 	return ArchOperation{
-		Arch: architecture,
+		Arch:    architecture,
+		Variant: variant,
 	}, nil
 
 }
 
 func (o ArchOperation) Line() string {
-	return o.Arch
+	if o.Variant != "" {
+		return "ARCH " + o.Arch + "/" + o.Variant
+	}
+	return "ARCH " + o.Arch
 }
 
 func (o ArchOperation) Info() string {
@@ -55,6 +60,7 @@ func (o ArchOperation) UpdateImage(image v1.Image) (v1.Image, error) {
 		return image, err
 	}
 	ociConfigFile.Architecture = o.Arch
+	ociConfigFile.Variant = o.Variant
 	newImage, err := mutate.ConfigFile(image, ociConfigFile)
 	if err != nil {
 		return image, err
@@ -0,0 +1,277 @@
+// Copyright 2023 Nubificus LTD.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+
+	"github.com/containerd/containerd/reference/docker"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+const (
+	// annotationRefName is the OCI annotation holding the reference of an image in an image layout
+	annotationRefName = "org.opencontainers.image.ref.name"
+	// annotationImageName is the annotation used by containerd to name imported images
+	annotationImageName = "io.containerd.image.name"
+	ociLayoutVersion    = "1.0.0"
+)
+
+// ociArchiveWriter writes an OCI image layout as a tarball
+type ociArchiveWriter struct {
+	tw    *tar.Writer
+	blobs map[v1.Hash]bool
+}
+
+// Referrer is an artifact saved along with the image it refers to,
+// named after the image tag with Suffix appended to the tag
+type Referrer struct {
+	Artifact v1.Image
+	Suffix   string
+}
+
+// SaveOCIArchive writes img as an OCI image layout tarball at filePath, along
+// with the given referrers. The archive can be imported to containerd, which
+// will name the image after tag.
+func SaveOCIArchive(img v1.Image, tag string, filePath string, referrers ...Referrer) error {
+	return writeOCIArchive(filePath, tag, img, referrers, func(w *ociArchiveWriter) error {
+		return w.writeImage(img)
+	})
+}
+
+// SaveOCIIndexArchive writes index and all of its images as an OCI image layout
+// tarball at filePath, along with the given referrers. The archive can be
+// imported to containerd, which will name the index after tag.
+func SaveOCIIndexArchive(index v1.ImageIndex, tag string, filePath string, referrers ...Referrer) error {
+	return writeOCIArchive(filePath, tag, index, referrers, func(w *ociArchiveWriter) error {
+		return w.writeImageIndex(index)
+	})
+}
+
+// writeOCIArchive creates the tarball at filePath, writes all blobs using
+// writeBlobs, as well as the referrers, and points index.json to root and
+// the referrers.
+func writeOCIArchive(filePath string, tag string, root partial.Describable, referrers []Referrer, writeBlobs func(*ociArchiveWriter) error) error {
+	f, err := os.Create(filePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := &ociArchiveWriter{
+		tw:    tar.NewWriter(f),
+		blobs: make(map[v1.Hash]bool),
+	}
+	err = writeBlobs(w)
+	if err != nil {
+		return err
+	}
+	desc, err := partial.Descriptor(root)
+	if err != nil {
+		return err
+	}
+	entries := []indexEntry{{desc: *desc, tag: tag}}
+	for _, referrer := range referrers {
+		err = w.writeImage(referrer.Artifact)
+		if err != nil {
+			return err
+		}
+		desc, err := partial.Descriptor(referrer.Artifact)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, indexEntry{desc: *desc, tag: tag, suffix: referrer.Suffix})
+	}
+	err = w.writeIndex(entries)
+	if err != nil {
+		return err
+	}
+	err = w.tw.Close()
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// writeImageIndex writes the blobs of all images in index, along with the index manifest
+func (w *ociArchiveWriter) writeImageIndex(index v1.ImageIndex) error {
+	indexManifest, err := index.IndexManifest()
+	if err != nil {
+		return err
+	}
+	for _, desc := range indexManifest.Manifests {
+		img, err := index.Image(desc.Digest)
+		if err != nil {
+			return err
+		}
+		err = w.writeImage(img)
+		if err != nil {
+			return err
+		}
+	}
+	digest, err := index.Digest()
+	if err != nil {
+		return err
+	}
+	rawManifest, err := index.RawManifest()
+	if err != nil {
+		return err
+	}
+	return w.writeBlob(digest, int64(len(rawManifest)), bytes.NewReader(rawManifest))
+}
+
+// writeImage writes the layers, config and manifest blobs of img
+func (w *ociArchiveWriter) writeImage(img v1.Image) error {
+	layers, err := img.Layers()
+	if err != nil {
+		return err
+	}
+	for _, layer := range layers {
+		digest, err := layer.Digest()
+		if err != nil {
+			return err
+		}
+		size, err := layer.Size()
+		if err != nil {
+			return err
+		}
+		rc, err := layer.Compressed()
+		if err != nil {
+			return err
+		}
+		err = w.writeBlob(digest, size, rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	configName, err := img.ConfigName()
+	if err != nil {
+		return err
+	}
+	rawConfig, err := img.RawConfigFile()
+	if err != nil {
+		return err
+	}
+	err = w.writeBlob(configName, int64(len(rawConfig)), bytes.NewReader(rawConfig))
+	if err != nil {
+		return err
+	}
+	digest, err := img.Digest()
+	if err != nil {
+		return err
+	}
+	rawManifest, err := img.RawManifest()
+	if err != nil {
+		return err
+	}
+	return w.writeBlob(digest, int64(len(rawManifest)), bytes.NewReader(rawManifest))
+}
+
+// writeBlob writes a blob under blobs/<algorithm>/<hex>, skipping blobs already written
+func (w *ociArchiveWriter) writeBlob(digest v1.Hash, size int64, r io.Reader) error {
+	if w.blobs[digest] {
+		return nil
+	}
+	w.blobs[digest] = true
+	err := w.tw.WriteHeader(&tar.Header{
+		Name:     path.Join("blobs", digest.Algorithm, digest.Hex),
+		Size:     size,
+		Mode:     0644,
+		Typeflag: tar.TypeReg,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.CopyN(w.tw, r, size)
+	return err
+}
+
+// indexEntry is a manifest of index.json, named after tag with suffix
+// appended to the tag
+type indexEntry struct {
+	desc   v1.Descriptor
+	tag    string
+	suffix string
+}
+
+// writeIndex writes the oci-layout and index.json files,
+// with index.json pointing to the given entries.
+func (w *ociArchiveWriter) writeIndex(entries []indexEntry) error {
+	manifests := []v1.Descriptor{}
+	for _, entry := range entries {
+		named, err := docker.ParseDockerRef(entry.tag)
+		if err != nil {
+			return err
+		}
+		if entry.suffix != "" {
+			tagged, ok := named.(docker.Tagged)
+			if !ok {
+				return fmt.Errorf("reference %q has no tag", named.String())
+			}
+			named, err = docker.WithTag(docker.TrimNamed(named), tagged.Tag()+entry.suffix)
+			if err != nil {
+				return err
+			}
+		}
+		desc := entry.desc
+		desc.Annotations = map[string]string{
+			annotationImageName: named.String(),
+			annotationRefName:   named.String(),
+		}
+		manifests = append(manifests, desc)
+	}
+	layout, err := json.Marshal(map[string]string{"imageLayoutVersion": ociLayoutVersion})
+	if err != nil {
+		return err
+	}
+	index, err := json.Marshal(v1.IndexManifest{
+		SchemaVersion: 2,
+		MediaType:     types.OCIImageIndex,
+		Manifests:     manifests,
+	})
+	if err != nil {
+		return err
+	}
+	files := []struct {
+		name    string
+		content []byte
+	}{
+		{"oci-layout", layout},
+		{"index.json", index},
+	}
+	for _, file := range files {
+		err := w.tw.WriteHeader(&tar.Header{
+			Name:     file.name,
+			Size:     int64(len(file.content)),
+			Mode:     0644,
+			Typeflag: tar.TypeReg,
+		})
+		if err != nil {
+			return err
+		}
+		if _, err := w.tw.Write(file.content); err != nil {
+			return err
+		}
+	}
+	return nil
+}
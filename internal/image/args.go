@@ -0,0 +1,145 @@
+// Copyright 2023 Nubificus LTD.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"fmt"
+	"strings"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// BuildArgs keeps track of the ARG instructions of a Containerfile and
+// expands the declared arguments in the instructions that follow them.
+type BuildArgs struct {
+	available map[string]string
+	declared  map[string]string
+}
+
+// NewBuildArgs creates a new BuildArgs. The available arguments, such as
+// TARGETARCH, can be used by the Containerfile once declared with ARG.
+func NewBuildArgs(available map[string]string) *BuildArgs {
+	return &BuildArgs{
+		available: available,
+		declared:  make(map[string]string),
+	}
+}
+
+// PlatformArgs returns the automatic platform arguments for the given target platform
+func PlatformArgs(platform v1.Platform) map[string]string {
+	return map[string]string{
+		"TARGETPLATFORM": platform.String(),
+		"TARGETOS":       platform.OS,
+		"TARGETARCH":     platform.Architecture,
+		"TARGETVARIANT":  platform.Variant,
+	}
+}
+
+// Expand declares the argument of an ARG instruction, or substitutes
+// the declared arguments in any other instruction. References to
+// undeclared arguments, such as shell variables in a LABEL value,
+// are kept as they are.
+func (a *BuildArgs) Expand(instruction InstructionLine) (InstructionLine, error) {
+	switch instruction.operation() {
+	case "NOOP":
+		return instruction, nil
+	case "ARG":
+		return instruction, a.declare(instruction)
+	}
+	return InstructionLine(a.expand(string(instruction))), nil
+}
+
+// expand substitutes the $NAME and ${NAME} references of the declared arguments in s
+func (a *BuildArgs) expand(s string) string {
+	var res strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '$' {
+			res.WriteByte(s[i])
+			continue
+		}
+		name, ref := argReference(s[i:])
+		if value, ok := a.declared[name]; ok {
+			res.WriteString(value)
+		} else {
+			if name != "" {
+				log.Debugf("Keeping reference to undeclared argument %q", name)
+			}
+			res.WriteString(ref)
+		}
+		i += len(ref) - 1
+	}
+	return res.String()
+}
+
+// argReference returns the argument name and the text of the $NAME or
+// ${NAME} reference at the start of s. The name is empty if s does not
+// start with a valid reference, in which case the reference is "$".
+func argReference(s string) (string, string) {
+	if strings.HasPrefix(s, "${") {
+		end := strings.IndexByte(s, '}')
+		if end < 0 || !isArgName(s[2:end]) {
+			return "", "$"
+		}
+		return s[2:end], s[:end+1]
+	}
+	end := 1
+	for end < len(s) && isArgNameChar(s[end], end == 1) {
+		end++
+	}
+	if end == 1 {
+		return "", "$"
+	}
+	return s[1:end], s[:end]
+}
+
+func isArgName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		if !isArgNameChar(name[i], i == 0) {
+			return false
+		}
+	}
+	return true
+}
+
+func isArgNameChar(c byte, first bool) bool {
+	if c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') {
+		return true
+	}
+	return !first && c >= '0' && c <= '9'
+}
+
+func (a *BuildArgs) declare(instruction InstructionLine) error {
+	parts := strings.Split(string(instruction), " ")
+	if len(parts) != 2 {
+		return fmt.Errorf("invalid ARG format: %q", instruction)
+	}
+	nameValue := strings.SplitN(parts[1], "=", 2)
+	name := nameValue[0]
+	if name == "" {
+		return fmt.Errorf("invalid ARG format: %q", instruction)
+	}
+	value := ""
+	if len(nameValue) == 2 {
+		value = strings.Trim(nameValue[1], "\"")
+	}
+	if available, ok := a.available[name]; ok {
+		value = available
+	}
+	a.declared[name] = value
+	return nil
+}
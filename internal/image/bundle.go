@@ -0,0 +1,487 @@
+// Copyright 2023 Nubificus LTD.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+const (
+	// bundleRootfs is the directory of the rootfs inside a bundle
+	bundleRootfs = "rootfs"
+	// bundleHostname is the hostname set in the bundle config
+	bundleHostname = "bima"
+	// bundleDefaultPath is the PATH of processes of images without one
+	bundleDefaultPath = "PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+	// holeChunkSize is the size of the zero chunks written as holes when extracting files
+	holeChunkSize = 64 << 10
+	// maxSymlinks is the number of symlinks followed when resolving an entry, like in Linux
+	maxSymlinks = 40
+)
+
+// WriteBundle writes img as an OCI runtime bundle in dir: a config.json holding
+// the process and the annotations of the image, along with its flattened rootfs.
+// The directory is created if it does not exist and must be empty otherwise.
+func WriteBundle(img v1.Image, dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err == nil && len(entries) > 0 {
+		return fmt.Errorf("bundle directory %q is not empty", dir)
+	}
+	rootfs := filepath.Join(dir, bundleRootfs)
+	if err := os.MkdirAll(rootfs, 0o755); err != nil {
+		return err
+	}
+	spec, err := bundleSpec(img)
+	if err != nil {
+		return err
+	}
+	config, err := json.MarshalIndent(spec, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, "config.json"), config, 0o644); err != nil {
+		return err
+	}
+	return extractRootfs(img, rootfs)
+}
+
+// bundleSpec returns the runtime config of img, with the defaults of "runc spec"
+// for the capabilities, rlimits, mounts, namespaces and masked paths of the
+// process, except for the terminal and the read-only rootfs, which are left
+// unset as urunc attaches no terminal and may write to the rootfs
+func bundleSpec(img v1.Image) (*specs.Spec, error) {
+	cfg, err := img.ConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := img.Manifest()
+	if err != nil {
+		return nil, err
+	}
+	args := append(append([]string{}, cfg.Config.Entrypoint...), cfg.Config.Cmd...)
+	env := cfg.Config.Env
+	if len(env) == 0 {
+		env = []string{bundleDefaultPath}
+	}
+	if len(manifest.Annotations) == 0 {
+		// Docker archives do not keep the manifest annotations
+		log.Warn("Image has no annotations, urunc will read the labels from urunc.json, which must use the legacy schema")
+	}
+	cwd := cfg.Config.WorkingDir
+	if cwd == "" {
+		cwd = "/"
+	}
+	return &specs.Spec{
+		Version: specs.Version,
+		Process: &specs.Process{
+			User: specs.User{UID: 0, GID: 0},
+			Args: args,
+			Env:  env,
+			Cwd:  cwd,
+			Capabilities: &specs.LinuxCapabilities{
+				Bounding:  bundleCapabilities(),
+				Effective: bundleCapabilities(),
+				Permitted: bundleCapabilities(),
+				Ambient:   bundleCapabilities(),
+			},
+			Rlimits:         []specs.POSIXRlimit{{Type: "RLIMIT_NOFILE", Hard: 1024, Soft: 1024}},
+			NoNewPrivileges: true,
+		},
+		Root:     &specs.Root{Path: bundleRootfs},
+		Hostname: bundleHostname,
+		Mounts: []specs.Mount{
+			{Destination: "/proc", Type: "proc", Source: "proc"},
+			{Destination: "/dev", Type: "tmpfs", Source: "tmpfs", Options: []string{"nosuid", "strictatime", "mode=755", "size=65536k"}},
+			{Destination: "/dev/pts", Type: "devpts", Source: "devpts", Options: []string{"nosuid", "noexec", "newinstance", "ptmxmode=0666", "mode=0620", "gid=5"}},
+			{Destination: "/dev/shm", Type: "tmpfs", Source: "shm", Options: []string{"nosuid", "noexec", "nodev", "mode=1777", "size=65536k"}},
+			{Destination: "/dev/mqueue", Type: "mqueue", Source: "mqueue", Options: []string{"nosuid", "noexec", "nodev"}},
+			{Destination: "/sys", Type: "sysfs", Source: "sysfs", Options: []string{"nosuid", "noexec", "nodev", "ro"}},
+			{Destination: "/sys/fs/cgroup", Type: "cgroup", Source: "cgroup", Options: []string{"nosuid", "noexec", "nodev", "relatime", "ro"}},
+		},
+		Annotations: manifest.Annotations,
+		Linux: &specs.Linux{
+			Namespaces: []specs.LinuxNamespace{
+				{Type: specs.PIDNamespace},
+				{Type: specs.NetworkNamespace},
+				{Type: specs.IPCNamespace},
+				{Type: specs.UTSNamespace},
+				{Type: specs.MountNamespace},
+			},
+			MaskedPaths: []string{
+				"/proc/acpi", "/proc/asound", "/proc/kcore", "/proc/keys", "/proc/latency_stats",
+				"/proc/timer_list", "/proc/timer_stats", "/proc/sched_debug", "/sys/firmware", "/proc/scsi",
+			},
+			ReadonlyPaths: []string{"/proc/bus", "/proc/fs", "/proc/irq", "/proc/sys", "/proc/sysrq-trigger"},
+		},
+	}, nil
+}
+
+// bundleCapabilities returns the default capabilities of "runc spec"
+func bundleCapabilities() []string {
+	return []string{"CAP_AUDIT_WRITE", "CAP_KILL", "CAP_NET_BIND_SERVICE"}
+}
+
+// extractRootfs writes the flattened filesystem of img to the rootfs directory
+func extractRootfs(img v1.Image, rootfs string) error {
+	rc := mutate.Extract(img)
+	defer rc.Close()
+	return extractTar(rc, rootfs)
+}
+
+// extractTar writes the entries of a tar stream to the rootfs directory
+func extractTar(r io.Reader, rootfs string) error {
+	tr := tar.NewReader(r)
+	count := 0
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read image filesystem - %v", err)
+		}
+		// entries are kept inside the rootfs, whatever their name and
+		// the symlinks of their parent directories
+		target, err := rootfsPath(rootfs, hdr.Name)
+		if err == nil {
+			err = removeExisting(target, hdr.Typeflag == tar.TypeDir)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to extract %q - %v", hdr.Name, err)
+		}
+		mode := os.FileMode(hdr.Mode).Perm()
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(target, mode|0o700)
+		case tar.TypeReg:
+			err = writeBundleFile(target, mode, hdr.Size, tr)
+			count++
+		case tar.TypeSymlink:
+			err = os.MkdirAll(filepath.Dir(target), 0o755)
+			if err == nil {
+				err = os.Symlink(hdr.Linkname, target)
+			}
+		case tar.TypeLink:
+			var source string
+			source, err = rootfsPath(rootfs, hdr.Linkname)
+			if err == nil {
+				err = os.Link(source, target)
+			}
+		default:
+			log.Warnf("Skipping %q of unsupported type %q", hdr.Name, hdr.Typeflag)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to extract %q - %v", hdr.Name, err)
+		}
+	}
+	log.Infof("Extracted %d files to %q", count, rootfs)
+	return nil
+}
+
+// rootfsPath returns the path of the entry name inside rootfs, resolving the
+// symlinks of its parent directories as if rootfs was the root directory,
+// so that entries can not be written outside of it through a symlink. The
+// entry itself is not resolved, as it is replaced when extracted.
+func rootfsPath(rootfs string, name string) (string, error) {
+	clean := filepath.Clean("/" + name)
+	if clean == "/" {
+		return rootfs, nil
+	}
+	pending := strings.Split(filepath.Dir(clean), "/")
+	resolved := "/"
+	links := 0
+	for len(pending) > 0 {
+		part := pending[0]
+		pending = pending[1:]
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			resolved = filepath.Dir(resolved)
+			continue
+		}
+		next := filepath.Join(resolved, part)
+		info, err := os.Lstat(filepath.Join(rootfs, next))
+		if err != nil || info.Mode()&os.ModeSymlink == 0 {
+			// missing parents are created as directories
+			resolved = next
+			continue
+		}
+		links++
+		if links > maxSymlinks {
+			return "", fmt.Errorf("too many levels of symbolic links")
+		}
+		link, err := os.Readlink(filepath.Join(rootfs, next))
+		if err != nil {
+			return "", err
+		}
+		if filepath.IsAbs(link) {
+			resolved = "/"
+		}
+		pending = append(strings.Split(link, "/"), pending...)
+	}
+	return filepath.Join(rootfs, resolved, filepath.Base(clean)), nil
+}
+
+// removeExisting removes an entry replaced by a later one, so that files are
+// not written through a symlink, unless both are directories
+func removeExisting(target string, isDir bool) error {
+	info, err := os.Lstat(target)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if isDir && info.IsDir() {
+		return nil
+	}
+	return os.RemoveAll(target)
+}
+
+// writeBundleFile writes the content of a file, leaving holes
+// in place of its zero chunks, like the sparse files of the layers
+func writeBundleFile(target string, mode os.FileMode, size int64, r io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	chunk := make([]byte, holeChunkSize)
+	zero := make([]byte, holeChunkSize)
+	for {
+		n, err := io.ReadFull(r, chunk)
+		if n > 0 {
+			if bytes.Equal(chunk[:n], zero[:n]) {
+				_, err = f.Seek(int64(n), io.SeekCurrent)
+			} else {
+				_, err = f.Write(chunk[:n])
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	// a trailing hole is only allocated by setting the size
+	if err := f.Truncate(size); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// LoadImage loads the image of the given platform from an image archive, as
+// saved by "bima build --output=tar": a Docker archive, or an OCI image layout
+// as a tarball or a directory. A nil platform stands for the first image of
+// the archive. The returned function removes any temporary files and must be
+// called once the image is no longer used.
+func LoadImage(path string, platform *v1.Platform) (v1.Image, func(), error) {
+	img, cleanup, err := loadImage(path, platform)
+	if err == nil {
+		err = checkPlatform(img, platform)
+	}
+	if err != nil {
+		cleanup()
+		return nil, func() {}, err
+	}
+	return img, cleanup, nil
+}
+
+// loadImage loads the image of the given platform, without checking the
+// platform of images whose descriptor does not hold one
+func loadImage(path string, platform *v1.Platform) (v1.Image, func(), error) {
+	noop := func() {}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, noop, err
+	}
+	if info.IsDir() {
+		img, err := layoutImage(path, platform)
+		return img, noop, err
+	}
+	isLayout, err := isOCIArchive(path)
+	if err != nil {
+		return nil, noop, err
+	}
+	if !isLayout {
+		img, err := tarball.ImageFromPath(path, nil)
+		return img, noop, err
+	}
+	// layout images read their blobs lazily, so the archive is unpacked
+	// to a directory kept until the image is no longer used
+	dir, err := os.MkdirTemp("", "bima-image-")
+	if err != nil {
+		return nil, noop, err
+	}
+	cleanup := func() {
+		os.RemoveAll(dir)
+	}
+	if err := untar(path, dir); err != nil {
+		cleanup()
+		return nil, noop, err
+	}
+	img, err := layoutImage(dir, platform)
+	if err != nil {
+		cleanup()
+		return nil, noop, err
+	}
+	return img, cleanup, nil
+}
+
+// checkPlatform checks that the config of img matches the given platform
+func checkPlatform(img v1.Image, platform *v1.Platform) error {
+	if platform == nil {
+		return nil
+	}
+	cfg, err := img.ConfigFile()
+	if err != nil {
+		return err
+	}
+	imgPlatform := cfg.Platform()
+	if imgPlatform == nil || !imgPlatform.Satisfies(*platform) {
+		return fmt.Errorf("image platform %q does not match %q", cfg.OS+"/"+cfg.Architecture, platform.String())
+	}
+	return nil
+}
+
+// isOCIArchive reports whether the tarball at path holds an OCI image layout
+func isOCIArchive(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return false, nil
+		}
+		if err != nil {
+			return false, fmt.Errorf("failed to read image archive %q - %v", path, err)
+		}
+		if filepath.Clean(hdr.Name) == "oci-layout" {
+			return true, nil
+		}
+	}
+}
+
+// untar extracts the regular files of the tarball at path to dir
+func untar(path string, dir string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		target := filepath.Join(dir, filepath.Clean("/"+hdr.Name))
+		if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+			return err
+		}
+		out, err := os.Create(target)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(out, tr)
+		out.Close()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// layoutImage returns the image of the given platform from the OCI image layout at dir
+func layoutImage(dir string, platform *v1.Platform) (v1.Image, error) {
+	index, err := layout.ImageIndexFromPath(dir)
+	if err != nil {
+		return nil, err
+	}
+	found := []string{}
+	img, err := indexImage(index, platform, &found)
+	if err != nil {
+		return nil, err
+	}
+	if img == nil && platform == nil {
+		return nil, fmt.Errorf("no image in %q", dir)
+	}
+	if img == nil {
+		return nil, fmt.Errorf("no image for platform %q, found %s", platform.String(), strings.Join(found, ", "))
+	}
+	return img, nil
+}
+
+// indexImage returns the image of the given platform from an image index,
+// looking into nested indexes, or nil, appending the platforms of the other
+// images to found. Images without a platform match any platform.
+func indexImage(index v1.ImageIndex, platform *v1.Platform, found *[]string) (v1.Image, error) {
+	manifest, err := index.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+	for _, desc := range manifest.Manifests {
+		switch {
+		case desc.MediaType.IsIndex():
+			nested, err := index.ImageIndex(desc.Digest)
+			if err != nil {
+				return nil, err
+			}
+			img, err := indexImage(nested, platform, found)
+			if img != nil || err != nil {
+				return img, err
+			}
+		case desc.ArtifactType != "":
+			// artifacts, such as debug artifacts, refer to the images
+			continue
+		case desc.MediaType.IsImage():
+			if platform == nil || desc.Platform == nil || desc.Platform.Satisfies(*platform) {
+				return index.Image(desc.Digest)
+			}
+			*found = append(*found, desc.Platform.String())
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,98 @@
+// Copyright 2023 Nubificus LTD.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExtractRootfsSymlinks(t *testing.T) {
+	outside := t.TempDir()
+	if err := os.WriteFile(filepath.Join(outside, "secret"), []byte("secret"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	entries := []struct {
+		hdr     tar.Header
+		content string
+	}{
+		{tar.Header{Name: "abs", Typeflag: tar.TypeSymlink, Linkname: outside}, ""},
+		{tar.Header{Name: "rel", Typeflag: tar.TypeSymlink, Linkname: "../../../../../../.." + outside}, ""},
+		{tar.Header{Name: "usr/lib/", Typeflag: tar.TypeDir, Mode: 0o755}, ""},
+		{tar.Header{Name: "lib", Typeflag: tar.TypeSymlink, Linkname: "usr/lib"}, ""},
+		{tar.Header{Name: "abs/pwned", Typeflag: tar.TypeReg, Mode: 0o644}, "abs"},
+		{tar.Header{Name: "rel/pwned", Typeflag: tar.TypeReg, Mode: 0o644}, "rel"},
+		{tar.Header{Name: "lib/libc.so", Typeflag: tar.TypeReg, Mode: 0o644}, "libc"},
+		{tar.Header{Name: "link", Typeflag: tar.TypeLink, Linkname: "abs/pwned"}, ""},
+		{tar.Header{Name: "abs", Typeflag: tar.TypeReg, Mode: 0o644}, "replaced"},
+	}
+	for _, entry := range entries {
+		hdr := entry.hdr
+		hdr.Size = int64(len(entry.content))
+		if err := tw.WriteHeader(&hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(entry.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	rootfs := t.TempDir()
+	// flattened images drop the entries under symlinks of the same layer,
+	// so the crafted stream is extracted directly
+	if err := extractTar(&buf, rootfs); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(filepath.Join(outside, "pwned")); err == nil {
+		t.Fatal("file was written outside of the rootfs through a symlink")
+	}
+	// the symlinks are resolved as if the rootfs was the root directory
+	for name, content := range map[string]string{
+		filepath.Join(outside, "pwned"): "rel",
+		"link":                          "rel",
+		"usr/lib/libc.so":               "libc",
+		"abs":                           "replaced",
+	} {
+		got, err := os.ReadFile(filepath.Join(rootfs, name))
+		if err != nil || string(got) != content {
+			t.Errorf("%s: read %q, %v, expected %q", name, got, err, content)
+		}
+	}
+
+	// hard links are resolved the same way, so the target is missing
+	buf.Reset()
+	tw = tar.NewWriter(&buf)
+	hdr := &tar.Header{Name: "secret", Typeflag: tar.TypeLink, Linkname: "rel/../abs/secret"}
+	if err := tw.WriteHeader(hdr); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	rootfs = t.TempDir()
+	if err := os.Symlink(outside, filepath.Join(rootfs, "abs")); err != nil {
+		t.Fatal(err)
+	}
+	if err := extractTar(&buf, rootfs); err == nil {
+		t.Error("hard link to a file outside of the rootfs was extracted")
+	}
+}
@@ -0,0 +1,330 @@
+// Copyright 2023 Nubificus LTD.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+const (
+	cacheBlobName     = "layer.blob"
+	cacheMetadataName = "layer.json"
+)
+
+// DefaultCacheDir returns the default directory of the build cache
+func DefaultCacheDir() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "bima"), nil
+}
+
+// LayerCache stores the compressed layers created by layer operations,
+// keyed by the instruction and the digest of its inputs.
+// It is safe for concurrent use.
+type LayerCache struct {
+	dir    string
+	mu     sync.Mutex
+	hits   int
+	misses int
+}
+
+// cacheMetadata holds everything needed to recreate a layer from its cached blob
+type cacheMetadata struct {
+	Digest      v1.Hash           `json:"digest"`
+	DiffID      v1.Hash           `json:"diffID"`
+	Size        int64             `json:"size"`
+	MediaType   types.MediaType   `json:"mediaType"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// NewLayerCache creates a new layer cache under dir
+func NewLayerCache(dir string) (*LayerCache, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	return &LayerCache{dir: dir}, nil
+}
+
+// Stats returns the number of cache hits and misses
+func (c *LayerCache) Stats() (int, int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.hits, c.misses
+}
+
+func (c *LayerCache) record(hit bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if hit {
+		c.hits++
+	} else {
+		c.misses++
+	}
+}
+
+// cacheKey computes the cache key of a layer, based on the instruction line,
+// the layer options and the content of the files that will be added to the layer.
+func cacheKey(line string, fileMap map[string][]byte, sparse map[string]*sparseFile, opts LayerOptions) (string, error) {
+	h := sha256.New()
+	fmt.Fprintf(h, "line:%s\n", line)
+	fmt.Fprintf(h, "estargz:%v\n", opts.EStargz)
+	fmt.Fprintf(h, "mediaType:%s\n", opts.MediaType)
+	if opts.EStargz {
+		fmt.Fprintf(h, "prioritized:%v\n", opts.PrioritizedFiles)
+	}
+	paths := []string{}
+	for p := range fileMap {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	for _, p := range paths {
+		fmt.Fprintf(h, "file:%s:%d\n", p, len(fileMap[p]))
+		h.Write(fileMap[p])
+	}
+	paths = []string{}
+	for p := range sparse {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	for _, p := range paths {
+		fmt.Fprintf(h, "sparse:%s:%d:%v\n", p, sparse[p].size, sparse[p].segments)
+		err := sparse[p].writeData(h)
+		if err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Get returns the cached layer for key, if it exists
+func (c *LayerCache) Get(key string) (v1.Layer, bool) {
+	entryDir := filepath.Join(c.dir, key)
+	content, err := os.ReadFile(filepath.Join(entryDir, cacheMetadataName))
+	if err != nil {
+		c.record(false)
+		return nil, false
+	}
+	var meta cacheMetadata
+	err = json.Unmarshal(content, &meta)
+	if err != nil {
+		log.Warnf("Ignoring corrupted cache entry %q - %v", key, err)
+		c.record(false)
+		return nil, false
+	}
+	blobPath := filepath.Join(entryDir, cacheBlobName)
+	info, err := os.Stat(blobPath)
+	if err != nil || info.Size() != meta.Size {
+		log.Warnf("Ignoring incomplete cache entry %q", key)
+		c.record(false)
+		return nil, false
+	}
+	layer := &cachedLayer{path: blobPath, meta: meta}
+	err = layer.verify()
+	if err != nil {
+		log.Warnf("Ignoring corrupted cache entry %q - %v", key, err)
+		c.record(false)
+		return nil, false
+	}
+	c.record(true)
+	return layer, true
+}
+
+// Put stores the compressed blob of layer in the cache under key and
+// returns the cached layer, which is read back from the stored blob
+func (c *LayerCache) Put(key string, layer v1.Layer) (v1.Layer, error) {
+	desc, err := partial.Descriptor(layer)
+	if err != nil {
+		return nil, err
+	}
+	diffID, err := layer.DiffID()
+	if err != nil {
+		return nil, err
+	}
+	meta := cacheMetadata{
+		Digest:      desc.Digest,
+		DiffID:      diffID,
+		Size:        desc.Size,
+		MediaType:   desc.MediaType,
+		Annotations: desc.Annotations,
+	}
+	metaContent, err := json.Marshal(meta)
+	if err != nil {
+		return nil, err
+	}
+
+	// Write the entry in a temporary directory and rename it,
+	// so that interrupted builds never leave partial entries behind
+	tmpDir, err := os.MkdirTemp(c.dir, "tmp-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmpDir)
+	blob, err := os.Create(filepath.Join(tmpDir, cacheBlobName))
+	if err != nil {
+		return nil, err
+	}
+	rc, err := layer.Compressed()
+	if err != nil {
+		blob.Close()
+		return nil, err
+	}
+	_, err = io.Copy(blob, rc)
+	rc.Close()
+	if err != nil {
+		blob.Close()
+		return nil, err
+	}
+	err = blob.Close()
+	if err != nil {
+		return nil, err
+	}
+	err = os.WriteFile(filepath.Join(tmpDir, cacheMetadataName), metaContent, 0600)
+	if err != nil {
+		return nil, err
+	}
+	entryDir := filepath.Join(c.dir, key)
+	err = os.RemoveAll(entryDir)
+	if err != nil {
+		return nil, err
+	}
+	err = os.Rename(tmpDir, entryDir)
+	if err != nil {
+		return nil, err
+	}
+	return &cachedLayer{path: filepath.Join(entryDir, cacheBlobName), meta: meta}, nil
+}
+
+// cachedLayer is a layer backed by a compressed blob in the build cache
+type cachedLayer struct {
+	path string
+	meta cacheMetadata
+}
+
+func (l *cachedLayer) Digest() (v1.Hash, error) {
+	return l.meta.Digest, nil
+}
+
+func (l *cachedLayer) DiffID() (v1.Hash, error) {
+	return l.meta.DiffID, nil
+}
+
+// Compressed returns the cached blob, checking that it still matches
+// the digest of the layer once it is read to the end
+func (l *cachedLayer) Compressed() (io.ReadCloser, error) {
+	f, err := os.Open(l.path)
+	if err != nil {
+		return nil, err
+	}
+	return &verifyingReadCloser{file: f, hash: sha256.New(), layer: l}, nil
+}
+
+func (l *cachedLayer) Uncompressed() (io.ReadCloser, error) {
+	rc, err := l.Compressed()
+	if err != nil {
+		return nil, err
+	}
+	zr, err := gzip.NewReader(rc)
+	if err != nil {
+		rc.Close()
+		return nil, err
+	}
+	return &gzipReadCloser{Reader: zr, file: rc}, nil
+}
+
+// verify reads the cached blob to check its size and digest
+func (l *cachedLayer) verify() error {
+	rc, err := l.Compressed()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	_, err = io.Copy(io.Discard, rc)
+	return err
+}
+
+func (l *cachedLayer) Size() (int64, error) {
+	return l.meta.Size, nil
+}
+
+func (l *cachedLayer) MediaType() (types.MediaType, error) {
+	return l.meta.MediaType, nil
+}
+
+// Descriptor preserves the annotations of the original layer, such as the eStargz TOC digest
+func (l *cachedLayer) Descriptor() (*v1.Descriptor, error) {
+	return &v1.Descriptor{
+		Digest:      l.meta.Digest,
+		Size:        l.meta.Size,
+		MediaType:   l.meta.MediaType,
+		Annotations: l.meta.Annotations,
+	}, nil
+}
+
+// verifyingReadCloser reads a cached blob, failing at its end
+// if its size or digest differ from the ones of the layer
+type verifyingReadCloser struct {
+	file  *os.File
+	hash  hash.Hash
+	n     int64
+	layer *cachedLayer
+}
+
+func (r *verifyingReadCloser) Read(p []byte) (int, error) {
+	n, err := r.file.Read(p)
+	r.hash.Write(p[:n])
+	r.n += int64(n)
+	if err == io.EOF {
+		digest := v1.Hash{Algorithm: "sha256", Hex: hex.EncodeToString(r.hash.Sum(nil))}
+		if r.n != r.layer.meta.Size || digest != r.layer.meta.Digest {
+			return n, fmt.Errorf("cached layer %q is %d bytes with digest %s, expected %d bytes with digest %s", r.layer.path, r.n, digest, r.layer.meta.Size, r.layer.meta.Digest)
+		}
+	}
+	return n, err
+}
+
+func (r *verifyingReadCloser) Close() error {
+	return r.file.Close()
+}
+
+// gzipReadCloser closes both the gzip reader and the underlying file
+type gzipReadCloser struct {
+	*gzip.Reader
+	file io.Closer
+}
+
+func (r *gzipReadCloser) Close() error {
+	err := r.Reader.Close()
+	if fileErr := r.file.Close(); err == nil {
+		err = fileErr
+	}
+	return err
+}
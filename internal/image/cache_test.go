@@ -0,0 +1,66 @@
+// Copyright 2023 Nubificus LTD.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLayerCacheCorruptedBlob(t *testing.T) {
+	cache, err := NewLayerCache(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	layer, err := newLayer(map[string][]byte{"/unikernel": []byte("unikernel binary")}, nil, LayerOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cached, err := cache.Put("key", layer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, _ := layer.Digest()
+	if got, _ := cached.Digest(); got != want {
+		t.Errorf("cached layer digest %s, expected %s", got, want)
+	}
+	if _, ok := cache.Get("key"); !ok {
+		t.Fatal("cached layer was not found")
+	}
+
+	// flip a byte, keeping the size of the blob
+	blobPath := filepath.Join(cache.dir, "key", cacheBlobName)
+	blob, err := os.ReadFile(blobPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob[len(blob)/2] ^= 0xff
+	if err := os.WriteFile(blobPath, blob, 0600); err != nil {
+		t.Fatal(err)
+	}
+	rc, err := cached.Compressed()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	if _, err := io.Copy(io.Discard, rc); err == nil {
+		t.Error("corrupted cached blob was read without an error")
+	}
+	if _, ok := cache.Get("key"); ok {
+		t.Error("corrupted cache entry was used")
+	}
+}
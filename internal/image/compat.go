@@ -0,0 +1,144 @@
+// Copyright 2023 Nubificus LTD.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// compatibilityFileName is the name of the compatibility file in the user's config directory
+const compatibilityFileName = "compatibility.json"
+
+// UnikernelSupport lists the hypervisors a type of unikernel runs on
+// and the optional annotations it accepts
+type UnikernelSupport struct {
+	Hypervisors []string `json:"hypervisors"`
+	Annotations []string `json:"annotations,omitempty"`
+}
+
+// CompatibilityMatrix maps the supported unikernel types to their support
+type CompatibilityMatrix map[string]UnikernelSupport
+
+// compatibilityFile is the format of files extending the compatibility matrix
+type compatibilityFile struct {
+	Unikernels CompatibilityMatrix `json:"unikernels"`
+}
+
+// blockAnnotations are the annotations of unikernels that can use a block device
+var blockAnnotations = []string{blockAnnotation, blockFsTypeAnnotation, blockReadOnlyAnnotation, useDMBlockAnnotation}
+
+// DefaultCompatibilityMatrix returns the unikernel and hypervisor
+// combinations known to be supported by urunc, as listed in
+// https://github.com/nubificus/urunc/blob/main/README.md. Other
+// combinations can be enabled with a compatibility file.
+func DefaultCompatibilityMatrix() CompatibilityMatrix {
+	return CompatibilityMatrix{
+		"rumprun": {
+			Hypervisors: []string{"hvt", "qemu"},
+			Annotations: append([]string{blkMntPointAnnotation}, blockAnnotations...),
+		},
+		"unikraft": {
+			Hypervisors: []string{"qemu", "firecracker"},
+			Annotations: append([]string{initrdAnnotation, blkMntPointAnnotation}, blockAnnotations...),
+		},
+		"mirage": {
+			Hypervisors: []string{"hvt", "spt"},
+			Annotations: append([]string{}, blockAnnotations...),
+		},
+		"linux": {
+			Hypervisors: []string{"qemu", "firecracker"},
+			Annotations: append([]string{initrdAnnotation, blkMntPointAnnotation, mountRootfsAnnotation, kernelCmdlineAnnotation}, blockAnnotations...),
+		},
+	}
+}
+
+// DefaultCompatibilityFile returns the default path of the file
+// extending the compatibility matrix
+func DefaultCompatibilityFile() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "bima", compatibilityFileName), nil
+}
+
+// LoadCompatibilityMatrix returns the default compatibility matrix, extended
+// with the unikernel types, hypervisors and annotations of the given file.
+// Annotations may be given without the "com.urunc.unikernel." prefix.
+func LoadCompatibilityMatrix(path string) (CompatibilityMatrix, error) {
+	matrix := DefaultCompatibilityMatrix()
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file compatibilityFile
+	dec := json.NewDecoder(bytes.NewReader(content))
+	dec.DisallowUnknownFields()
+	err = dec.Decode(&file)
+	if err != nil {
+		return nil, fmt.Errorf("invalid compatibility file %q - %v", path, err)
+	}
+	for unikernelType, extra := range file.Unikernels {
+		if unikernelType == "" {
+			return nil, fmt.Errorf("invalid compatibility file %q - empty unikernel type", path)
+		}
+		support := matrix[unikernelType]
+		for _, hypervisor := range extra.Hypervisors {
+			if !contains(support.Hypervisors, hypervisor) {
+				support.Hypervisors = append(support.Hypervisors, hypervisor)
+			}
+		}
+		for _, annotation := range extra.Annotations {
+			if !strings.Contains(annotation, ".") {
+				annotation = unikernelAnnotationPrefix + annotation
+			}
+			if !contains(support.Annotations, annotation) {
+				support.Annotations = append(support.Annotations, annotation)
+			}
+		}
+		matrix[unikernelType] = support
+		log.Debugf("Unikernel type %q supports hypervisors %v", unikernelType, support.Hypervisors)
+	}
+	return matrix, nil
+}
+
+// UnikernelTypes returns the sorted unikernel types of the matrix
+func (m CompatibilityMatrix) UnikernelTypes() []string {
+	types := []string{}
+	for t := range m {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// knownAnnotation reports whether any unikernel type supports the annotation
+func (m CompatibilityMatrix) knownAnnotation(key string) bool {
+	if contains(commonAnnotations, key) {
+		return true
+	}
+	for _, support := range m {
+		if contains(support.Annotations, key) {
+			return true
+		}
+	}
+	return false
+}
@@ -20,7 +20,6 @@ import (
 	"path/filepath"
 	"strings"
 
-	"github.com/google/go-containerregistry/pkg/crane"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/google/go-containerregistry/pkg/v1/mutate"
 	l "github.com/nubificus/bima/internal/log"
@@ -35,6 +34,7 @@ type CopyOperation struct {
 	Source      string
 	Destination string
 	line        string
+	lineNumber  int
 }
 
 // newCopyOperation creates a new copy operation
@@ -52,6 +52,10 @@ func newCopyOperation(instructionLine InstructionLine) (CopyOperation, error) {
 	if err != nil {
 		return CopyOperation{}, err
 	}
+	// a trailing slash copies a file into the destination directory
+	if strings.HasSuffix(parts[2], "/") && dest != "/" {
+		dest += "/"
+	}
 	return CopyOperation{
 		Source:      source,
 		Destination: dest,
@@ -72,81 +76,124 @@ func (o CopyOperation) Type() string {
 }
 
 func (o CopyOperation) UpdateImage(image v1.Image) (v1.Image, error) {
-	log.Debugf("Checking path: %q", o.Source)
+	layer, err := o.Layer(LayerOptions{})
+	if err != nil {
+		return nil, err
+	}
+	newImage, err := mutate.AppendLayers(image, layer)
+	if err != nil {
+		return nil, err
+	}
+	return newImage, nil
+}
 
-	fileMap := make(map[string][]byte)
-	transformedMap := make(map[string][]byte)
-	exists, err := utils.DirExists(o.Source)
+// Layer creates the layer holding the copied files
+func (o CopyOperation) Layer(opts LayerOptions) (v1.Layer, error) {
+	files, sparse, err := o.Files()
 	if err != nil {
 		return nil, err
 	}
-	if exists {
-		err := scanDirectory(o.Source, fileMap)
+	return newLayer(files, sparse, opts)
+}
+
+// Files returns the copied files, keyed by their path inside the image rootfs.
+// Files with holes are returned separately as sparse files.
+func (o CopyOperation) Files() (map[string][]byte, map[string]*sparseFile, error) {
+	sources, fromDir, err := o.sources()
+	if err != nil {
+		return nil, nil, err
+	}
+	fileMap := make(map[string][]byte)
+	sparseMap := make(map[string]*sparseFile)
+	for _, source := range sources {
+		fileContent, sparse, err := readFile(source)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
-	} else {
-		fileContent, err := os.ReadFile(o.Source)
-		if err != nil {
-			return nil, err
+		if sparse != nil {
+			sparseMap[o.transform(source, fromDir)] = sparse
+		} else {
+			fileMap[o.transform(source, fromDir)] = fileContent
 		}
-		fileMap[o.Source] = fileContent
 	}
-	log.Debugf("Found %v files in %q", len(fileMap), o.Source)
-	if len(fileMap) == 0 {
-		return nil, fmt.Errorf("%q does not exist or is empty", o.Source)
-	}
-	if len(fileMap) == 1 {
-		for filePath, fileContent := range fileMap {
-			if strings.HasSuffix(o.Destination, "/") {
-				fileName := filepath.Base(filePath)
-				newPath := filepath.Join(o.Destination, fileName)
-				log.Tracef("Transformed %q to %q", filePath, newPath)
+	return fileMap, sparseMap, nil
+}
 
-				transformedMap[newPath] = fileContent
-			} else {
-				transformedMap[o.Destination] = fileContent
-				log.Tracef("Transformed %q to %q", filePath, o.Destination)
+// placements returns the local paths of the copied files,
+// keyed by their path inside the image rootfs
+func (o CopyOperation) placements() (map[string]string, error) {
+	sources, fromDir, err := o.sources()
+	if err != nil {
+		return nil, err
+	}
+	placements := make(map[string]string)
+	for _, source := range sources {
+		placements[o.transform(source, fromDir)] = source
+	}
+	return placements, nil
+}
 
-			}
+// sources returns the local paths of the copied files,
+// and whether they were found in a source directory
+func (o CopyOperation) sources() ([]string, bool, error) {
+	log.Debugf("Checking path: %q", o.Source)
+	sources := []string{}
+	exists, err := utils.DirExists(o.Source)
+	if err != nil {
+		return nil, false, err
+	}
+	if exists {
+		err := scanDirectory(o.Source, &sources)
+		if err != nil {
+			return nil, false, err
 		}
 	} else {
-		for filePath, fileContent := range fileMap {
-			newPath := strings.Replace(filePath, o.Source, o.Destination, 1)
-			transformedMap[newPath] = fileContent
-			log.Tracef("Transformed %q to %q", filePath, newPath)
-		}
+		sources = append(sources, o.Source)
 	}
-	layer, err := crane.Layer(transformedMap)
-	if err != nil {
-		return nil, err
+	log.Debugf("Found %v files in %q", len(sources), o.Source)
+	if len(sources) == 0 {
+		return nil, false, fmt.Errorf("%q does not exist or is empty", o.Source)
 	}
-	newImage, err := mutate.AppendLayers(image, layer)
-	if err != nil {
-		return nil, err
+	return sources, exists, nil
+}
+
+// transform returns the path inside the image rootfs of a copied file.
+// Files of a source directory keep their path relative to it, under the
+// destination directory.
+func (o CopyOperation) transform(filePath string, fromDir bool) string {
+	var newPath string
+	switch {
+	case fromDir:
+		rel, err := filepath.Rel(o.Source, filePath)
+		if err != nil {
+			rel = filepath.Base(filePath)
+		}
+		newPath = filepath.Join(o.Destination, rel)
+	case strings.HasSuffix(o.Destination, "/"):
+		newPath = filepath.Join(o.Destination, filepath.Base(filePath))
+	default:
+		newPath = o.Destination
 	}
-	return newImage, nil
+	log.Tracef("Transformed %q to %q", filePath, newPath)
+	return newPath
 }
 
-func scanDirectory(dirPath string, fileMap map[string][]byte) error {
-	files, err := os.ReadDir(dirPath)
+// scanDirectory appends the paths of the files under dirPath to files
+func scanDirectory(dirPath string, files *[]string) error {
+	entries, err := os.ReadDir(dirPath)
 	if err != nil {
 		return err
 	}
-	for _, file := range files {
-		filePath := filepath.Join(dirPath, file.Name())
+	for _, entry := range entries {
+		filePath := filepath.Join(dirPath, entry.Name())
 
-		if file.IsDir() {
-			err := scanDirectory(filePath, fileMap)
+		if entry.IsDir() {
+			err := scanDirectory(filePath, files)
 			if err != nil {
 				return err
 			}
 		} else {
-			fileContent, err := os.ReadFile(filePath)
-			if err != nil {
-				return err
-			}
-			fileMap[filePath] = fileContent
+			*files = append(*files, filePath)
 		}
 	}
 	return nil
@@ -0,0 +1,125 @@
+// Copyright 2023 Nubificus LTD.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"path"
+	"path/filepath"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/static"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+const (
+	// DebugArtifactType is the config media type of the artifacts holding
+	// the debug file of a stripped unikernel binary
+	DebugArtifactType types.MediaType = "application/vnd.nubificus.bima.debug.config.v1+json"
+	// debugFileMediaType is the media type of the debug file layer
+	debugFileMediaType types.MediaType = "application/vnd.nubificus.bima.debug.elf.v1"
+	// debugBuildIDAnnotation holds the GNU build-id of the stripped binary
+	debugBuildIDAnnotation = "com.nubificus.bima.debug.buildID"
+	// debugBinaryAnnotation holds the in-image path of the stripped binary
+	debugBinaryAnnotation = "com.nubificus.bima.debug.binary"
+)
+
+// stripBinary strips the debug sections of the unikernel binary, if it is one
+// of the given files of the layer of the operation at index. The debug file
+// is kept to be stored in the debug artifact of the image.
+func (i *BimaImage) stripBinary(index int, files map[string][]byte, sparse map[string]*sparseFile) error {
+	if !i.opts.StripDebug || i.binary == "" {
+		return nil
+	}
+	binary := filepath.Join("/", i.binary)
+	for p, s := range sparse {
+		if filepath.Join("/", p) != binary {
+			continue
+		}
+		content, err := s.content()
+		if err != nil {
+			return err
+		}
+		delete(sparse, p)
+		files[p] = content
+	}
+	for p, content := range files {
+		if filepath.Join("/", p) != binary {
+			continue
+		}
+		stripped, err := stripDebug(content)
+		if err != nil {
+			return err
+		}
+		if stripped == nil {
+			log.Warnf("Unikernel binary %q is not an ELF file with debug sections, it will not be stripped", binary)
+			return nil
+		}
+		if stripped.buildID == "" {
+			log.Warnf("Unikernel binary %q has no build-id, its debug file can only be matched by the image", binary)
+		}
+		log.Infof("Stripped %d bytes of debug sections from %q", len(content)-len(stripped.stripped), binary)
+		files[p] = stripped.stripped
+		i.debugMu.Lock()
+		i.debug[index] = stripped
+		i.debugMu.Unlock()
+	}
+	return nil
+}
+
+// DebugArtifact returns an OCI artifact holding the debug file of the stripped
+// unikernel binary, with the image as its subject, or nil if the binary was not
+// stripped. It must be called once the image is complete, as it refers to the
+// image by its digest.
+func (i *BimaImage) DebugArtifact() (v1.Image, error) {
+	if !i.opts.StripDebug || i.binary == "" {
+		return nil, nil
+	}
+	// the binary of the image is the one placed by the last layer holding it
+	entry, err := i.fs.resolve(i.binary)
+	if err != nil {
+		return nil, err
+	}
+	stripped, ok := i.debug[entry.op]
+	if !ok {
+		return nil, nil
+	}
+	subject, err := partial.Descriptor(*i.Image)
+	if err != nil {
+		return nil, err
+	}
+	binary := filepath.Join("/", i.binary)
+	artifact := mutate.MediaType(empty.Image, types.OCIManifestSchema1)
+	artifact = mutate.ConfigMediaType(artifact, DebugArtifactType)
+	artifact, err = mutate.Append(artifact, mutate.Addendum{
+		Layer:       static.NewLayer(stripped.debug, debugFileMediaType),
+		Annotations: map[string]string{AnnotationTitle: path.Base(binary) + ".debug"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	annotations := map[string]string{debugBinaryAnnotation: binary}
+	if stripped.buildID != "" {
+		annotations[debugBuildIDAnnotation] = stripped.buildID
+	}
+	artifact = mutate.Annotations(artifact, annotations).(v1.Image)
+	return mutate.Subject(artifact, v1.Descriptor{
+		MediaType: subject.MediaType,
+		Size:      subject.Size,
+		Digest:    subject.Digest,
+	}).(v1.Image), nil
+}
@@ -0,0 +1,295 @@
+// Copyright 2023 Nubificus LTD.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"bytes"
+	"debug/elf"
+	"debug/pe"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// errUnknownFormat is returned by a format detector when the binary is not of its format
+var errUnknownFormat = errors.New("unknown binary format")
+
+// archInfo holds the architecture of a binary, using the OCI platform naming
+type archInfo struct {
+	Arch    string
+	Variant string
+}
+
+// binaryInfo holds the information detected from the headers of a binary
+type binaryInfo struct {
+	archInfo
+	// KernelVersion is the release of a Linux kernel image, if known
+	KernelVersion string
+	// Kernel reports whether the binary is a Linux kernel image
+	Kernel bool
+}
+
+func (a archInfo) String() string {
+	if a.Variant != "" {
+		return a.Arch + "/" + a.Variant
+	}
+	return a.Arch
+}
+
+// elfArch maps an ELF machine, class and byte order to an architecture
+type elfArch struct {
+	machine elf.Machine
+	class   elf.Class
+	order   binary.ByteOrder
+	arch    archInfo
+}
+
+var elfArchs = []elfArch{
+	{elf.EM_X86_64, elf.ELFCLASS64, binary.LittleEndian, archInfo{Arch: "amd64"}},
+	{elf.EM_386, elf.ELFCLASS32, binary.LittleEndian, archInfo{Arch: "386"}},
+	{elf.EM_AARCH64, elf.ELFCLASS64, binary.LittleEndian, archInfo{Arch: "arm64"}},
+	{elf.EM_ARM, elf.ELFCLASS32, binary.LittleEndian, archInfo{Arch: "arm", Variant: "v7"}},
+	{elf.EM_RISCV, elf.ELFCLASS64, binary.LittleEndian, archInfo{Arch: "riscv64"}},
+	{elf.EM_PPC64, elf.ELFCLASS64, binary.LittleEndian, archInfo{Arch: "ppc64le"}},
+	{elf.EM_PPC64, elf.ELFCLASS64, binary.BigEndian, archInfo{Arch: "ppc64"}},
+	{elf.EM_S390, elf.ELFCLASS64, binary.BigEndian, archInfo{Arch: "s390x"}},
+}
+
+// peMachineRISCV64 is defined here, as debug/pe only provides it since go1.20
+const peMachineRISCV64 = 0x5064
+
+var peArchs = map[uint16]archInfo{
+	pe.IMAGE_FILE_MACHINE_AMD64: {Arch: "amd64"},
+	pe.IMAGE_FILE_MACHINE_I386:  {Arch: "386"},
+	pe.IMAGE_FILE_MACHINE_ARM64: {Arch: "arm64"},
+	pe.IMAGE_FILE_MACHINE_ARMNT: {Arch: "arm", Variant: "v7"},
+	peMachineRISCV64:            {Arch: "riscv64"},
+}
+
+// armCPUArchVariants maps the Tag_CPU_arch values of the ARM EABI attributes to OCI variants
+var armCPUArchVariants = map[uint64]string{
+	1:  "v5", // v4
+	2:  "v5", // v4T
+	3:  "v5", // v5T
+	4:  "v5", // v5TE
+	5:  "v5", // v5TEJ
+	6:  "v6",
+	7:  "v6", // v6KZ
+	8:  "v6", // v6T2
+	9:  "v6", // v6K
+	10: "v7",
+	11: "v6", // v6-M
+	12: "v6", // v6S-M
+	13: "v7", // v7E-M
+	14: "v8",
+}
+
+// formatDetector detects the architecture of binaries of a specific format.
+// It returns errUnknownFormat if the binary is not of its format.
+type formatDetector struct {
+	name   string
+	detect func(r io.ReaderAt) (binaryInfo, error)
+}
+
+// formatDetectors are tried in order. Linux kernel formats come before PE,
+// as kernels built with an EFI stub are valid PE files as well.
+var formatDetectors []formatDetector
+
+func init() {
+	formatDetectors = []formatDetector{
+		{"ELF", detectELFArch},
+		{"x86 Linux kernel bzImage", detectBzImageArch},
+		{"arm64 Linux kernel Image", detectArm64ImageArch},
+		{"arm Linux kernel zImage", detectZImageArch},
+		{"U-Boot uImage", detectUImageArch},
+		{"PE", detectPEArch},
+		{"compressed Linux kernel", detectCompressedKernelArch},
+	}
+}
+
+// detectArch detects the architecture of the binary at the given path
+func detectArch(binaryPath string) (binaryInfo, error) {
+	f, err := os.Open(binaryPath)
+	if err != nil {
+		return binaryInfo{}, err
+	}
+	defer f.Close()
+	info, name, err := detectFormat(f, formatDetectors)
+	if err != nil {
+		if name == "" {
+			return binaryInfo{}, fmt.Errorf("failed to detect architecture of %q - %v", binaryPath, err)
+		}
+		return binaryInfo{}, fmt.Errorf("failed to detect architecture of %s binary %q - %v", name, binaryPath, err)
+	}
+	log.Debugf("Detected %s binary %q for %q", name, binaryPath, info)
+	// ELF and PE binaries are only kernels if they hold a kernel version banner
+	info.Kernel = (name != "ELF" && name != "PE") || info.KernelVersion != ""
+	if info.KernelVersion != "" {
+		log.Debugf("Detected Linux kernel version %q", info.KernelVersion)
+	}
+	return info, nil
+}
+
+// detectFormat runs the given detectors in order and returns the result of the
+// first one that recognizes the format of r, along with the format name.
+func detectFormat(r io.ReaderAt, detectors []formatDetector) (binaryInfo, string, error) {
+	for _, detector := range detectors {
+		info, err := detector.detect(r)
+		if errors.Is(err, errUnknownFormat) {
+			continue
+		}
+		return info, detector.name, err
+	}
+	return binaryInfo{}, "", errUnknownFormat
+}
+
+func detectELFArch(r io.ReaderAt) (binaryInfo, error) {
+	var magic [4]byte
+	if _, err := r.ReadAt(magic[:], 0); err != nil || string(magic[:]) != elf.ELFMAG {
+		return binaryInfo{}, errUnknownFormat
+	}
+	elfFile, err := elf.NewFile(r)
+	if err != nil {
+		return binaryInfo{}, err
+	}
+	defer elfFile.Close()
+	for _, a := range elfArchs {
+		if a.machine != elfFile.Machine || a.class != elfFile.Class || a.order != elfFile.ByteOrder {
+			continue
+		}
+		info := binaryInfo{archInfo: a.arch}
+		if a.machine == elf.EM_ARM {
+			if variant := armVariant(elfFile); variant != "" {
+				info.Variant = variant
+			}
+		}
+		// an uncompressed vmlinux keeps its version banner in .rodata
+		if section := elfFile.Section(".rodata"); section != nil && section.Type != elf.SHT_NOBITS {
+			info.KernelVersion, err = findKernelVersion(section.Open())
+			if err != nil {
+				return binaryInfo{}, err
+			}
+		}
+		return info, nil
+	}
+	return binaryInfo{}, fmt.Errorf("unsupported ELF machine %v (%v, %v)", elfFile.Machine, elfFile.Class, elfFile.Data)
+}
+
+func detectPEArch(r io.ReaderAt) (binaryInfo, error) {
+	var dosHeader [64]byte
+	if _, err := r.ReadAt(dosHeader[:], 0); err != nil || dosHeader[0] != 'M' || dosHeader[1] != 'Z' {
+		return binaryInfo{}, errUnknownFormat
+	}
+	var signature [4]byte
+	peOffset := int64(binary.LittleEndian.Uint32(dosHeader[0x3c:]))
+	if _, err := r.ReadAt(signature[:], peOffset); err != nil || !bytes.Equal(signature[:], []byte("PE\x00\x00")) {
+		return binaryInfo{}, errUnknownFormat
+	}
+	peFile, err := pe.NewFile(r)
+	if err != nil {
+		return binaryInfo{}, err
+	}
+	defer peFile.Close()
+	arch, ok := peArchs[peFile.FileHeader.Machine]
+	if !ok {
+		return binaryInfo{}, fmt.Errorf("unsupported PE machine %#x", peFile.FileHeader.Machine)
+	}
+	return binaryInfo{archInfo: arch}, nil
+}
+
+// armVariant returns the variant of a 32-bit arm ELF binary, based on the
+// Tag_CPU_arch attribute of its .ARM.attributes section, or an empty string
+// if the attribute can not be found.
+func armVariant(f *elf.File) string {
+	section := f.Section(".ARM.attributes")
+	if section == nil {
+		return ""
+	}
+	data, err := section.Data()
+	if err != nil || len(data) == 0 || data[0] != 'A' {
+		return ""
+	}
+	data = data[1:]
+	for len(data) >= 4 {
+		sectionLen := int(f.ByteOrder.Uint32(data))
+		if sectionLen < 4 || sectionLen > len(data) {
+			return ""
+		}
+		vendorSection := data[4:sectionLen]
+		data = data[sectionLen:]
+		vendorEnd := bytes.IndexByte(vendorSection, 0)
+		if vendorEnd < 0 || string(vendorSection[:vendorEnd]) != "aeabi" {
+			continue
+		}
+		subsections := vendorSection[vendorEnd+1:]
+		for len(subsections) >= 5 {
+			tag := subsections[0]
+			subsectionLen := int(f.ByteOrder.Uint32(subsections[1:]))
+			if subsectionLen < 5 || subsectionLen > len(subsections) {
+				return ""
+			}
+			attributes := subsections[5:subsectionLen]
+			subsections = subsections[subsectionLen:]
+			// only file wide attributes are of interest
+			if tag != 1 {
+				continue
+			}
+			if cpuArch, ok := armCPUArch(attributes); ok {
+				return armCPUArchVariants[cpuArch]
+			}
+		}
+	}
+	return ""
+}
+
+// armCPUArch returns the value of the Tag_CPU_arch attribute
+func armCPUArch(attributes []byte) (uint64, bool) {
+	for len(attributes) > 0 {
+		tag, n := binary.Uvarint(attributes)
+		if n <= 0 {
+			return 0, false
+		}
+		attributes = attributes[n:]
+		isString := tag == 4 || tag == 5 || tag == 67 || (tag > 32 && tag%2 == 1)
+		if tag == 32 {
+			// Tag_compatibility holds a flag followed by a vendor name
+			_, n := binary.Uvarint(attributes)
+			if n <= 0 {
+				return 0, false
+			}
+			attributes = attributes[n:]
+			isString = true
+		}
+		if isString {
+			end := bytes.IndexByte(attributes, 0)
+			if end < 0 {
+				return 0, false
+			}
+			attributes = attributes[end+1:]
+			continue
+		}
+		val, n := binary.Uvarint(attributes)
+		if n <= 0 {
+			return 0, false
+		}
+		attributes = attributes[n:]
+		if tag == 6 {
+			return val, true
+		}
+	}
+	return 0, false
+}
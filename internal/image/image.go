@@ -17,23 +17,37 @@ package image
 import (
 	"encoding/json"
 	"fmt"
-	"os"
 	"path/filepath"
+	"runtime"
 	"strings"
+	"sync"
 
-	"debug/elf"
-	"debug/pe"
-
-	"github.com/google/go-containerregistry/pkg/crane"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/google/go-containerregistry/pkg/v1/empty"
 	"github.com/google/go-containerregistry/pkg/v1/mutate"
 	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/types"
 	"github.com/nubificus/bima/internal/utils"
+	"golang.org/x/sync/errgroup"
+)
+
+// Supported sets of media types for the produced images
+const (
+	MediaTypesDocker = "docker"
+	MediaTypesOCI    = "oci"
 )
 
-func baseImage() (*v1.Image, error) {
+// SupportedMediaTypes returns a list of all supported sets of media types
+func SupportedMediaTypes() []string {
+	return []string{MediaTypesDocker, MediaTypesOCI}
+}
+
+func baseImage(mediaTypes string) (*v1.Image, error) {
 	newImage := empty.Image
+	if mediaTypes == MediaTypesOCI {
+		newImage = mutate.MediaType(newImage, types.OCIManifestSchema1)
+		newImage = mutate.ConfigMediaType(newImage, types.OCIConfigJSON)
+	}
 	ociConfigFile, err := partial.ConfigFile(newImage)
 	if err != nil {
 		return nil, err
@@ -46,26 +60,151 @@ func baseImage() (*v1.Image, error) {
 	return &newImage, nil
 }
 
+// BuildOptions holds the settings that affect how a BimaImage is assembled.
+type BuildOptions struct {
+	// EStargz writes the image layers as eStargz for lazy pulling
+	EStargz bool
+	// Cache is used to reuse unchanged layers. A nil Cache disables caching
+	Cache *LayerCache
+	// Jobs is the number of layers created concurrently. Zero stands for the number of CPUs
+	Jobs int
+	// MediaTypes selects between Docker and OCI media types. Empty stands for Docker
+	MediaTypes string
+	// Platform is the target platform of the image. If nil, the architecture
+	// is extracted from the unikernel binary
+	Platform *v1.Platform
+	// RootfsFormat is the format of the filesystem image assembled from the
+	// copied files. Empty stands for no filesystem image
+	RootfsFormat string
+	// InitrdCompression is the compression of initrd images. Empty stands for none
+	InitrdCompression string
+	// Compatibility is the matrix the unikernel labels are validated against.
+	// Nil stands for the built-in matrix
+	Compatibility CompatibilityMatrix
+	// UruncJSONSchema is the schema of urunc.json. Empty stands for the
+	// legacy schema
+	UruncJSONSchema string
+	// AnnotationEncoding is the encoding of the label values in the manifest
+	// annotations. Empty stands for base64
+	AnnotationEncoding string
+	// LaunchConfig generates the launch configuration of the unikernel
+	// for its hypervisor
+	LaunchConfig bool
+	// StripDebug strips the debug sections of the unikernel binary,
+	// keeping them in a debug artifact
+	StripDebug bool
+}
+
 type BimaImage struct {
 	Image  *v1.Image
 	labels []LabelOperation
-	copies []CopyOperation
-	arch   string
+	// fs tracks the files the layers place in the image rootfs
+	fs          *virtualFS
+	arch        binaryInfo
+	opts        BuildOptions
+	prioritized []string
+	// binary is the in-image path of the unikernel binary
+	binary string
+	// rootfsFiles are the copied files kept out of the layers,
+	// to be assembled in a filesystem image
+	rootfsFiles map[string][]byte
+	// initrdPaths are the paths selected by INITRD instructions
+	initrdPaths []string
+	// applied is the number of operations applied to the image, which
+	// is the index of the next operation
+	applied int
+	// debug holds the debug files split from the unikernel binary,
+	// keyed by the index of the operation of the layer holding the binary
+	debug   map[int]*strippedELF
+	debugMu sync.Mutex
 }
 
-func NewBimaImage() (*BimaImage, error) {
-	img, err := baseImage()
+func NewBimaImage(opts BuildOptions) (*BimaImage, error) {
+	img, err := baseImage(opts.MediaTypes)
 	if err != nil {
 		return nil, err
 	}
 	return &BimaImage{
-		Image: img,
+		Image:       img,
+		opts:        opts,
+		fs:          newVirtualFS(),
+		rootfsFiles: make(map[string][]byte),
+		debug:       make(map[int]*strippedELF),
 	}, nil
 }
 
+// ApplyOperations applies all given operations to the image, in order.
+// The layers of layer operations are created concurrently beforehand.
+func (i *BimaImage) ApplyOperations(operations []BimaOperation) error {
+	// The unikernel binary and urunc.json are the first files read by urunc,
+	// so they are placed first in eStargz layers.
+	binary, err := unikernelBinary(operations)
+	if err != nil {
+		return err
+	}
+	i.binary = binary
+	if binary != "" {
+		i.prioritized = []string{binary, uruncJSONPath}
+	}
+	// INITRD instructions select the files packed in an initrd
+	i.initrdPaths = initrdPaths(operations)
+	if len(i.initrdPaths) > 0 {
+		if i.opts.RootfsFormat != "" && i.opts.RootfsFormat != RootfsFormatInitrd {
+			return fmt.Errorf("INITRD instructions can not be used with the %q rootfs format", i.opts.RootfsFormat)
+		}
+		i.opts.RootfsFormat = RootfsFormatInitrd
+	}
+	layers, rootfsFiles, err := i.createLayers(operations)
+	if err != nil {
+		return err
+	}
+	for idx, op := range operations {
+		err := i.applyOperation(op, layers[idx])
+		if err != nil {
+			return fmt.Errorf("ERROR: failed to add operation %v to image - %q", op, err.Error())
+		}
+		i.addRootfsFiles(rootfsFiles[idx])
+		log.Debug(op.Info())
+		log.Infof("Appending layer %q", op.Line())
+	}
+	if i.opts.Cache != nil {
+		hits, misses := i.opts.Cache.Stats()
+		log.Infof("Build cache: %d hits, %d misses", hits, misses)
+	}
+	return nil
+}
+
 func (i *BimaImage) ApplyOperation(operation BimaOperation) error {
+	var layer v1.Layer
+	var rootfsFiles map[string][]byte
+	if layerOp, ok := operation.(layerOperation); ok {
+		var err error
+		layer, rootfsFiles, err = i.createLayer(i.applied, layerOp)
+		if err != nil {
+			return err
+		}
+	}
+	err := i.applyOperation(operation, layer)
+	if err != nil {
+		return err
+	}
+	i.addRootfsFiles(rootfsFiles)
+	return nil
+}
+
+// applyOperation updates the image with the given operation. If the operation
+// is a layer operation, layer holds its already created layer.
+func (i *BimaImage) applyOperation(operation BimaOperation, layer v1.Layer) error {
 	img := *i.Image
-	newImg, err := operation.UpdateImage(img)
+	var newImg v1.Image
+	var err error
+	if layer == nil {
+		img, err = operation.UpdateImage(img)
+		if err != nil {
+			return err
+		}
+	}
+	newImg, err = appendHistory(img, layer, operation.Line())
 	if err != nil {
 		return err
 	}
@@ -74,11 +213,150 @@ func (i *BimaImage) ApplyOperation(operation BimaOperation) error {
 	if operation.Type() == "LABEL" {
 		i.labels = append(i.labels, operation.(LabelOperation))
 	} else if operation.Type() == "COPY" {
-		i.copies = append(i.copies, operation.(CopyOperation))
+		err = i.fs.addCopy(operation.(CopyOperation), i.applied)
+		if err != nil {
+			return err
+		}
 	}
+	i.applied++
 	return nil
 }
 
+// appendHistory appends layer to the image along with a history entry, so the
+// layer can be traced back to the instruction that created it. A nil layer
+// only adds a history entry, marked as an empty layer.
+func appendHistory(image v1.Image, layer v1.Layer, createdBy string) (v1.Image, error) {
+	return mutate.Append(image, mutate.Addendum{
+		Layer: layer,
+		History: v1.History{
+			CreatedBy:  createdBy,
+			EmptyLayer: layer == nil,
+		},
+	})
+}
+
+// createLayers creates the layers of all layer operations, using up to
+// opts.Jobs concurrent workers. The returned slices are indexed like operations,
+// with nil entries for operations that do not add a layer.
+func (i *BimaImage) createLayers(operations []BimaOperation) ([]v1.Layer, []map[string][]byte, error) {
+	layers := make([]v1.Layer, len(operations))
+	rootfsFiles := make([]map[string][]byte, len(operations))
+	jobs := i.opts.Jobs
+	if jobs <= 0 {
+		jobs = runtime.NumCPU()
+	}
+	log.Debugf("Creating layers with %d jobs", jobs)
+	// the operations are applied after the ones already applied
+	first := i.applied
+	g := new(errgroup.Group)
+	g.SetLimit(jobs)
+	for idx, op := range operations {
+		layerOp, ok := op.(layerOperation)
+		if !ok {
+			continue
+		}
+		idx := idx
+		g.Go(func() error {
+			layer, files, err := i.createLayer(first+idx, layerOp)
+			if err != nil {
+				return fmt.Errorf("ERROR: failed to create layer for %q - %q", layerOp.Line(), err.Error())
+			}
+			layers[idx] = layer
+			rootfsFiles[idx] = files
+			return nil
+		})
+	}
+	err := g.Wait()
+	if err != nil {
+		return nil, nil, err
+	}
+	return layers, rootfsFiles, nil
+}
+
+// createLayer creates the layer of a layer operation,
+// reusing a cached layer when its inputs have not changed.
+// When a filesystem image is built, it also returns the files
+// kept out of the layer for the filesystem image.
+func (i *BimaImage) createLayer(index int, op layerOperation) (v1.Layer, map[string][]byte, error) {
+	files, sparse, err := op.Files()
+	if err != nil {
+		return nil, nil, err
+	}
+	err = i.stripBinary(index, files, sparse)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to strip unikernel binary - %v", err)
+	}
+	files, sparse, rootfsFiles, err := i.splitRootfsFiles(files, sparse)
+	if err != nil {
+		return nil, nil, err
+	}
+	opts := i.layerOptions()
+	if opts.EStargz && len(sparse) > 0 {
+		// eStargz layers are rewritten with archive/tar, which inflates sparse files
+		err := inflateSparseFiles(sparse, files)
+		if err != nil {
+			return nil, nil, err
+		}
+		sparse = nil
+	}
+	if i.opts.Cache == nil {
+		layer, err := newLayer(files, sparse, opts)
+		return layer, rootfsFiles, err
+	}
+	key, err := cacheKey(op.Line(), files, sparse, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	if layer, ok := i.opts.Cache.Get(key); ok {
+		log.Infof("Using cached layer for %q", op.Line())
+		return layer, rootfsFiles, nil
+	}
+	log.Infof("No cached layer for %q", op.Line())
+	layer, err := newLayer(files, sparse, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	cached, err := i.opts.Cache.Put(key, layer)
+	if err != nil {
+		log.Warnf("Failed to cache layer for %q - %v", op.Line(), err)
+		return layer, rootfsFiles, nil
+	}
+	return cached, rootfsFiles, nil
+}
+
+func (i *BimaImage) layerOptions() LayerOptions {
+	mediaType := types.DockerLayer
+	if i.opts.MediaTypes == MediaTypesOCI {
+		mediaType = types.OCILayer
+	}
+	return LayerOptions{
+		EStargz:          i.opts.EStargz,
+		PrioritizedFiles: i.prioritized,
+		MediaType:        mediaType,
+	}
+}
+
+// unikernelBinary returns the absolute in-image path of the unikernel binary,
+// as defined by the LABEL operations, or an empty string if it is not set.
+// Like in UnikernelSpec, later labels override earlier ones.
+func unikernelBinary(operations []BimaOperation) (string, error) {
+	labels := []LabelOperation{}
+	for _, op := range operations {
+		if label, ok := op.(LabelOperation); ok {
+			labels = append(labels, label)
+		}
+	}
+	spec, err := unikernelSpec(labels)
+	if err != nil {
+		return "", err
+	}
+	if spec.Binary == "" {
+		return "", nil
+	}
+	// relative paths are relative to the rootfs, like the layer paths
+	return filepath.Join("/", spec.Binary), nil
+}
+
 func (i *BimaImage) getLabelKeys() []string {
 	labels := []string{}
 	for _, label := range i.labels {
@@ -131,19 +409,24 @@ func (i *BimaImage) Validate() error {
 }
 
 func (i *BimaImage) validateUnikernel() error {
-	missingLabels := []string{}
-	requiredLabels := RequiredUnikernelAnnotations()
-	currentLabels := i.getLabelMap()
-	for _, label := range requiredLabels {
-		_, ok := currentLabels[label]
-		if !ok {
-			missingLabels = append(missingLabels, label)
-		}
+	spec, err := i.UnikernelSpec()
+	if err != nil {
+		return err
 	}
-	if len(missingLabels) == 0 {
-		return nil
+	matrix := i.opts.Compatibility
+	if matrix == nil {
+		matrix = DefaultCompatibilityMatrix()
+	}
+	err = spec.Validate(matrix, i.opts.RootfsFormat)
+	if err != nil {
+		return fmt.Errorf("ERR: %v", err)
+	}
+	err = i.validateArtifacts(spec)
+	if err != nil {
+		return fmt.Errorf("ERR: %v", err)
 	}
-	return fmt.Errorf("ERR: invalid bima unikernel image - missing labels %v", missingLabels)
+	i.setCmdlineLabels(spec)
+	return i.validateSolo5ABI()
 }
 func (i *BimaImage) validateIoT() error {
 	// todo
@@ -164,9 +447,15 @@ func (i *BimaImage) AddCmd() error {
 	return nil
 }
 
+// addUnikernelCmd sets the image Cmd to the arguments of the unikernel
+// cmdline, as the unikernel receives them, or to the unikernel binary if
+// the cmdline is empty
 func (i *BimaImage) addUnikernelCmd() error {
-	cmd, ok := i.getLabelMap()[cmdAnnotation()]
-	if !ok {
+	spec, err := i.UnikernelSpec()
+	if err != nil {
+		return err
+	}
+	if spec.Binary == "" {
 		return fmt.Errorf("invalid bima unikernel image - %q missing", cmdAnnotation())
 	}
 	img := *i.Image
@@ -176,15 +465,25 @@ func (i *BimaImage) addUnikernelCmd() error {
 		return err
 	}
 	cfg = cfg.DeepCopy()
-	decodedCmd, err := utils.Base64Decode(cmd)
+	cfg.Config.Cmd, err = utils.ParseCmdline(spec.Cmdline)
 	if err != nil {
-		return err
+		return fmt.Errorf("invalid unikernel cmdline - %v", err)
+	}
+	if len(cfg.Config.Cmd) == 0 {
+		cfg.Config.Cmd = []string{spec.Binary}
 	}
-	cfg.Config.Cmd = strings.Split(decodedCmd, " ")
 	img, err = mutate.Config(img, cfg.Config)
 	if err != nil {
 		return err
 	}
+	cmdLine, err := json.Marshal(cfg.Config.Cmd)
+	if err != nil {
+		return err
+	}
+	img, err = appendHistory(img, nil, "CMD "+string(cmdLine))
+	if err != nil {
+		return err
+	}
 	i.Image = &img
 	return nil
 }
@@ -210,22 +509,16 @@ func (i *BimaImage) AddUruncJSON() error {
 
 func (i *BimaImage) addUnikernelJSON() error {
 	img := *i.Image
-	annotations := i.getLabelKeys()
-	uruncMap := make(map[string]string)
-	currentAnnotationMap := i.getLabelMap()
-	for _, key := range annotations {
-		uruncMap[key] = currentAnnotationMap[key]
-	}
-	byteObj, err := json.Marshal(uruncMap)
+	byteObj, err := i.uruncJSON(i.opts.UruncJSONSchema)
 	if err != nil {
 		return err
 	}
-	layerMap := map[string][]byte{"/urunc.json": byteObj}
-	layer, err := crane.Layer(layerMap)
+	layerMap := map[string][]byte{uruncJSONPath: byteObj}
+	layer, err := newLayer(layerMap, nil, i.layerOptions())
 	if err != nil {
 		return err
 	}
-	newImg, err := mutate.AppendLayers(img, layer)
+	newImg, err := appendHistory(img, layer, "COPY urunc.json "+uruncJSONPath)
 	if err != nil {
 		return err
 	}
@@ -238,99 +531,49 @@ func (i *BimaImage) addIoTJSON() error {
 }
 
 func (i *BimaImage) extractIUnikernelArch() error {
+	unikernelPath, err := i.unikernelSource()
+	if err != nil {
+		return err
+	}
+	arch, err := detectArch(unikernelPath)
+	if err != nil {
+		return err
+	}
+	i.arch = arch
+	spec, err := i.UnikernelSpec()
+	if err != nil {
+		return err
+	}
+	return i.validateLinuxKernel(spec)
+}
+
+// unikernelSource returns the local path of the file copied to the
+// path defined by the "com.urunc.unikernel.binary" annotation
+func (i *BimaImage) unikernelSource() (string, error) {
 	// first we need to find the value of annotation "com.urunc.unikernel.binary"
 	targetKey := cmdAnnotation()
 	targetVal := ""
 	for _, val := range i.labels {
+		// later labels override earlier ones
 		if val.Key == targetKey {
 			targetVal = val.Value
-			break
 		}
 	}
 	if targetVal == "" {
-		return fmt.Errorf("unikernel annotation was not set")
+		return "", fmt.Errorf("unikernel annotation was not set")
 	}
 	targetVal, err := utils.Base64Decode(targetVal)
 	if err != nil {
-		return fmt.Errorf("failed to decode unikernel annotation value")
-
-	}
-	// next, we need to find the file name of the unikernel
-	unikernelName := filepath.Base(targetVal)
-	unikernelPath := ""
-
-	// search COPY operations to find the local unikernel file
-	for _, val := range i.copies {
-		tmp := filepath.Base(val.Destination)
-		if tmp == unikernelName {
-			unikernelPath = val.Source
-			break
-		}
-	}
-	if unikernelPath == "" {
-		return fmt.Errorf("unikernel defined by annotation was not copied in image rootfs")
-	}
-
-	elfFile, err := elf.Open(unikernelPath)
-	if err == nil {
-		defer elfFile.Close()
-		switch elfFile.Machine {
-		case elf.EM_ARM:
-			i.arch = "arm64"
-			return nil
-		case elf.EM_AARCH64:
-			i.arch = "arm64"
-			return nil
-		case elf.EM_X86_64:
-			i.arch = "amd64"
-			return nil
-		case elf.EM_386:
-			i.arch = "amd64"
-			return nil
-		default:
-			return fmt.Errorf("unknown architecture")
-		}
-	}
+		return "", fmt.Errorf("failed to decode unikernel annotation value")
 
-	// We are not dealing with an elf binary. Maybe we can try PE
-	peFile, err := pe.Open(unikernelPath)
-	if err == nil {
-		defer peFile.Close()
-		switch peFile.FileHeader.Machine {
-		case pe.IMAGE_FILE_MACHINE_AMD64:
-			i.arch = "arm64"
-			return nil
-		case pe.IMAGE_FILE_MACHINE_ARM64:
-			i.arch = "arm64"
-			return nil
-		default:
-			return fmt.Errorf("unknown architecture")
-		}
 	}
-
-	// We are not dealing with an elf or PE binary.
-	// Let's check if it is Linux kernel ARM64 boot executable Image
-	file, err := os.Open(unikernelPath)
+	// resolve the exact in-image path to the local file copied there
+	entry, err := i.fs.resolve(targetVal)
 	if err != nil {
-		return err
+		return "", fmt.Errorf("invalid unikernel binary - %v", err)
 	}
-	defer file.Close()
-
-	var dosheader [64]byte
-
-	if _, err = file.ReadAt(dosheader[0:], 0); err != nil {
-		return err
-	}
-	if dosheader[0] == 'M' && dosheader[1] == 'Z' {
-		if dosheader[56] == 'A' && dosheader[57] == 'R' {
-			if dosheader[58] == 'M' && dosheader[59] == 'd' {
-				i.arch = "arm64"
-				return nil
-			}
-		}
-	}
-
-	return err
+	log.Debugf("Unikernel binary %q was copied from %q by %q", targetVal, entry.source, entry.createdBy)
+	return entry.source, nil
 }
 
 func (i *BimaImage) SetArchitecture() error {
@@ -338,7 +581,17 @@ func (i *BimaImage) SetArchitecture() error {
 	if err != nil {
 		return err
 	}
-	newOp, err := newArchOperation(i.arch)
+	if i.opts.Platform != nil {
+		platform := i.opts.Platform
+		variantMismatch := platform.Variant != "" && i.arch.Variant != "" && platform.Variant != i.arch.Variant
+		if platform.Architecture != i.arch.Arch || variantMismatch {
+			return fmt.Errorf("unikernel binary architecture %q does not match target platform %q", i.arch, platform)
+		}
+		if platform.Variant != "" {
+			i.arch.Variant = platform.Variant
+		}
+	}
+	newOp, err := newArchOperation(i.arch.Arch, i.arch.Variant)
 	if err != nil {
 		return err
 	}
@@ -347,6 +600,56 @@ func (i *BimaImage) SetArchitecture() error {
 	if err != nil {
 		return err
 	}
+	newImg, err = appendHistory(newImg, nil, newOp.Line())
+	if err != nil {
+		return err
+	}
 	i.Image = &newImg
-	return nil
+	return i.addKernelVersion()
+}
+
+// addKernelVersion records the version of a Linux kernel unikernel binary
+// as an annotation, unless it is already set by a label.
+func (i *BimaImage) addKernelVersion() error {
+	if i.arch.KernelVersion == "" {
+		return nil
+	}
+	if _, ok := i.getLabelMap()[kernelVersionAnnotation]; ok {
+		log.Debugf("Kernel version is already set by label %q", kernelVersionAnnotation)
+		return nil
+	}
+	return i.ApplyOperation(NewLabelOperation(kernelVersionAnnotation, i.arch.KernelVersion))
+}
+
+// Platform returns the platform of the image
+func (i *BimaImage) Platform() (*v1.Platform, error) {
+	cfg, err := (*i.Image).ConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	return &v1.Platform{
+		OS:           cfg.OS,
+		Architecture: cfg.Architecture,
+		Variant:      cfg.Variant,
+	}, nil
+}
+
+// NewIndex creates an OCI image index holding the given images,
+// with a platform descriptor for each one of them.
+func NewIndex(images []*BimaImage) (v1.ImageIndex, error) {
+	adds := []mutate.IndexAddendum{}
+	for _, img := range images {
+		platform, err := img.Platform()
+		if err != nil {
+			return nil, err
+		}
+		adds = append(adds, mutate.IndexAddendum{
+			Add: *img.Image,
+			Descriptor: v1.Descriptor{
+				Platform: platform,
+			},
+		})
+	}
+	index := mutate.IndexMediaType(empty.Index, types.OCIImageIndex)
+	return mutate.AppendManifests(index, adds...), nil
 }
@@ -0,0 +1,37 @@
+// Copyright 2023 Nubificus LTD.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import "testing"
+
+func TestUnikernelBinary(t *testing.T) {
+	for label, want := range map[string]string{
+		"/unikernel/redis.hvt":   "/unikernel/redis.hvt",
+		"unikernel/redis.hvt":    "/unikernel/redis.hvt",
+		"./unikernel//redis.hvt": "/unikernel/redis.hvt",
+	} {
+		operations := []BimaOperation{
+			NewLabelOperation("com.urunc.unikernel.binary", "/other"),
+			NewLabelOperation("com.urunc.unikernel.binary", label),
+		}
+		got, err := unikernelBinary(operations)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("binary label %q gives %q, expected %q", label, got, want)
+		}
+	}
+}
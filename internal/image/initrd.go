@@ -0,0 +1,80 @@
+// Copyright 2023 Nubificus LTD.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// InitrdOperation holds the in-image paths of the copied
+// files and directories that are packed in the initrd.
+type InitrdOperation struct {
+	Paths      []string
+	line       string
+	lineNumber int
+}
+
+// newInitrdOperation creates a new initrd operation
+// based on the provided instruction line.
+func newInitrdOperation(instructionLine InstructionLine) (InitrdOperation, error) {
+	parts := strings.Fields(string(instructionLine))
+	if len(parts) < 2 {
+		return InitrdOperation{}, fmt.Errorf("invalid INITRD format: %q", instructionLine)
+	}
+	paths := []string{}
+	for _, p := range parts[1:] {
+		if !filepath.IsAbs(p) {
+			return InitrdOperation{}, fmt.Errorf("INITRD paths must be absolute: %q", instructionLine)
+		}
+		paths = append(paths, filepath.Clean(p))
+	}
+	return InitrdOperation{
+		Paths: paths,
+		line:  string(instructionLine),
+	}, nil
+}
+
+func (o InitrdOperation) Line() string {
+	return o.line
+}
+
+func (o InitrdOperation) Info() string {
+	return fmt.Sprintf("Performing instruction: %q\nPacking %v in the initrd", o.line, o.Paths)
+}
+
+func (o InitrdOperation) Type() string {
+	return "INITRD"
+}
+
+// UpdateImage leaves the image unchanged, as the selected
+// files are packed in the initrd when it is created.
+func (o InitrdOperation) UpdateImage(image v1.Image) (v1.Image, error) {
+	return image, nil
+}
+
+// initrdPaths returns the paths selected by all INITRD operations
+func initrdPaths(operations []BimaOperation) []string {
+	paths := []string{}
+	for _, op := range operations {
+		if initrd, ok := op.(InitrdOperation); ok {
+			paths = append(paths, initrd.Paths...)
+		}
+	}
+	return paths
+}
@@ -0,0 +1,333 @@
+// Copyright 2023 Nubificus LTD.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	// kernelBanner prefixes the version string of every Linux kernel
+	kernelBanner = "Linux version "
+	// maxKernelSize limits the size of decompressed kernel payloads
+	maxKernelSize = 512 << 20
+	// kernelScanOffset limits how far into a file compressed payloads are searched for
+	kernelScanOffset = 1 << 20
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b, 0x08}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// uImageArchs maps the U-Boot image architecture codes to architectures
+var uImageArchs = map[byte]archInfo{
+	2:  {Arch: "arm", Variant: "v7"},
+	3:  {Arch: "386"},
+	8:  {Arch: "s390x"},
+	22: {Arch: "arm64"},
+	24: {Arch: "amd64"},
+	26: {Arch: "riscv64"},
+}
+
+// U-Boot image types and compression methods, as defined in U-Boot's image.h
+const (
+	uImageTypeKernel       = 2
+	uImageTypeKernelNoLoad = 14
+	uImageCompNone         = 0
+	uImageCompGzip         = 1
+	uImageCompZstd         = 6
+)
+
+// detectBzImageArch detects the x86 Linux boot protocol bzImage format, which
+// has the "HdrS" magic at offset 0x202 of its setup header.
+func detectBzImageArch(r io.ReaderAt) (binaryInfo, error) {
+	var header [0x240]byte
+	if _, err := r.ReadAt(header[:], 0); err != nil {
+		return binaryInfo{}, errUnknownFormat
+	}
+	if !bytes.Equal(header[0x202:0x206], []byte("HdrS")) {
+		return binaryInfo{}, errUnknownFormat
+	}
+	protocol := binary.LittleEndian.Uint16(header[0x206:])
+	if protocol < 0x200 {
+		return binaryInfo{}, fmt.Errorf("unsupported boot protocol version %d.%02d", protocol>>8, protocol&0xff)
+	}
+	log.Debugf("Found x86 boot protocol version %d.%02d", protocol>>8, protocol&0xff)
+	info := binaryInfo{archInfo: archInfo{Arch: "386"}}
+	// kernels with a 64-bit entry point set XLF_KERNEL_64 since protocol 2.12
+	if protocol >= 0x20c && header[0x236]&1 != 0 {
+		info.Arch = "amd64"
+	}
+	// the kernel_version field points to a NUL terminated string, relative to 0x200
+	if versionOffset := binary.LittleEndian.Uint16(header[0x20e:]); versionOffset != 0 {
+		var version [128]byte
+		n, err := r.ReadAt(version[:], int64(versionOffset)+0x200)
+		if err != nil && err != io.EOF {
+			return binaryInfo{}, err
+		}
+		info.KernelVersion = parseKernelRelease(string(version[:n]))
+	}
+	return info, nil
+}
+
+// detectArm64ImageArch detects the arm64 Linux kernel boot executable Image
+// format, which has the "ARM\x64" magic at offset 56.
+func detectArm64ImageArch(r io.ReaderAt) (binaryInfo, error) {
+	var header [64]byte
+	if _, err := r.ReadAt(header[:], 0); err != nil {
+		return binaryInfo{}, errUnknownFormat
+	}
+	if !bytes.Equal(header[56:60], []byte("ARM\x64")) {
+		return binaryInfo{}, errUnknownFormat
+	}
+	version, err := findKernelVersion(io.NewSectionReader(r, 0, maxKernelSize))
+	if err != nil {
+		return binaryInfo{}, err
+	}
+	return binaryInfo{archInfo: archInfo{Arch: "arm64"}, KernelVersion: version}, nil
+}
+
+// detectZImageArch detects the arm Linux kernel zImage format, which has the
+// 0x016f2818 magic at offset 0x24, in the byte order of the kernel.
+func detectZImageArch(r io.ReaderAt) (binaryInfo, error) {
+	var header [0x30]byte
+	if _, err := r.ReadAt(header[:], 0); err != nil {
+		return binaryInfo{}, errUnknownFormat
+	}
+	if binary.LittleEndian.Uint32(header[0x24:]) != 0x016f2818 && binary.BigEndian.Uint32(header[0x24:]) != 0x016f2818 {
+		return binaryInfo{}, errUnknownFormat
+	}
+	// the kernel is compressed after the decompressor, so search for a known payload
+	version, err := findCompressedKernelVersion(r)
+	if err != nil {
+		return binaryInfo{}, err
+	}
+	return binaryInfo{archInfo: archInfo{Arch: "arm", Variant: "v7"}, KernelVersion: version}, nil
+}
+
+// detectUImageArch detects the legacy U-Boot image format, which starts with a
+// 64 byte big-endian header with the 0x27051956 magic.
+func detectUImageArch(r io.ReaderAt) (binaryInfo, error) {
+	var header [64]byte
+	if _, err := r.ReadAt(header[:], 0); err != nil {
+		return binaryInfo{}, errUnknownFormat
+	}
+	if binary.BigEndian.Uint32(header[0:]) != 0x27051956 {
+		return binaryInfo{}, errUnknownFormat
+	}
+	size := int64(binary.BigEndian.Uint32(header[12:]))
+	imageType, arch, comp := header[30], header[29], header[31]
+	if imageType != uImageTypeKernel && imageType != uImageTypeKernelNoLoad {
+		return binaryInfo{}, fmt.Errorf("unsupported image type %d, expected a kernel", imageType)
+	}
+	info := binaryInfo{}
+	var ok bool
+	info.archInfo, ok = uImageArchs[arch]
+	if !ok {
+		return binaryInfo{}, fmt.Errorf("unsupported architecture %d", arch)
+	}
+	payload := io.NewSectionReader(r, int64(len(header)), size)
+	var err error
+	switch comp {
+	case uImageCompNone:
+		info.KernelVersion, err = findKernelVersion(payload)
+	case uImageCompGzip, uImageCompZstd:
+		info.KernelVersion, err = decompressedKernelVersion(payload)
+	default:
+		log.Debugf("Can not extract the kernel version of uImage with compression %d", comp)
+	}
+	if err != nil {
+		return binaryInfo{}, err
+	}
+	// fall back to the image name, which is usually set to "Linux-<release>"
+	name := string(bytes.TrimRight(header[32:], "\x00"))
+	if info.KernelVersion == "" && strings.HasPrefix(name, "Linux-") {
+		info.KernelVersion = parseKernelRelease(strings.TrimPrefix(name, "Linux-"))
+	}
+	return info, nil
+}
+
+// detectCompressedKernelArch detects gzip or zstd compressed kernels, such as
+// vmlinux.gz or Image.zst, by detecting the format of their payload.
+func detectCompressedKernelArch(r io.ReaderAt) (binaryInfo, error) {
+	var magic [4]byte
+	if _, err := r.ReadAt(magic[:], 0); err != nil {
+		return binaryInfo{}, errUnknownFormat
+	}
+	if !bytes.HasPrefix(magic[:], gzipMagic) && !bytes.Equal(magic[:], zstdMagic) {
+		return binaryInfo{}, errUnknownFormat
+	}
+	rc, err := decompress(io.NewSectionReader(r, 0, 1<<62))
+	if err != nil {
+		return binaryInfo{}, err
+	}
+	defer rc.Close()
+	payload, err := io.ReadAll(io.LimitReader(rc, maxKernelSize+1))
+	if err != nil {
+		return binaryInfo{}, err
+	}
+	if len(payload) > maxKernelSize {
+		return binaryInfo{}, fmt.Errorf("decompressed payload exceeds %d bytes", maxKernelSize)
+	}
+	// compressed payloads are not expected to be nested
+	detectors := []formatDetector{}
+	for _, detector := range formatDetectors {
+		if detector.name != "compressed Linux kernel" {
+			detectors = append(detectors, detector)
+		}
+	}
+	info, name, err := detectFormat(bytes.NewReader(payload), detectors)
+	if err != nil {
+		if name == "" {
+			return binaryInfo{}, fmt.Errorf("unknown compressed payload - %v", err)
+		}
+		return binaryInfo{}, fmt.Errorf("compressed %s payload - %v", name, err)
+	}
+	log.Debugf("Detected compressed %s payload", name)
+	if info.KernelVersion == "" {
+		info.KernelVersion, err = findKernelVersion(bytes.NewReader(payload))
+		if err != nil {
+			return binaryInfo{}, err
+		}
+	}
+	return info, nil
+}
+
+// findCompressedKernelVersion searches the start of r for a gzip or zstd
+// compressed payload and returns the kernel version found in it, if any.
+func findCompressedKernelVersion(r io.ReaderAt) (string, error) {
+	head := make([]byte, kernelScanOffset)
+	n, err := r.ReadAt(head, 0)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	head = head[:n]
+	for _, magic := range [][]byte{gzipMagic, zstdMagic} {
+		offset := bytes.Index(head, magic)
+		if offset < 0 {
+			continue
+		}
+		version, err := decompressedKernelVersion(io.NewSectionReader(r, int64(offset), 1<<62))
+		if err != nil {
+			log.Debugf("Failed to decompress kernel payload at offset %d - %v", offset, err)
+			continue
+		}
+		if version != "" {
+			return version, nil
+		}
+	}
+	return "", nil
+}
+
+// decompressedKernelVersion returns the kernel version found in the gzip or
+// zstd compressed stream r.
+func decompressedKernelVersion(r io.Reader) (string, error) {
+	rc, err := decompress(r)
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+	return findKernelVersion(io.LimitReader(rc, maxKernelSize))
+}
+
+// decompress returns a reader for the gzip or zstd compressed stream r
+func decompress(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(len(zstdMagic))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(magic, zstdMagic) {
+		dec, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		return dec.IOReadCloser(), nil
+	}
+	gz, err := gzip.NewReader(br)
+	if err != nil {
+		return nil, err
+	}
+	// kernel payloads are single stream, with trailing data after it
+	gz.Multistream(false)
+	return gz, nil
+}
+
+// findKernelVersion scans r for the Linux version banner and returns the kernel
+// release following it, or an empty string if the banner can not be found.
+func findKernelVersion(r io.Reader) (string, error) {
+	const chunkSize = 1 << 20
+	// the part of the banner following its prefix that is needed to parse the release
+	const releaseLen = 128
+	banner := []byte(kernelBanner)
+	buf := []byte{}
+	chunk := make([]byte, chunkSize)
+	for {
+		n, err := io.ReadFull(r, chunk)
+		eof := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !eof {
+			return "", err
+		}
+		buf = append(buf, chunk[:n]...)
+		for {
+			idx := bytes.Index(buf, banner)
+			if idx < 0 {
+				// keep enough of the buffer for a banner crossing chunk boundaries
+				if len(buf) > len(banner) {
+					buf = buf[len(buf)-len(banner):]
+				}
+				break
+			}
+			start := idx + len(banner)
+			if !eof && len(buf)-start < releaseLen {
+				// wait for the rest of the banner
+				buf = buf[idx:]
+				break
+			}
+			end := start + releaseLen
+			if end > len(buf) {
+				end = len(buf)
+			}
+			if release := parseKernelRelease(string(buf[start:end])); release != "" {
+				return release, nil
+			}
+			buf = buf[start:]
+		}
+		if eof {
+			return "", nil
+		}
+		// avoid growing the buffer, as it only holds the unprocessed tail
+		buf = append([]byte{}, buf...)
+	}
+}
+
+// parseKernelRelease returns the kernel release at the start of a version
+// string such as "6.1.0-13-amd64 (debian-kernel@lists.debian.org) #1 SMP"
+func parseKernelRelease(version string) string {
+	fields := strings.Fields(strings.SplitN(version, "\x00", 2)[0])
+	if len(fields) == 0 || fields[0][0] < '0' || fields[0][0] > '9' {
+		return ""
+	}
+	return fields[0]
+}
@@ -16,6 +16,7 @@ package image
 
 import (
 	"fmt"
+	"sort"
 	"strings"
 
 	v1 "github.com/google/go-containerregistry/pkg/v1"
@@ -23,29 +24,48 @@ import (
 	"github.com/nubificus/bima/internal/utils"
 )
 
+// Supported encodings of the label values in the image manifest annotations
+const (
+	AnnotationEncodingBase64 = "base64"
+	AnnotationEncodingPlain  = "plain"
+	AnnotationEncodingBoth   = "both"
+)
+
+const (
+	// annotationEncodingAnnotation tells consumers the encoding of the label
+	// values in the manifest annotations. Its own value is always plain.
+	annotationEncodingAnnotation = "com.nubificus.bima.annotationEncoding"
+	// plainAnnotationSuffix is appended to the keys of the plain copies of
+	// the labels, when both encodings are used
+	plainAnnotationSuffix = ".plain"
+)
+
+// SupportedAnnotationEncodings returns a list of all supported annotation encodings
+func SupportedAnnotationEncodings() []string {
+	return []string{AnnotationEncodingBase64, AnnotationEncodingPlain, AnnotationEncodingBoth}
+}
+
 // LabelOperation hols the information needed
 // to create a new layer with an annotation.
 type LabelOperation struct {
-	Key   string
-	Value string
-	line  string
+	Key        string
+	Value      string
+	line       string
+	lineNumber int
 }
 
 // newLabelOperation creates a new label operation
 // based on the provided instruction line.
 func newLabelOperation(instructionLine InstructionLine) (LabelOperation, error) {
-	arg := strings.ReplaceAll(string(instructionLine), "LABEL", "")
+	arg := strings.TrimPrefix(string(instructionLine), "LABEL")
 	arg = strings.TrimSpace(arg)
 	parts := strings.SplitN(string(arg), "=", 2)
 	if len(parts) != 2 {
 		return LabelOperation{}, fmt.Errorf("invalid LABEL format: %q", instructionLine)
 	}
-	// trim both single and double quotes
-	key := strings.Trim(parts[0], "\"")
-	key = strings.Trim(key, "\\'")
-
-	val := strings.Trim(parts[1], "\"")
-	val = strings.Trim(val, "\\'")
+	// remove one pair of single or double quotes, like a Dockerfile LABEL
+	key := utils.Unquote(parts[0])
+	val := utils.Unquote(parts[1])
 
 	return LabelOperation{
 		Key:   key,
@@ -54,10 +74,49 @@ func newLabelOperation(instructionLine InstructionLine) (LabelOperation, error)
 	}, nil
 }
 
+// NewLabelOperation creates a new label operation
+// for the given key and value.
+func NewLabelOperation(key string, value string) LabelOperation {
+	return LabelOperation{
+		Key:   key,
+		Value: utils.Base64Encode(value),
+		line:  fmt.Sprintf("LABEL %s=%s", key, value),
+	}
+}
+
+// OverrideLabels sets the given labels on top of the provided operations.
+// LABEL operations with the same key are replaced, while new labels are appended.
+func OverrideLabels(operations []BimaOperation, labels map[string]string) []BimaOperation {
+	res := []BimaOperation{}
+	for _, op := range operations {
+		if label, ok := op.(LabelOperation); ok {
+			if _, found := labels[label.Key]; found {
+				log.Debugf("Overriding label %q", label.Key)
+				continue
+			}
+		}
+		res = append(res, op)
+	}
+	keys := []string{}
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		res = append(res, NewLabelOperation(key, labels[key]))
+	}
+	return res
+}
+
 func (o LabelOperation) Line() string {
 	return o.line
 }
 
+// source describes the instruction of the label for error messages
+func (o LabelOperation) source() string {
+	return operationSource(o.line, o.lineNumber)
+}
+
 func (o LabelOperation) Info() string {
 	return fmt.Sprintf("Performing instruction: %q\nSetting label %q to %q", o.line, o.Key, o.Value)
 }
@@ -72,3 +131,36 @@ func (o LabelOperation) UpdateImage(image v1.Image) (v1.Image, error) {
 	newImage := mutate.Annotations(image, annotations).(v1.Image)
 	return newImage, nil
 }
+
+// EncodeAnnotations sets the manifest annotations of the labels in the
+// encoding of the build options, along with the marker annotation of the encoding. LABEL
+// operations set base64 encoded annotations, so for the base64 encoding
+// only the marker is added.
+func (i *BimaImage) EncodeAnnotations() error {
+	encoding := i.opts.AnnotationEncoding
+	if encoding == "" {
+		encoding = AnnotationEncodingBase64
+	}
+	annotations := map[string]string{annotationEncodingAnnotation: encoding}
+	for _, label := range i.labels {
+		switch encoding {
+		case AnnotationEncodingBase64:
+			continue
+		case AnnotationEncodingPlain, AnnotationEncodingBoth:
+			value, err := utils.Base64Decode(label.Value)
+			if err != nil {
+				return fmt.Errorf("%s - failed to decode label value", label.source())
+			}
+			if encoding == AnnotationEncodingPlain {
+				annotations[label.Key] = value
+			} else {
+				annotations[label.Key+plainAnnotationSuffix] = value
+			}
+		default:
+			return fmt.Errorf("unsupported annotation encoding %q", encoding)
+		}
+	}
+	img := mutate.Annotations(*i.Image, annotations).(v1.Image)
+	i.Image = &img
+	return nil
+}
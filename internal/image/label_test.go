@@ -0,0 +1,60 @@
+// Copyright 2023 Nubificus LTD.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLabelCmdline(t *testing.T) {
+	tests := []struct {
+		line string
+		want []string
+	}{
+		{`LABEL com.urunc.unikernel.cmdline=redis-server --requirepass "a b"`, []string{"redis-server", "--requirepass", "a b"}},
+		{`LABEL com.urunc.unikernel.cmdline="redis-server --requirepass \"a b\""`, []string{"redis-server", "--requirepass", "a b"}},
+		{`LABEL com.urunc.unikernel.cmdline='redis-server --requirepass "a  b"'`, []string{"redis-server", "--requirepass", "a  b"}},
+		{`LABEL  com.urunc.unikernel.cmdline=redis-server   --port	6379`, []string{"redis-server", "--port", "6379"}},
+		{`LABEL com.urunc.unikernel.cmdline=["redis-server", "--requirepass", "a  b"]`, []string{"redis-server", "--requirepass", "a  b"}},
+		{`LABEL "com.urunc.unikernel.cmdline"="LABEL  x"`, []string{"LABEL", "x"}},
+	}
+	for _, test := range tests {
+		img, err := NewBimaImage(BuildOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, line := range []string{"LABEL com.urunc.unikernel.binary=/unikernel/redis", test.line} {
+			op, err := NewInstructionLine(line).ToBimaOperation()
+			if err != nil {
+				t.Fatalf("%s: %v", line, err)
+			}
+			if err := img.ApplyOperation(op); err != nil {
+				t.Fatalf("%s: %v", line, err)
+			}
+		}
+		if err := img.addUnikernelCmd(); err != nil {
+			t.Errorf("%s: %v", test.line, err)
+			continue
+		}
+		cfg, err := (*img.Image).ConfigFile()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(cfg.Config.Cmd, test.want) {
+			t.Errorf("%s: Cmd is %q, expected %q", test.line, cfg.Config.Cmd, test.want)
+		}
+	}
+}
@@ -0,0 +1,259 @@
+// Copyright 2023 Nubificus LTD.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/nubificus/bima/internal/utils"
+)
+
+// launchConfigAnnotation holds the in-image path of the launch configuration
+// generated for the hypervisor of the unikernel
+const launchConfigAnnotation = "com.urunc.unikernel.launchConfig"
+
+// Paths of the generated launch configurations inside the image rootfs
+const (
+	firecrackerConfigPath = "/urunc/firecracker.json"
+	qemuArgsPath          = "/urunc/qemu.args"
+)
+
+// Defaults of the firecracker machine configuration, which requires both values
+const (
+	firecrackerDefaultVCPUs     = 1
+	firecrackerDefaultMemoryMiB = 128
+)
+
+// launchTapDevice is the name of the tap device of the generated network
+// configuration, which the runtime may replace
+const launchTapDevice = "tap0"
+
+// qemuRootDevice is the device of the block image, the only virtio disk of qemu
+const qemuRootDevice = "/dev/vda"
+
+// launchConfigGenerators render the launch configuration of a hypervisor,
+// given its in-image path
+var launchConfigGenerators = map[string]struct {
+	path     string
+	generate func(spec UnikernelSpec) ([]byte, error)
+}{
+	"firecracker": {firecrackerConfigPath, firecrackerConfig},
+	"qemu":        {qemuArgsPath, qemuArgs},
+}
+
+// firecracker VM configuration, as read by "firecracker --config-file"
+type firecrackerVMConfig struct {
+	BootSource        firecrackerBootSource    `json:"boot-source"`
+	Drives            []firecrackerDrive       `json:"drives"`
+	MachineConfig     firecrackerMachineConfig `json:"machine-config"`
+	NetworkInterfaces []firecrackerNetwork     `json:"network-interfaces,omitempty"`
+}
+
+type firecrackerBootSource struct {
+	KernelImagePath string `json:"kernel_image_path"`
+	BootArgs        string `json:"boot_args,omitempty"`
+	InitrdPath      string `json:"initrd_path,omitempty"`
+}
+
+type firecrackerDrive struct {
+	DriveID      string `json:"drive_id"`
+	PathOnHost   string `json:"path_on_host"`
+	IsRootDevice bool   `json:"is_root_device"`
+	IsReadOnly   bool   `json:"is_read_only"`
+}
+
+type firecrackerMachineConfig struct {
+	VCPUCount  int   `json:"vcpu_count"`
+	MemSizeMiB int64 `json:"mem_size_mib"`
+}
+
+type firecrackerNetwork struct {
+	IfaceID     string `json:"iface_id"`
+	HostDevName string `json:"host_dev_name"`
+}
+
+// AddLaunchConfig generates the launch configuration of the unikernel for
+// its hypervisor, if requested by the build options, in a dedicated layer.
+// The configuration is referenced by the "com.urunc.unikernel.launchConfig"
+// annotation. Hypervisors without a generator are skipped with a warning.
+func (i *BimaImage) AddLaunchConfig() error {
+	if !i.opts.LaunchConfig || i.imageType() != "unikernel" {
+		return nil
+	}
+	spec, err := i.UnikernelSpec()
+	if err != nil {
+		return err
+	}
+	generator, ok := launchConfigGenerators[spec.Hypervisor]
+	if !ok {
+		log.Warnf("Can not generate a launch configuration for hypervisor %q", spec.Hypervisor)
+		return nil
+	}
+	if _, err := i.fs.resolve(generator.path); err == nil || i.fs.isDir(generator.path) {
+		return fmt.Errorf("launch configuration path %q conflicts with a copied file", generator.path)
+	}
+	content, err := generator.generate(spec)
+	if err != nil {
+		return fmt.Errorf("failed to generate %s launch configuration - %v", spec.Hypervisor, err)
+	}
+	log.Infof("Generated %s launch configuration %q", spec.Hypervisor, generator.path)
+	layer, err := newLayer(map[string][]byte{generator.path: content}, nil, i.layerOptions())
+	if err != nil {
+		return err
+	}
+	img, err := appendHistory(*i.Image, layer, fmt.Sprintf("LAUNCHCONFIG %s %s", spec.Hypervisor, generator.path))
+	if err != nil {
+		return err
+	}
+	i.Image = &img
+	return i.ApplyOperation(NewLabelOperation(launchConfigAnnotation, generator.path))
+}
+
+// firecrackerConfig renders the firecracker VM configuration of the unikernel
+func firecrackerConfig(spec UnikernelSpec) ([]byte, error) {
+	// firecracker sets the root device of the drive marked as the root device
+	bootArgs, err := bootArgs(spec, "")
+	if err != nil {
+		return nil, err
+	}
+	resources, err := spec.resources()
+	if err != nil {
+		return nil, err
+	}
+	config := firecrackerVMConfig{
+		BootSource: firecrackerBootSource{
+			KernelImagePath: spec.Binary,
+			BootArgs:        bootArgs,
+			InitrdPath:      spec.Initrd,
+		},
+		Drives: []firecrackerDrive{},
+		MachineConfig: firecrackerMachineConfig{
+			VCPUCount:  firecrackerDefaultVCPUs,
+			MemSizeMiB: firecrackerDefaultMemoryMiB,
+		},
+	}
+	if resources.VCPUs != 0 {
+		config.MachineConfig.VCPUCount = resources.VCPUs
+	}
+	if resources.MemoryMiB != 0 {
+		config.MachineConfig.MemSizeMiB = resources.MemoryMiB
+	}
+	if spec.Block != "" {
+		readOnly, _ := strconv.ParseBool(spec.Extra[blockReadOnlyAnnotation])
+		config.Drives = append(config.Drives, firecrackerDrive{
+			DriveID:      "rootfs",
+			PathOnHost:   spec.Block,
+			IsRootDevice: spec.Type == linuxUnikernelType && rootIsBlock(spec),
+			IsReadOnly:   readOnly,
+		})
+	}
+	if hasNetwork(spec) {
+		config.NetworkInterfaces = []firecrackerNetwork{{IfaceID: "eth0", HostDevName: launchTapDevice}}
+	}
+	return json.MarshalIndent(config, "", "  ")
+}
+
+// qemuArgs renders the qemu arguments of the unikernel, one per line
+func qemuArgs(spec UnikernelSpec) ([]byte, error) {
+	bootArgs, err := bootArgs(spec, qemuRootDevice)
+	if err != nil {
+		return nil, err
+	}
+	resources, err := spec.resources()
+	if err != nil {
+		return nil, err
+	}
+	args := []string{"-nographic", "-kernel", spec.Binary}
+	if bootArgs != "" {
+		args = append(args, "-append", bootArgs)
+	}
+	if spec.Initrd != "" {
+		args = append(args, "-initrd", spec.Initrd)
+	}
+	if resources.MemoryMiB != 0 {
+		args = append(args, "-m", fmt.Sprintf("%dM", resources.MemoryMiB))
+	}
+	if resources.VCPUs != 0 {
+		args = append(args, "-smp", strconv.Itoa(resources.VCPUs))
+	}
+	if spec.Block != "" {
+		drive := fmt.Sprintf("file=%s,format=raw,if=virtio", spec.Block)
+		if readOnly, _ := strconv.ParseBool(spec.Extra[blockReadOnlyAnnotation]); readOnly {
+			drive += ",readonly=on"
+		}
+		args = append(args, "-drive", drive)
+	}
+	if hasNetwork(spec) {
+		args = append(args,
+			"-netdev", fmt.Sprintf("tap,id=net0,ifname=%s,script=no,downscript=no", launchTapDevice),
+			"-device", "virtio-net-pci,netdev=net0")
+	}
+	return []byte(strings.Join(args, "\n") + "\n"), nil
+}
+
+// bootArgs returns the command line the unikernel is booted with. Linux
+// guests boot with their kernel command line, with the init process and its
+// arguments taken from the unikernel cmdline. If rootDevice is set and the
+// root of a Linux guest is its block image, the kernel command line mounts
+// rootDevice as the root, unless it already sets the root.
+func bootArgs(spec UnikernelSpec, rootDevice string) (string, error) {
+	if spec.Type != linuxUnikernelType {
+		return spec.Cmdline, nil
+	}
+	args := []string{}
+	kernelCmdline := spec.Extra[kernelCmdlineAnnotation]
+	if kernelCmdline != "" {
+		args = append(args, kernelCmdline)
+	}
+	if rootDevice != "" && spec.Block != "" && rootIsBlock(spec) && !strings.Contains(" "+kernelCmdline, " root=") {
+		args = append(args, "root="+rootDevice)
+		if readOnly, _ := strconv.ParseBool(spec.Extra[blockReadOnlyAnnotation]); readOnly {
+			args = append(args, "ro")
+		}
+	}
+	cmd, err := utils.ParseCmdline(spec.Cmdline)
+	if err != nil {
+		return "", err
+	}
+	if len(cmd) > 0 && !strings.Contains(" "+spec.Extra[kernelCmdlineAnnotation], " init=") {
+		args = append(args, "init="+cmd[0])
+	}
+	if len(cmd) > 1 {
+		// the kernel passes the arguments following "--" to init
+		args = append(args, "--")
+		for _, arg := range cmd[1:] {
+			if strings.ContainsAny(arg, " \t") {
+				arg = "\"" + arg + "\""
+			}
+			args = append(args, arg)
+		}
+	}
+	return strings.Join(args, " "), nil
+}
+
+// rootIsBlock reports whether a Linux guest mounts its block image as its root filesystem
+func rootIsBlock(spec UnikernelSpec) bool {
+	config, err := linuxConfig(spec)
+	return err == nil && config != nil && config.Root == LinuxRootBlock
+}
+
+// hasNetwork reports whether the unikernel needs a network interface
+func hasNetwork(spec UnikernelSpec) bool {
+	mode, ok := spec.Extra[networkAnnotation]
+	return ok && mode != NetworkNone
+}
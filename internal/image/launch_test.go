@@ -0,0 +1,69 @@
+// Copyright 2023 Nubificus LTD.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestQemuRootDevice(t *testing.T) {
+	tests := []struct {
+		extra  map[string]string
+		initrd string
+		want   string
+	}{
+		{map[string]string{}, "", "console=ttyS0 root=/dev/vda init=/sbin/init"},
+		{map[string]string{blockReadOnlyAnnotation: "true"}, "", "console=ttyS0 root=/dev/vda ro init=/sbin/init"},
+		{map[string]string{kernelCmdlineAnnotation: "console=ttyS0 root=/dev/vdb"}, "", "console=ttyS0 root=/dev/vdb init=/sbin/init"},
+		// the initrd is the root, so the block image is not mounted as the root
+		{map[string]string{}, "/initrd", "console=ttyS0 init=/sbin/init"},
+	}
+	for _, test := range tests {
+		if _, ok := test.extra[kernelCmdlineAnnotation]; !ok {
+			test.extra[kernelCmdlineAnnotation] = "console=ttyS0"
+		}
+		spec := UnikernelSpec{
+			Type:       linuxUnikernelType,
+			Hypervisor: "qemu",
+			Binary:     "/kernel",
+			Cmdline:    "/sbin/init",
+			Block:      "/rootfs.ext2",
+			Initrd:     test.initrd,
+			Extra:      test.extra,
+		}
+		args, err := qemuArgs(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(string(args), "\n")
+		got := ""
+		for idx, line := range lines {
+			if line == "-append" && idx+1 < len(lines) {
+				got = lines[idx+1]
+			}
+		}
+		if got != test.want {
+			t.Errorf("%v: boot args %q, expected %q", test.extra, got, test.want)
+		}
+		config, err := firecrackerConfig(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(string(config), "root=/dev/vda") {
+			t.Errorf("%v: firecracker boot args set the root device", test.extra)
+		}
+	}
+}
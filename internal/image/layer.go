@@ -0,0 +1,142 @@
+// Copyright 2023 Nubificus LTD.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/containerd/stargz-snapshotter/estargz"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// LayerOptions holds the settings used when creating a filesystem layer.
+type LayerOptions struct {
+	// EStargz writes the layer as eStargz, so it can be lazily pulled
+	EStargz bool
+	// PrioritizedFiles are placed first in eStargz layers
+	PrioritizedFiles []string
+	// MediaType of the layer. Empty stands for the Docker layer media type
+	MediaType types.MediaType
+}
+
+// newLayer creates a new layer containing the files of fileMap and sparse,
+// where the keys are the paths inside the image rootfs. Sparse files are
+// stored as PAX sparse entries, without their holes.
+func newLayer(fileMap map[string][]byte, sparse map[string]*sparseFile, opts LayerOptions) (v1.Layer, error) {
+	b := &bytes.Buffer{}
+	w := tar.NewWriter(b)
+
+	paths := []string{}
+	for p := range fileMap {
+		paths = append(paths, p)
+	}
+	for p := range sparse {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	// eStargz needs the parent directories of prioritized files
+	// to be present in the layer
+	if opts.EStargz {
+		err := writeParentDirs(w, paths)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, p := range paths {
+		if s, ok := sparse[p]; ok {
+			err := writeSparseEntry(w, b, p, s)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		content := fileMap[p]
+		err := w.WriteHeader(&tar.Header{
+			Name: p,
+			Size: int64(len(content)),
+		})
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(content); err != nil {
+			return nil, err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	// the layer is compressed once, to compute its digest, and the
+	// compressed blob is reused when the layer is cached or saved
+	layerOpts := []tarball.LayerOption{tarball.WithCompressedCaching}
+	if opts.MediaType != "" {
+		layerOpts = append(layerOpts, tarball.WithMediaType(opts.MediaType))
+	}
+	if opts.EStargz {
+		// only prioritize files that are part of this layer,
+		// as estargz fails on missing prioritized entries
+		prioritized := []string{}
+		for _, p := range opts.PrioritizedFiles {
+			if _, ok := fileMap[p]; ok {
+				prioritized = append(prioritized, p)
+			}
+		}
+		log.Tracef("Creating eStargz layer with prioritized files %v", prioritized)
+		layerOpts = append(layerOpts,
+			tarball.WithEstargzOptions(estargz.WithPrioritizedFiles(prioritized)),
+			tarball.WithEstargz,
+		)
+	}
+
+	// Return a new copy of the buffer each time it's opened.
+	return tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewBuffer(b.Bytes())), nil
+	}, layerOpts...)
+}
+
+// writeParentDirs adds a directory entry for every parent directory of the given paths
+func writeParentDirs(w *tar.Writer, paths []string) error {
+	dirs := make(map[string]bool)
+	for _, p := range paths {
+		for dir := path.Dir(p); dir != "/" && dir != "."; dir = path.Dir(dir) {
+			dirs[dir] = true
+		}
+	}
+	sortedDirs := []string{}
+	for dir := range dirs {
+		sortedDirs = append(sortedDirs, dir)
+	}
+	sort.Strings(sortedDirs)
+	for _, dir := range sortedDirs {
+		err := w.WriteHeader(&tar.Header{
+			Name:     strings.TrimPrefix(dir, "/") + "/",
+			Typeflag: tar.TypeDir,
+			Mode:     0755,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
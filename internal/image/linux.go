@@ -0,0 +1,104 @@
+// Copyright 2023 Nubificus LTD.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// linuxUnikernelType is the unikernel type of Linux guests, whose binary is
+// a Linux kernel booted with an initrd and/or a block rootfs
+const linuxUnikernelType = "linux"
+
+// Roots of Linux guests, reported in urunc.json
+const (
+	LinuxRootBlock  = "block"
+	LinuxRootInitrd = "initrd"
+	// LinuxRootKernel stands for the initramfs built into the kernel
+	LinuxRootKernel = "kernel"
+)
+
+// UruncLinux holds the boot configuration of Linux guests
+type UruncLinux struct {
+	KernelCmdline string `json:"kernelCmdline,omitempty"`
+	// Root is the artifact the guest mounts as its root filesystem
+	Root        string `json:"root"`
+	MountRootfs bool   `json:"mountRootfs,omitempty"`
+}
+
+// validateArtifacts checks that the initrd and block images referenced by the
+// labels are copied in the image rootfs as regular files, unless they are
+// created from the copied files by the rootfs format. Linux guests are also
+// checked for a root filesystem.
+func (i *BimaImage) validateArtifacts(spec UnikernelSpec) error {
+	format := i.opts.RootfsFormat
+	createdInitrd := format == RootfsFormatInitrd
+	createdBlock := format != "" && !createdInitrd
+	if spec.Initrd != "" && !createdInitrd {
+		if _, err := i.fs.resolve(spec.Initrd); err != nil {
+			return spec.errorf(initrdAnnotation, "invalid initrd - %v", err)
+		}
+	}
+	if spec.Block != "" && !createdBlock {
+		if _, err := i.fs.resolve(spec.Block); err != nil {
+			return spec.errorf(blockAnnotation, "invalid block image - %v", err)
+		}
+	}
+	if spec.Type != linuxUnikernelType {
+		return nil
+	}
+	hasInitrd := spec.Initrd != "" || createdInitrd
+	hasBlock := spec.Block != "" || createdBlock
+	if mountRootfs, _ := strconv.ParseBool(spec.Extra[mountRootfsAnnotation]); mountRootfs && !hasBlock {
+		return spec.errorf(mountRootfsAnnotation, "%q requires a block rootfs, set by %q or a block rootfs format", mountRootfsAnnotation, blockAnnotation)
+	}
+	if !hasInitrd && !hasBlock {
+		log.Warnf("Linux guest has neither an initrd nor a block rootfs, it can only boot from the initramfs built into the kernel")
+	}
+	return nil
+}
+
+// validateLinuxKernel checks that the binary of Linux guests is a Linux kernel image
+func (i *BimaImage) validateLinuxKernel(spec UnikernelSpec) error {
+	if spec.Type != linuxUnikernelType || i.arch.Kernel {
+		return nil
+	}
+	return spec.errorf(binaryAnnotation, "%q is not a Linux kernel image, as required by %s unikernels", spec.Binary, spec.Type)
+}
+
+// linuxConfig returns the boot configuration of Linux guests for urunc.json
+func linuxConfig(spec UnikernelSpec) (*UruncLinux, error) {
+	if spec.Type != linuxUnikernelType {
+		return nil, nil
+	}
+	config := &UruncLinux{KernelCmdline: spec.Extra[kernelCmdlineAnnotation]}
+	if value, ok := spec.Extra[mountRootfsAnnotation]; ok {
+		mountRootfs, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value %q of %q", value, mountRootfsAnnotation)
+		}
+		config.MountRootfs = mountRootfs
+	}
+	switch {
+	case spec.Block != "" && (config.MountRootfs || spec.Initrd == ""):
+		config.Root = LinuxRootBlock
+	case spec.Initrd != "":
+		config.Root = LinuxRootInitrd
+	default:
+		config.Root = LinuxRootKernel
+	}
+	return config, nil
+}
@@ -0,0 +1,271 @@
+// Copyright 2023 Nubificus LTD.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"bufio"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/containerd/containerd/reference/docker"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/nubificus/bima/internal/utils"
+)
+
+// Standard OCI annotation keys, as defined in
+// https://github.com/opencontainers/image-spec/blob/main/annotations.md
+const (
+	AnnotationCreated  = "org.opencontainers.image.created"
+	AnnotationAuthors  = "org.opencontainers.image.authors"
+	AnnotationSource   = "org.opencontainers.image.source"
+	AnnotationRevision = "org.opencontainers.image.revision"
+	AnnotationVersion  = "org.opencontainers.image.version"
+	AnnotationTitle    = "org.opencontainers.image.title"
+)
+
+// Metadata holds the standard OCI metadata of the image.
+type Metadata struct {
+	// Author is set as the author of the image config
+	Author string
+	// Created is set as the creation time of the image config
+	Created time.Time
+	// Annotations are added to the image manifest as-is
+	Annotations map[string]string
+	// explicit holds the keys of the annotations given to NewMetadata,
+	// which override the annotations of the labels
+	explicit map[string]bool
+}
+
+// NewMetadata creates the image metadata, deriving the standard OCI annotations
+// from the image tag and the git repository of the build context, if any.
+// The given annotations override the derived ones.
+func NewMetadata(contextDir string, tag string, author string, created time.Time, annotations map[string]string) (Metadata, error) {
+	created = created.UTC().Truncate(time.Second)
+	derived := map[string]string{
+		AnnotationCreated: created.Format(time.RFC3339),
+	}
+	if author != "" {
+		derived[AnnotationAuthors] = author
+	}
+	named, err := docker.ParseNormalizedNamed(tag)
+	if err != nil {
+		return Metadata{}, err
+	}
+	derived[AnnotationTitle] = path.Base(docker.Path(named))
+	if tagged, ok := named.(docker.Tagged); ok {
+		derived[AnnotationVersion] = tagged.Tag()
+	}
+	gitDir, err := findGitDir(contextDir)
+	if err != nil {
+		return Metadata{}, err
+	}
+	if gitDir != "" {
+		log.Debugf("Found git directory %q", gitDir)
+		source, err := gitRemoteURL(gitDir)
+		if err != nil {
+			log.Warnf("Failed to read git remote of %q - %v", gitDir, err)
+		} else if source != "" {
+			derived[AnnotationSource] = source
+		}
+		revision, err := gitRevision(gitDir)
+		if err != nil {
+			log.Warnf("Failed to read git revision of %q - %v", gitDir, err)
+		} else if revision != "" {
+			derived[AnnotationRevision] = revision
+		}
+	}
+	explicit := make(map[string]bool)
+	for key, val := range annotations {
+		derived[key] = val
+		explicit[key] = true
+	}
+	return Metadata{
+		Author:      author,
+		Created:     created,
+		Annotations: derived,
+		explicit:    explicit,
+	}, nil
+}
+
+// ParseKeyValues parses a list of KEY=VALUE strings to a map
+func ParseKeyValues(pairs []string) (map[string]string, error) {
+	res := make(map[string]string)
+	for _, pair := range pairs {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid KEY=VALUE format: %q", pair)
+		}
+		res[parts[0]] = parts[1]
+	}
+	return res, nil
+}
+
+// AddMetadata sets the author and creation time of the image config and adds
+// the metadata annotations to the image manifest. Derived annotations do not
+// override the ones set by LABEL instructions, while explicit ones do.
+func (i *BimaImage) AddMetadata(metadata Metadata) error {
+	img := *i.Image
+	cfg, err := img.ConfigFile()
+	if err != nil {
+		return err
+	}
+	cfg = cfg.DeepCopy()
+	cfg.Author = metadata.Author
+	cfg.Created = v1.Time{Time: metadata.Created}
+	img, err = mutate.ConfigFile(img, cfg)
+	if err != nil {
+		return err
+	}
+	labels := i.getLabelMap()
+	annotations := make(map[string]string)
+	for key, val := range metadata.Annotations {
+		if _, ok := labels[key]; ok {
+			if !metadata.explicit[key] {
+				log.Debugf("Annotation %q is already set by a label", key)
+				continue
+			}
+			log.Debugf("Overriding the annotation of label %q", key)
+		}
+		annotations[key] = val
+	}
+	img = mutate.Annotations(img, annotations).(v1.Image)
+	i.Image = &img
+	return nil
+}
+
+// findGitDir returns the git directory of the repository containing dir,
+// or an empty string if dir is not part of a git repository.
+func findGitDir(dir string) (string, error) {
+	for {
+		gitPath := filepath.Join(dir, ".git")
+		isDir, err := utils.DirExists(gitPath)
+		if err != nil {
+			return "", err
+		}
+		if isDir {
+			return gitPath, nil
+		}
+		isFile, err := utils.FileExists(gitPath)
+		if err != nil {
+			return "", err
+		}
+		if isFile {
+			// worktrees and submodules use a file pointing to the actual git directory
+			content, err := os.ReadFile(gitPath)
+			if err != nil {
+				return "", err
+			}
+			target := strings.TrimSpace(strings.TrimPrefix(string(content), "gitdir:"))
+			if !filepath.IsAbs(target) {
+				target = filepath.Join(dir, target)
+			}
+			return target, nil
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", nil
+		}
+		dir = parent
+	}
+}
+
+// gitRevision returns the commit hash HEAD points to
+func gitRevision(gitDir string) (string, error) {
+	content, err := os.ReadFile(filepath.Join(gitDir, "HEAD"))
+	if err != nil {
+		return "", err
+	}
+	head := strings.TrimSpace(string(content))
+	if !strings.HasPrefix(head, "ref:") {
+		// detached HEAD
+		return head, nil
+	}
+	ref := strings.TrimSpace(strings.TrimPrefix(head, "ref:"))
+	// worktrees keep their refs in the common git directory
+	commonDir := gitDir
+	if content, err := os.ReadFile(filepath.Join(gitDir, "commondir")); err == nil {
+		commonDir = strings.TrimSpace(string(content))
+		if !filepath.IsAbs(commonDir) {
+			commonDir = filepath.Join(gitDir, commonDir)
+		}
+	}
+	for _, dir := range []string{gitDir, commonDir} {
+		content, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(ref)))
+		if err == nil {
+			return strings.TrimSpace(string(content)), nil
+		}
+	}
+	packed, err := os.Open(filepath.Join(commonDir, "packed-refs"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			// the branch has no commits yet
+			return "", nil
+		}
+		return "", err
+	}
+	defer packed.Close()
+	scanner := bufio.NewScanner(packed)
+	for scanner.Scan() {
+		parts := strings.Fields(scanner.Text())
+		if len(parts) == 2 && parts[1] == ref {
+			return parts[0], nil
+		}
+	}
+	return "", scanner.Err()
+}
+
+// gitRemoteURL returns the URL of the "origin" remote, without any credentials
+func gitRemoteURL(gitDir string) (string, error) {
+	configPath := filepath.Join(gitDir, "config")
+	if content, err := os.ReadFile(filepath.Join(gitDir, "commondir")); err == nil {
+		commonDir := strings.TrimSpace(string(content))
+		if !filepath.IsAbs(commonDir) {
+			commonDir = filepath.Join(gitDir, commonDir)
+		}
+		configPath = filepath.Join(commonDir, "config")
+	}
+	lines, err := utils.SplitFileToLines(configPath)
+	if err != nil {
+		return "", err
+	}
+	inOrigin := false
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "[") {
+			inOrigin = line == `[remote "origin"]`
+			continue
+		}
+		if !inOrigin {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) != "url" {
+			continue
+		}
+		remote := strings.TrimSpace(parts[1])
+		if u, err := url.Parse(remote); err == nil && u.User != nil {
+			u.User = nil
+			remote = u.String()
+		}
+		return remote, nil
+	}
+	return "", nil
+}
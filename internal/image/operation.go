@@ -19,18 +19,21 @@ import (
 	"strings"
 
 	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/nubificus/bima/internal/utils"
 )
 
 // supportedOperations returns a list of all supported operations
-func supportedOperations() [5]string {
-	return [5]string{"FROM", "COPY", "LABEL", "NOOP"}
+func supportedOperations() [6]string {
+	return [6]string{"FROM", "COPY", "LABEL", "ARG", "INITRD", "NOOP"}
 }
 
 // InstructionLine represents a single line from the Containerfile
 type InstructionLine string
 
+// NewInstructionLine creates an instruction line from a Containerfile line,
+// collapsing the whitespace between its words.
 func NewInstructionLine(line string) InstructionLine {
-	line = strings.TrimSpace(line)
+	line = utils.CollapseSpaces(strings.TrimSpace(line))
 	first := line[0]
 	if first == '#' {
 		line = "NOOP " + line
@@ -62,20 +65,54 @@ func (i InstructionLine) ToBimaOperation() (BimaOperation, error) {
 	}
 	op := i.operation()
 	switch op {
-	case "FROM", "NOOP":
+	case "FROM", "ARG", "NOOP":
 		return nil, nil
 	case "COPY":
 		return newCopyOperation(i)
 	case "LABEL":
 		return newLabelOperation(i)
+	case "INITRD":
+		return newInitrdOperation(i)
 	default:
 		return nil, fmt.Errorf("ERR: Unsupported operation %q", op)
 	}
 }
 
+// WithLineNumber records the Containerfile line number of an operation,
+// so that errors about the operation can point to its line
+func WithLineNumber(op BimaOperation, number int) BimaOperation {
+	switch o := op.(type) {
+	case CopyOperation:
+		o.lineNumber = number
+		return o
+	case LabelOperation:
+		o.lineNumber = number
+		return o
+	case InitrdOperation:
+		o.lineNumber = number
+		return o
+	}
+	return op
+}
+
+// operationSource describes the instruction of an operation for error messages,
+// along with its Containerfile line number, if known
+func operationSource(line string, lineNumber int) string {
+	if lineNumber == 0 {
+		return line
+	}
+	return fmt.Sprintf("Containerfile line %d (%s)", lineNumber, line)
+}
+
 type BimaOperation interface {
 	Line() string
 	Info() string
 	Type() string
 	UpdateImage(v1.Image) (v1.Image, error)
 }
+
+// layerOperation is implemented by operations that add a new filesystem layer to the image
+type layerOperation interface {
+	BimaOperation
+	Files() (map[string][]byte, map[string]*sparseFile, error)
+}
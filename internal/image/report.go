@@ -0,0 +1,228 @@
+// Copyright 2023 Nubificus LTD.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// Supported formats of the size report
+const (
+	SizeReportText = "text"
+	SizeReportJSON = "json"
+)
+
+// reportedFiles is the number of largest files listed for each layer
+const reportedFiles = 5
+
+// SupportedSizeReportFormats returns a list of all supported size report formats
+func SupportedSizeReportFormats() []string {
+	return []string{SizeReportText, SizeReportJSON}
+}
+
+// FileSize is the size of a file of a layer
+type FileSize struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+}
+
+// LayerSize holds the sizes of a layer and its largest files. UncompressedSize
+// is the size of the layer tarball, which only holds the data of sparse files,
+// while UnpackedSize is the total size of its files, holes included.
+type LayerSize struct {
+	Digest           string     `json:"digest"`
+	CreatedBy        string     `json:"createdBy"`
+	Size             int64      `json:"size"`
+	UncompressedSize int64      `json:"uncompressedSize"`
+	UnpackedSize     int64      `json:"unpackedSize"`
+	LargestFiles     []FileSize `json:"largestFiles"`
+}
+
+// SizeReport holds the sizes of the layers of an image.
+// Size is the total compressed size of the layers.
+type SizeReport struct {
+	Platform         string      `json:"platform"`
+	Size             int64       `json:"size"`
+	UncompressedSize int64       `json:"uncompressedSize"`
+	UnpackedSize     int64       `json:"unpackedSize"`
+	Layers           []LayerSize `json:"layers"`
+}
+
+// SizeReport reads the layers of the image to report their sizes
+func (i *BimaImage) SizeReport() (SizeReport, error) {
+	img := *i.Image
+	cf, err := img.ConfigFile()
+	if err != nil {
+		return SizeReport{}, err
+	}
+	platform := v1.Platform{OS: cf.OS, Architecture: cf.Architecture, Variant: cf.Variant}
+	report := SizeReport{Platform: platform.String(), Layers: []LayerSize{}}
+	layers, err := img.Layers()
+	if err != nil {
+		return SizeReport{}, err
+	}
+	// history entries of empty layers have no matching layer
+	createdBy := []string{}
+	for _, h := range cf.History {
+		if !h.EmptyLayer {
+			createdBy = append(createdBy, h.CreatedBy)
+		}
+	}
+	for idx, layer := range layers {
+		layerSize, err := newLayerSize(layer)
+		if err != nil {
+			return SizeReport{}, err
+		}
+		if len(createdBy) == len(layers) {
+			layerSize.CreatedBy = createdBy[idx]
+		}
+		report.Size += layerSize.Size
+		report.UncompressedSize += layerSize.UncompressedSize
+		report.UnpackedSize += layerSize.UnpackedSize
+		report.Layers = append(report.Layers, layerSize)
+	}
+	return report, nil
+}
+
+// newLayerSize reads a layer to find its uncompressed and unpacked sizes
+// and its largest files
+func newLayerSize(layer v1.Layer) (LayerSize, error) {
+	digest, err := layer.Digest()
+	if err != nil {
+		return LayerSize{}, err
+	}
+	size, err := layer.Size()
+	if err != nil {
+		return LayerSize{}, err
+	}
+	rc, err := layer.Uncompressed()
+	if err != nil {
+		return LayerSize{}, err
+	}
+	defer rc.Close()
+	counter := &countingReader{r: rc}
+	tr := tar.NewReader(counter)
+	files := []FileSize{}
+	var unpacked int64
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return LayerSize{}, fmt.Errorf("failed to read layer %s - %v", digest, err)
+		}
+		// the size of sparse files is their real size, holes included
+		if hdr.Typeflag == tar.TypeReg {
+			files = append(files, FileSize{Path: hdr.Name, Size: hdr.Size})
+			unpacked += hdr.Size
+		}
+	}
+	// count the padding following the end of the archive
+	if _, err := io.Copy(io.Discard, counter); err != nil {
+		return LayerSize{}, err
+	}
+	sort.SliceStable(files, func(a, b int) bool {
+		return files[a].Size > files[b].Size
+	})
+	if len(files) > reportedFiles {
+		files = files[:reportedFiles]
+	}
+	return LayerSize{
+		Digest:           digest.String(),
+		Size:             size,
+		UncompressedSize: counter.n,
+		UnpackedSize:     unpacked,
+		LargestFiles:     files,
+	}, nil
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// CheckLimits checks the unpacked size of the image and its layers, which
+// is the space they take once unpacked, holes of sparse files included,
+// against the given limits. Zero limits are not checked.
+func (r SizeReport) CheckLimits(maxImageSize int64, maxLayerSize int64) error {
+	if maxImageSize > 0 && r.UnpackedSize > maxImageSize {
+		return fmt.Errorf("image for platform %q is %s unpacked, exceeding the maximum image size of %s", r.Platform, formatSize(r.UnpackedSize), formatSize(maxImageSize))
+	}
+	if maxLayerSize > 0 {
+		for _, layer := range r.Layers {
+			if layer.UnpackedSize > maxLayerSize {
+				return fmt.Errorf("layer %s created by %q is %s unpacked, exceeding the maximum layer size of %s", layer.Digest, layer.CreatedBy, formatSize(layer.UnpackedSize), formatSize(maxLayerSize))
+			}
+		}
+	}
+	return nil
+}
+
+// WriteSizeReports writes the size reports of the built images to w,
+// as plain text or JSON
+func WriteSizeReports(w io.Writer, reports []SizeReport, format string) error {
+	switch format {
+	case SizeReportJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(reports)
+	case SizeReportText:
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		for _, report := range reports {
+			fmt.Fprintf(tw, "Image for platform %s: %s compressed, %s uncompressed, %s unpacked\n", report.Platform, formatSize(report.Size), formatSize(report.UncompressedSize), formatSize(report.UnpackedSize))
+			fmt.Fprintln(tw, "  LAYER\tSIZE\tUNCOMPRESSED\tUNPACKED\tCREATED BY")
+			for _, layer := range report.Layers {
+				fmt.Fprintf(tw, "  %.19s\t%s\t%s\t%s\t%s\n", layer.Digest, formatSize(layer.Size), formatSize(layer.UncompressedSize), formatSize(layer.UnpackedSize), layer.CreatedBy)
+				for _, file := range layer.LargestFiles {
+					fmt.Fprintf(tw, "    %s\t\t\t%s\t\n", file.Path, formatSize(file.Size))
+				}
+			}
+		}
+		return tw.Flush()
+	default:
+		return fmt.Errorf("unsupported size report format %q", format)
+	}
+}
+
+// formatSize formats a size in bytes with a binary unit
+func formatSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	value := float64(size)
+	for _, suffix := range []string{"KiB", "MiB", "GiB", "TiB"} {
+		value /= unit
+		if value < unit || suffix == "TiB" {
+			return fmt.Sprintf("%.1f %s", value, suffix)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,211 @@
+// Copyright 2023 Nubificus LTD.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/nubificus/bima/internal/rootfs"
+	"github.com/nubificus/bima/internal/utils"
+)
+
+// Supported formats of the filesystem image assembled from the copied files
+const (
+	RootfsFormatExt2     = "ext2"
+	RootfsFormatSquashfs = "squashfs"
+	RootfsFormatEROFS    = "erofs"
+	RootfsFormatInitrd   = "initrd"
+)
+
+const (
+	// blockAnnotation holds the in-image path of the block image urunc
+	// attaches to the unikernel as its rootfs
+	blockAnnotation = "com.urunc.unikernel.block"
+	// blockFsTypeAnnotation holds the filesystem type of the block image
+	blockFsTypeAnnotation = "com.urunc.unikernel.blockFsType"
+	// blockReadOnlyAnnotation marks block images urunc must attach read-only
+	blockReadOnlyAnnotation = "com.urunc.unikernel.blockReadOnly"
+	// initrdAnnotation holds the in-image path of the initrd of the unikernel
+	initrdAnnotation = "com.urunc.unikernel.initrd"
+)
+
+// SupportedRootfsFormats returns a list of all supported filesystem image formats
+func SupportedRootfsFormats() []string {
+	return []string{RootfsFormatExt2, RootfsFormatSquashfs, RootfsFormatEROFS, RootfsFormatInitrd}
+}
+
+// isReadOnlyRootfsFormat reports whether the filesystem format can only be mounted read-only
+func isReadOnlyRootfsFormat(format string) bool {
+	return format == RootfsFormatSquashfs || format == RootfsFormatEROFS
+}
+
+// SupportedInitrdCompressions returns a list of all supported initrd compressions
+func SupportedInitrdCompressions() []string {
+	return []string{rootfs.CompressionNone, rootfs.CompressionGzip, rootfs.CompressionLZ4}
+}
+
+// splitRootfsFiles splits the copied files to the ones added to the image layers
+// and the ones assembled in the filesystem image. The unikernel binary and
+// urunc.json are read by urunc, so they are always kept in the layers. Sparse
+// files assembled in the filesystem image are read in full.
+func (i *BimaImage) splitRootfsFiles(files map[string][]byte, sparse map[string]*sparseFile) (map[string][]byte, map[string]*sparseFile, map[string][]byte, error) {
+	if i.opts.RootfsFormat == "" {
+		return files, sparse, nil, nil
+	}
+	layerFiles := make(map[string][]byte)
+	layerSparse := make(map[string]*sparseFile)
+	rootfsFiles := make(map[string][]byte)
+	rootfsSparse := make(map[string]*sparseFile)
+	for p, content := range files {
+		if i.inRootfs(filepath.Clean(p)) {
+			rootfsFiles[p] = content
+		} else {
+			layerFiles[p] = content
+		}
+	}
+	for p, s := range sparse {
+		if i.inRootfs(filepath.Clean(p)) {
+			rootfsSparse[p] = s
+		} else {
+			layerSparse[p] = s
+		}
+	}
+	err := inflateSparseFiles(rootfsSparse, rootfsFiles)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return layerFiles, layerSparse, rootfsFiles, nil
+}
+
+// inRootfs reports whether the copied file at p is assembled in the filesystem
+// image. If INITRD instructions are used, only the files they select are.
+func (i *BimaImage) inRootfs(p string) bool {
+	if p == i.binary || p == uruncJSONPath {
+		return false
+	}
+	if len(i.initrdPaths) == 0 {
+		return true
+	}
+	for _, selected := range i.initrdPaths {
+		if p == selected || strings.HasPrefix(p, strings.TrimSuffix(selected, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// addRootfsFiles adds files to the filesystem image, replacing
+// any files copied at the same path by previous operations
+func (i *BimaImage) addRootfsFiles(files map[string][]byte) {
+	for p, content := range files {
+		i.rootfsFiles[filepath.Clean(p)] = content
+	}
+}
+
+// AddRootfs assembles the copied files in a filesystem image of the configured
+// format and adds it to the image. The image is placed at the path set by the
+// annotation of the format, "com.urunc.unikernel.block" for block images and
+// "com.urunc.unikernel.initrd" for initrd images, or at a default path if the
+// annotation is not set by a label. Block images are also annotated with their
+// filesystem type and, for read-only formats, to be attached read-only.
+func (i *BimaImage) AddRootfs() error {
+	format := i.opts.RootfsFormat
+	if format == "" {
+		return nil
+	}
+	annotation := blockAnnotation
+	imagePath := "/rootfs." + format
+	if format == RootfsFormatInitrd {
+		annotation = initrdAnnotation
+		imagePath = "/initrd.cpio"
+		switch i.opts.InitrdCompression {
+		case rootfs.CompressionGzip:
+			imagePath += ".gz"
+		case rootfs.CompressionLZ4:
+			imagePath += ".lz4"
+		}
+	}
+	encoded, labelled := i.getLabelMap()[annotation]
+	if labelled {
+		decoded, err := utils.Base64Decode(encoded)
+		if err != nil {
+			return fmt.Errorf("failed to decode %q annotation value", annotation)
+		}
+		imagePath = filepath.Clean(decoded)
+	}
+	for _, selected := range i.initrdPaths {
+		found := false
+		for p := range i.rootfsFiles {
+			if p == selected || strings.HasPrefix(p, strings.TrimSuffix(selected, "/")+"/") {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("INITRD path %q does not match any copied file", selected)
+		}
+	}
+	if _, ok := i.rootfsFiles[imagePath]; ok {
+		return fmt.Errorf("rootfs image path %q conflicts with a copied file", imagePath)
+	}
+	var content []byte
+	var err error
+	switch format {
+	case RootfsFormatExt2:
+		content, err = rootfs.Ext2(i.rootfsFiles)
+	case RootfsFormatSquashfs:
+		content, err = rootfs.Squashfs(i.rootfsFiles)
+	case RootfsFormatEROFS:
+		content, err = rootfs.EROFS(i.rootfsFiles)
+	case RootfsFormatInitrd:
+		content, err = rootfs.Initrd(i.rootfsFiles, i.opts.InitrdCompression)
+	default:
+		return fmt.Errorf("unsupported rootfs format %q", format)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create %s rootfs image - %v", format, err)
+	}
+	log.Infof("Created %s rootfs image %q with %d files", format, imagePath, len(i.rootfsFiles))
+	layer, err := newLayer(map[string][]byte{imagePath: content}, nil, i.layerOptions())
+	if err != nil {
+		return err
+	}
+	img, err := appendHistory(*i.Image, layer, fmt.Sprintf("ROOTFS %s %s", format, imagePath))
+	if err != nil {
+		return err
+	}
+	i.Image = &img
+	labels := [][2]string{}
+	if !labelled {
+		labels = append(labels, [2]string{annotation, imagePath})
+	}
+	if format != RootfsFormatInitrd {
+		labels = append(labels, [2]string{blockFsTypeAnnotation, format})
+		if isReadOnlyRootfsFormat(format) {
+			labels = append(labels, [2]string{blockReadOnlyAnnotation, "true"})
+		}
+	}
+	for _, label := range labels {
+		if _, set := i.getLabelMap()[label[0]]; set && label[0] != annotation {
+			continue
+		}
+		if err := i.ApplyOperation(NewLabelOperation(label[0], label[1])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
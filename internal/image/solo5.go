@@ -0,0 +1,223 @@
+// Copyright 2023 Nubificus LTD.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"github.com/nubificus/bima/internal/utils"
+)
+
+// Solo5 ELF notes, as defined in Solo5's include/elf_abi.h
+const (
+	solo5NoteName     = "Solo5"
+	solo5NoteManifest = 0x3154464d // "MFT1"
+	solo5NoteABI      = 0x31494241 // "ABI1"
+	solo5MftVersion   = 1
+	solo5MftNameSize  = 68
+)
+
+// solo5ABITargets maps the Solo5 ABI targets to their names
+var solo5ABITargets = map[uint32]string{
+	1: "hvt",
+	2: "spt",
+	3: "virtio",
+	4: "muen",
+	5: "genode",
+	6: "xen",
+}
+
+// solo5Hypervisors lists the hypervisors able to run each Solo5 ABI target
+var solo5Hypervisors = map[string][]string{
+	"hvt":    {"hvt"},
+	"spt":    {"spt"},
+	"virtio": {"virtio", "qemu", "firecracker"},
+	"muen":   {"muen"},
+	"genode": {"genode"},
+	"xen":    {"xen"},
+}
+
+// solo5MftTypes maps the Solo5 manifest entry types to device kinds
+var solo5MftTypes = map[uint32]string{
+	1: "block",
+	2: "net",
+}
+
+// solo5ABI holds the Solo5 ABI and manifest notes of a unikernel binary
+type solo5ABI struct {
+	Target  string
+	Version uint32
+	// Devices maps the device names declared in the manifest to their kind
+	Devices map[string]string
+}
+
+// validateSolo5ABI checks that a Solo5 unikernel binary was built for the
+// hypervisor set by the "com.urunc.unikernel.hypervisor" annotation.
+func (i *BimaImage) validateSolo5ABI() error {
+	unikernelPath, err := i.unikernelSource()
+	if err != nil {
+		return err
+	}
+	encoded, ok := i.getLabelMap()[hypervisorAnnotation]
+	if !ok {
+		return nil
+	}
+	hypervisor, err := utils.Base64Decode(encoded)
+	if err != nil {
+		return fmt.Errorf("failed to decode hypervisor annotation value")
+	}
+	abi, err := readSolo5ABI(unikernelPath)
+	if err != nil {
+		return fmt.Errorf("failed to read Solo5 notes of %q - %v", unikernelPath, err)
+	}
+	if abi == nil {
+		if _, isSolo5 := solo5Hypervisors[hypervisor]; isSolo5 {
+			log.Warnf("Unikernel binary %q has no Solo5 ABI note, although hypervisor is %q", unikernelPath, hypervisor)
+		}
+		return nil
+	}
+	log.Debugf("Found Solo5 ABI %q version %d in %q", abi.Target, abi.Version, unikernelPath)
+	for name, kind := range abi.Devices {
+		log.Debugf("Solo5 manifest declares %s device %q", kind, name)
+	}
+	for _, supported := range solo5Hypervisors[abi.Target] {
+		if supported == hypervisor {
+			return nil
+		}
+	}
+	return fmt.Errorf("unikernel binary %q is built for the Solo5 %q target, which can not run on hypervisor %q", unikernelPath, abi.Target, hypervisor)
+}
+
+// readSolo5ABI returns the Solo5 notes of an ELF binary, or nil if the binary
+// is not an ELF file or has no Solo5 ABI note.
+func readSolo5ABI(binaryPath string) (*solo5ABI, error) {
+	f, err := elf.Open(binaryPath)
+	if err != nil {
+		if _, ok := err.(*elf.FormatError); ok {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	var abi *solo5ABI
+	var manifest []byte
+	for _, section := range f.Sections {
+		if section.Type != elf.SHT_NOTE {
+			continue
+		}
+		data, err := section.Data()
+		if err != nil {
+			return nil, err
+		}
+		notes, err := parseNotes(data, f.ByteOrder)
+		if err != nil {
+			return nil, fmt.Errorf("section %s - %v", section.Name, err)
+		}
+		for _, note := range notes {
+			if note.name != solo5NoteName {
+				continue
+			}
+			switch note.noteType {
+			case solo5NoteABI:
+				if len(note.desc) < 8 {
+					return nil, fmt.Errorf("truncated ABI note")
+				}
+				target := f.ByteOrder.Uint32(note.desc)
+				name, ok := solo5ABITargets[target]
+				if !ok {
+					return nil, fmt.Errorf("unknown ABI target %d", target)
+				}
+				abi = &solo5ABI{Target: name, Version: f.ByteOrder.Uint32(note.desc[4:])}
+			case solo5NoteManifest:
+				manifest = note.desc
+			}
+		}
+	}
+	if abi == nil {
+		return nil, nil
+	}
+	if manifest != nil {
+		abi.Devices, err = parseSolo5Manifest(manifest, f.ByteOrder)
+		if err != nil {
+			return nil, fmt.Errorf("manifest note - %v", err)
+		}
+	}
+	return abi, nil
+}
+
+// elfNote is a single entry of an ELF note section
+type elfNote struct {
+	name     string
+	noteType uint32
+	desc     []byte
+}
+
+// parseNotes parses the entries of an ELF note section
+func parseNotes(data []byte, order binary.ByteOrder) ([]elfNote, error) {
+	align := func(n uint32) uint32 { return (n + 3) &^ 3 }
+	notes := []elfNote{}
+	for len(data) >= 12 {
+		nameSize, descSize, noteType := order.Uint32(data), order.Uint32(data[4:]), order.Uint32(data[8:])
+		data = data[12:]
+		if uint64(align(nameSize))+uint64(align(descSize)) > uint64(len(data)) {
+			return nil, fmt.Errorf("truncated note")
+		}
+		name := string(bytes.TrimRight(data[:nameSize], "\x00"))
+		data = data[align(nameSize):]
+		desc := data[:descSize]
+		data = data[align(descSize):]
+		notes = append(notes, elfNote{name: name, noteType: noteType, desc: desc})
+	}
+	return notes, nil
+}
+
+// parseSolo5Manifest parses the devices declared in a Solo5 manifest note
+func parseSolo5Manifest(desc []byte, order binary.ByteOrder) (map[string]string, error) {
+	// the manifest is aligned to 8 bytes, so it may follow 4 bytes of padding
+	if len(desc) >= 8 && order.Uint32(desc) != solo5MftVersion && order.Uint32(desc[4:]) == solo5MftVersion {
+		desc = desc[4:]
+	}
+	if len(desc) < 8 {
+		return nil, fmt.Errorf("truncated manifest")
+	}
+	if version := order.Uint32(desc); version != solo5MftVersion {
+		return nil, fmt.Errorf("unsupported manifest version %d", version)
+	}
+	entries := int(order.Uint32(desc[4:]))
+	desc = desc[8:]
+	devices := make(map[string]string)
+	if entries == 0 {
+		return devices, nil
+	}
+	entrySize := len(desc) / entries
+	if entrySize < solo5MftNameSize+4 {
+		return nil, fmt.Errorf("truncated manifest entries")
+	}
+	for e := 0; e < entries; e++ {
+		entry := desc[e*entrySize : (e+1)*entrySize]
+		name := strings.SplitN(string(entry[:solo5MftNameSize]), "\x00", 2)[0]
+		kind, ok := solo5MftTypes[order.Uint32(entry[solo5MftNameSize:])]
+		if !ok {
+			// reserved entries, such as the one marking the manifest as relocatable
+			continue
+		}
+		devices[name] = kind
+	}
+	return devices, nil
+}
@@ -0,0 +1,242 @@
+// Copyright 2023 Nubificus LTD.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// sparseMinHoles is the minimum size of the holes of a file
+	// for it to be stored as a sparse file
+	sparseMinHoles = 1 << 20
+	// tarBlockSize is the size of tar headers and the alignment of their data
+	tarBlockSize = 512
+	// ustarMaxSize is the maximum size the ustar header size field can hold
+	ustarMaxSize = 1<<33 - 1
+)
+
+// sparseSegment is a region of a sparse file holding data
+type sparseSegment struct {
+	Offset int64
+	Length int64
+}
+
+// sparseFile is a copied file with holes. Only its data segments are read
+// from the source file, when they are written to a layer.
+type sparseFile struct {
+	source   string
+	size     int64
+	segments []sparseSegment
+}
+
+// readFile reads the file at p, unless it has holes, in which case it only
+// returns its data segments, as a sparse file
+func readFile(p string) ([]byte, *sparseFile, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	segments, err := dataSegments(f, info)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to find holes of %q - %v", p, err)
+	}
+	if segments != nil {
+		sparse := &sparseFile{source: p, size: info.Size(), segments: segments}
+		if holes := sparse.size - sparse.dataSize(); holes >= sparseMinHoles {
+			log.Debugf("Found %d bytes of holes in %q", holes, p)
+			return nil, sparse, nil
+		}
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, nil, err
+	}
+	content, err := io.ReadAll(f)
+	if err != nil {
+		return nil, nil, err
+	}
+	return content, nil, nil
+}
+
+// dataSize returns the total size of the data segments
+func (s *sparseFile) dataSize() int64 {
+	var size int64
+	for _, segment := range s.segments {
+		size += segment.Length
+	}
+	return size
+}
+
+// writeData writes the data segments of the file to w
+func (s *sparseFile) writeData(w io.Writer) error {
+	f, err := os.Open(s.source)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	for _, segment := range s.segments {
+		_, err := io.Copy(w, io.NewSectionReader(f, segment.Offset, segment.Length))
+		if err != nil {
+			return fmt.Errorf("failed to read %q - %v", s.source, err)
+		}
+	}
+	return nil
+}
+
+// content returns the full content of the file, with its holes filled with zeros
+func (s *sparseFile) content() ([]byte, error) {
+	f, err := os.Open(s.source)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	content := make([]byte, s.size)
+	for _, segment := range s.segments {
+		_, err := f.ReadAt(content[segment.Offset:segment.Offset+segment.Length], segment.Offset)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %q - %v", s.source, err)
+		}
+	}
+	return content, nil
+}
+
+// inflateSparseFiles returns the full content of sparse files
+func inflateSparseFiles(sparse map[string]*sparseFile, files map[string][]byte) error {
+	for p, s := range sparse {
+		log.Warnf("Storing %d bytes of holes of %q as data", s.size-s.dataSize(), s.source)
+		content, err := s.content()
+		if err != nil {
+			return err
+		}
+		files[p] = content
+	}
+	return nil
+}
+
+// writeSparseEntry writes a sparse file as a PAX entry of the GNU sparse
+// format 1.0. archive/tar can read such entries but not write them, so the
+// headers are encoded here and written to out, the underlying writer of tw.
+func writeSparseEntry(tw *tar.Writer, out io.Writer, name string, s *sparseFile) error {
+	// the sparse map lists the data segments, ending with an empty segment
+	// at the end of the file if the file ends with a hole
+	segments := s.segments
+	if len(segments) == 0 || segments[len(segments)-1].Offset+segments[len(segments)-1].Length < s.size {
+		segments = append(append([]sparseSegment{}, segments...), sparseSegment{Offset: s.size})
+	}
+	sparseMap := strconv.Itoa(len(segments)) + "\n"
+	for _, segment := range segments {
+		sparseMap += fmt.Sprintf("%d\n%d\n", segment.Offset, segment.Length)
+	}
+	sparseMap += strings.Repeat("\x00", padding(int64(len(sparseMap))))
+	size := int64(len(sparseMap)) + s.dataSize()
+
+	records := map[string]string{
+		"GNU.sparse.major":    "1",
+		"GNU.sparse.minor":    "0",
+		"GNU.sparse.name":     name,
+		"GNU.sparse.realsize": strconv.FormatInt(s.size, 10),
+	}
+	if size > ustarMaxSize {
+		records["size"] = strconv.FormatInt(size, 10)
+	}
+	pax := paxRecords(records)
+
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	dir, file := path.Split(strings.TrimPrefix(name, "/"))
+	entries := []string{
+		ustarHeader(path.Join(dir, "PaxHeaders.0", file), int64(len(pax)), tar.TypeXHeader),
+		pax + strings.Repeat("\x00", padding(int64(len(pax)))),
+		ustarHeader(path.Join(dir, "GNUSparseFile.0", file), size, tar.TypeReg),
+		sparseMap,
+	}
+	for _, entry := range entries {
+		if _, err := io.WriteString(out, entry); err != nil {
+			return err
+		}
+	}
+	if err := s.writeData(out); err != nil {
+		return err
+	}
+	_, err := out.Write(make([]byte, padding(s.dataSize())))
+	return err
+}
+
+// paxRecords encodes PAX extended header records, sorted by key
+func paxRecords(records map[string]string) string {
+	keys := []string{}
+	for key := range records {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	for _, key := range keys {
+		// the length of a record includes the digits of the length itself
+		record := " " + key + "=" + records[key] + "\n"
+		length := len(record)
+		for length < len(strconv.Itoa(length))+len(record) {
+			length++
+		}
+		b.WriteString(strconv.Itoa(length) + record)
+	}
+	return b.String()
+}
+
+// ustarHeader encodes a ustar header block. Names longer than the
+// name field are truncated, as readers take the name from PAX records.
+func ustarHeader(name string, size int64, typeflag byte) string {
+	blk := make([]byte, tarBlockSize)
+	if len(name) > 100 {
+		name = name[:100]
+	}
+	copy(blk[0:100], name)
+	copy(blk[100:108], "0000000\x00")
+	copy(blk[108:116], "0000000\x00")
+	copy(blk[116:124], "0000000\x00")
+	if size > ustarMaxSize {
+		// the size is set by a PAX record instead
+		size = 0
+	}
+	copy(blk[124:136], fmt.Sprintf("%011o\x00", size))
+	copy(blk[136:148], "00000000000\x00")
+	copy(blk[148:156], "        ")
+	blk[156] = typeflag
+	copy(blk[257:263], "ustar\x00")
+	copy(blk[263:265], "00")
+	var checksum int64
+	for _, b := range blk {
+		checksum += int64(b)
+	}
+	copy(blk[148:156], fmt.Sprintf("%06o\x00 ", checksum))
+	return string(blk)
+}
+
+// padding returns the number of bytes needed to align size to a tar block
+func padding(size int64) int {
+	return int(-size & (tarBlockSize - 1))
+}
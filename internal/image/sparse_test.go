@@ -0,0 +1,194 @@
+// Copyright 2023 Nubificus LTD.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// sparseTestName is longer than the name field of ustar headers
+var sparseTestName = "/" + strings.Repeat("d", 60) + "/" + strings.Repeat("f", 80) + ".img"
+
+// testSparseFile creates a file with holes at its start, middle and end,
+// returning it as a sparse file along with its full content
+func testSparseFile(t *testing.T) (*sparseFile, []byte) {
+	const size = 3<<20 + 5
+	content := make([]byte, size)
+	segments := []sparseSegment{{Offset: 1 << 20, Length: 4096}, {Offset: 2 << 20, Length: 100}}
+	for idx, segment := range segments {
+		copy(content[segment.Offset:], bytes.Repeat([]byte{byte('a' + idx)}, int(segment.Length)))
+	}
+	source := filepath.Join(t.TempDir(), "disk.img")
+	f, err := os.Create(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	for _, segment := range segments {
+		if _, err := f.WriteAt(content[segment.Offset:segment.Offset+segment.Length], segment.Offset); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := f.Truncate(size); err != nil {
+		t.Fatal(err)
+	}
+	return &sparseFile{source: source, size: size, segments: segments}, content
+}
+
+// writeSparseTar writes a tarball holding the sparse file s between two regular files
+func writeSparseTar(w io.Writer, s *sparseFile) error {
+	tw := tar.NewWriter(w)
+	for _, name := range []string{"/before", "", "/after"} {
+		if name == "" {
+			if err := writeSparseEntry(tw, w, sparseTestName, s); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := tw.WriteHeader(&tar.Header{Name: name, Size: int64(len(name)), Mode: 0o644}); err != nil {
+			return err
+		}
+		if _, err := tw.Write([]byte(name)); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// readSparseTar reads back a tarball of writeSparseTar with archive/tar,
+// returning the size of the sparse file and writing its content to w
+func readSparseTar(t *testing.T, r io.Reader, w io.Writer) int64 {
+	tr := tar.NewReader(r)
+	var size int64 = -1
+	for _, name := range []string{"/before", sparseTestName, "/after"} {
+		hdr, err := tr.Next()
+		if err != nil {
+			t.Fatalf("failed to read the header of %q: %v", name, err)
+		}
+		if hdr.Name != name {
+			t.Fatalf("read entry %q, expected %q", hdr.Name, name)
+		}
+		if name != sparseTestName {
+			content, err := io.ReadAll(tr)
+			if err != nil || string(content) != name {
+				t.Errorf("%s: read %q, %v", name, content, err)
+			}
+			continue
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			t.Errorf("sparse file has type %q, expected a regular file", hdr.Typeflag)
+		}
+		size = hdr.Size
+		if _, err := io.Copy(w, tr); err != nil {
+			t.Fatalf("failed to read the sparse file: %v", err)
+		}
+	}
+	if _, err := tr.Next(); err != io.EOF {
+		t.Errorf("expected the end of the archive, got %v", err)
+	}
+	return size
+}
+
+func TestSparseEntry(t *testing.T) {
+	s, content := testSparseFile(t)
+	var buf bytes.Buffer
+	if err := writeSparseTar(&buf, s); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() >= len(content) {
+		t.Errorf("tarball of %d bytes holds the holes of the %d bytes file", buf.Len(), len(content))
+	}
+	var got bytes.Buffer
+	if size := readSparseTar(t, bytes.NewReader(buf.Bytes()), &got); size != s.size {
+		t.Errorf("sparse file size %d, expected %d", size, s.size)
+	}
+	if !bytes.Equal(got.Bytes(), content) {
+		t.Error("content of the sparse file differs")
+	}
+
+	// the entries are also read by the tar implementations of other tools
+	archive := filepath.Join(t.TempDir(), "layer.tar")
+	if err := os.WriteFile(archive, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for _, tool := range []string{"tar", "bsdtar"} {
+		path, err := exec.LookPath(tool)
+		if err != nil {
+			t.Logf("%s not found, skipping", tool)
+			continue
+		}
+		dir := t.TempDir()
+		if out, err := exec.Command(path, "-xf", archive, "-C", dir).CombinedOutput(); err != nil {
+			t.Errorf("%s failed to extract the layer: %v\n%s", tool, err, out)
+			continue
+		}
+		extracted, err := os.ReadFile(filepath.Join(dir, sparseTestName))
+		if err != nil || !bytes.Equal(extracted, content) {
+			t.Errorf("%s: content of the sparse file differs (%v)", tool, err)
+		}
+		for _, name := range []string{"before", "after"} {
+			if extracted, err := os.ReadFile(filepath.Join(dir, name)); err != nil || string(extracted) != "/"+name {
+				t.Errorf("%s: %s: read %q, %v", tool, name, extracted, err)
+			}
+		}
+	}
+}
+
+// zeroCountingWriter counts the bytes written to it and checks they are zeros
+type zeroCountingWriter struct {
+	n       int64
+	nonZero bool
+}
+
+func (w *zeroCountingWriter) Write(p []byte) (int, error) {
+	if !w.nonZero && len(bytes.Trim(p, "\x00")) != 0 {
+		w.nonZero = true
+	}
+	w.n += int64(len(p))
+	return len(p), nil
+}
+
+func TestSparseEntryOverUstarSize(t *testing.T) {
+	if testing.Short() {
+		t.Skip("writing more than 8GiB of data is skipped in short mode")
+	}
+	// the data segment is read from /dev/zero, as it exceeds the size limit of ustar
+	s := &sparseFile{
+		source:   "/dev/zero",
+		size:     ustarMaxSize + 3<<20,
+		segments: []sparseSegment{{Offset: 1 << 20, Length: ustarMaxSize + 1}},
+	}
+	if _, err := os.Stat(s.source); err != nil {
+		t.Skip("/dev/zero not found")
+	}
+	r, w := io.Pipe()
+	go func() {
+		w.CloseWithError(writeSparseTar(w, s))
+	}()
+	got := &zeroCountingWriter{}
+	if size := readSparseTar(t, r, got); size != s.size {
+		t.Errorf("sparse file size %d, expected %d", size, s.size)
+	}
+	if got.n != s.size || got.nonZero {
+		t.Errorf("read %d bytes (non-zero: %v), expected %d zeros", got.n, got.nonZero, s.size)
+	}
+}
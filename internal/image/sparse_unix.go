@@ -0,0 +1,58 @@
+// Copyright 2023 Nubificus LTD.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux || darwin || freebsd
+
+package image
+
+import (
+	"errors"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// dataSegments returns the data segments of a file with holes, found with
+// SEEK_DATA and SEEK_HOLE, or nil if the file has no holes.
+func dataSegments(f *os.File, info os.FileInfo) ([]sparseSegment, error) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	// files with all of their blocks allocated have no holes
+	if !ok || int64(stat.Blocks)*512 >= info.Size() {
+		return nil, nil
+	}
+	segments := []sparseSegment{}
+	size := info.Size()
+	for offset := int64(0); offset < size; {
+		start, err := f.Seek(offset, unix.SEEK_DATA)
+		if errors.Is(err, syscall.ENXIO) {
+			// no data after offset
+			break
+		}
+		if errors.Is(err, syscall.EINVAL) {
+			// the filesystem does not report holes
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		end, err := f.Seek(start, unix.SEEK_HOLE)
+		if err != nil {
+			return nil, err
+		}
+		segments = append(segments, sparseSegment{Offset: start, Length: end - start})
+		offset = end
+	}
+	return segments, nil
+}
@@ -0,0 +1,221 @@
+// Copyright 2023 Nubificus LTD.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/nubificus/bima/internal/utils"
+)
+
+// Annotations of unikernel images, besides the ones defined next to the
+// features that set them
+const (
+	unikernelAnnotationPrefix  = "com.urunc.unikernel."
+	unikernelTypeAnnotation    = "com.urunc.unikernel.unikernelType"
+	binaryAnnotation           = "com.urunc.unikernel.binary"
+	cmdlineAnnotation          = "com.urunc.unikernel.cmdline"
+	blkMntPointAnnotation      = "com.urunc.unikernel.blkMntPoint"
+	useDMBlockAnnotation       = "com.urunc.unikernel.useDMBlock"
+	mountRootfsAnnotation      = "com.urunc.unikernel.mountRootfs"
+	kernelCmdlineAnnotation    = "com.urunc.unikernel.kernelCmdline"
+	unikernelVersionAnnotation = "com.urunc.unikernel.unikernelVersion"
+)
+
+// UnikernelSpec is the unikernel metadata of an image, as set by its labels
+type UnikernelSpec struct {
+	Type       string
+	Hypervisor string
+	Binary     string
+	Cmdline    string
+	// Initrd, Block and BlkMntPoint are optional
+	Initrd      string
+	Block       string
+	BlkMntPoint string
+	// Extra holds the values of all other unikernel annotations
+	Extra map[string]string
+	// labels maps the annotations to the LABEL operations that set them
+	labels map[string]LabelOperation
+}
+
+// commonAnnotations are accepted for all unikernel types
+var commonAnnotations = []string{
+	unikernelTypeAnnotation,
+	hypervisorAnnotation,
+	binaryAnnotation,
+	cmdlineAnnotation,
+	unikernelVersionAnnotation,
+	kernelVersionAnnotation,
+	memoryAnnotation,
+	vcpusAnnotation,
+	networkAnnotation,
+	launchConfigAnnotation,
+}
+
+// booleanAnnotations hold "true" or "false"
+var booleanAnnotations = []string{blockReadOnlyAnnotation, useDMBlockAnnotation, mountRootfsAnnotation}
+
+// UnikernelSpec builds the unikernel metadata of the image from its labels.
+// Later labels override earlier ones with the same key. A cmdline in the exec
+// form of a JSON array is normalized to a shell-quoted command line.
+func (i *BimaImage) UnikernelSpec() (UnikernelSpec, error) {
+	return unikernelSpec(i.labels)
+}
+
+// unikernelSpec builds the unikernel metadata from the given labels, in order
+func unikernelSpec(labels []LabelOperation) (UnikernelSpec, error) {
+	spec := UnikernelSpec{
+		Extra:  make(map[string]string),
+		labels: make(map[string]LabelOperation),
+	}
+	for _, label := range labels {
+		if !strings.HasPrefix(label.Key, unikernelAnnotationPrefix) {
+			continue
+		}
+		value, err := utils.Base64Decode(label.Value)
+		if err != nil {
+			return UnikernelSpec{}, fmt.Errorf("%s - failed to decode label value", label.source())
+		}
+		spec.labels[label.Key] = label
+		switch label.Key {
+		case unikernelTypeAnnotation:
+			spec.Type = value
+		case hypervisorAnnotation:
+			spec.Hypervisor = value
+		case binaryAnnotation:
+			spec.Binary = value
+		case cmdlineAnnotation:
+			spec.Cmdline = utils.NormalizeCmdline(value)
+		case initrdAnnotation:
+			spec.Initrd = value
+		case blockAnnotation:
+			spec.Block = value
+		case blkMntPointAnnotation:
+			spec.BlkMntPoint = value
+		default:
+			spec.Extra[label.Key] = value
+		}
+	}
+	return spec, nil
+}
+
+// setCmdlineLabels replaces the values of the cmdline labels with the
+// normalized cmdline of the spec, so that the manifest annotation and
+// urunc.json hold the same command line the unikernel is launched with
+func (i *BimaImage) setCmdlineLabels(spec UnikernelSpec) {
+	value := utils.Base64Encode(spec.Cmdline)
+	changed := false
+	for idx, label := range i.labels {
+		if label.Key == cmdlineAnnotation && label.Value != value {
+			i.labels[idx].Value = value
+			changed = true
+		}
+	}
+	if !changed {
+		return
+	}
+	log.Infof("Normalized the unikernel cmdline to %q", spec.Cmdline)
+	img := mutate.Annotations(*i.Image, map[string]string{cmdlineAnnotation: value}).(v1.Image)
+	i.Image = &img
+}
+
+// Validate checks the unikernel metadata against the support of its type in
+// the compatibility matrix, along with the annotation the rootfs of the given
+// format will be set by. Errors point to the LABEL instruction that set the
+// invalid value.
+func (s UnikernelSpec) Validate(matrix CompatibilityMatrix, rootfsFormat string) error {
+	missing := []string{}
+	for _, key := range RequiredUnikernelAnnotations() {
+		if _, ok := s.labels[key]; !ok {
+			missing = append(missing, key)
+		}
+	}
+	if len(missing) != 0 {
+		return fmt.Errorf("invalid bima unikernel image - missing labels %v", missing)
+	}
+	support, ok := matrix[s.Type]
+	if !ok {
+		return s.errorf(unikernelTypeAnnotation, "unsupported unikernel type %q, supported types: %v", s.Type, matrix.UnikernelTypes())
+	}
+	if !contains(support.Hypervisors, s.Hypervisor) {
+		return s.errorf(hypervisorAnnotation, "hypervisor %q is not supported by %s unikernels, supported hypervisors: %v", s.Hypervisor, s.Type, support.Hypervisors)
+	}
+	if s.Binary == "" {
+		return s.errorf(binaryAnnotation, "empty unikernel binary path")
+	}
+	if _, err := utils.ParseCmdline(s.Cmdline); err != nil {
+		return s.errorf(cmdlineAnnotation, "invalid cmdline - %v", err)
+	}
+	keys := []string{}
+	for key := range s.labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if contains(commonAnnotations, key) || contains(support.Annotations, key) {
+			continue
+		}
+		if !matrix.knownAnnotation(key) {
+			log.Warnf("%s - unknown unikernel annotation %q", s.labels[key].source(), key)
+			continue
+		}
+		return s.errorf(key, "annotation %q is not supported by %s unikernels", key, s.Type)
+	}
+	for _, key := range booleanAnnotations {
+		value, ok := s.Extra[key]
+		if !ok {
+			continue
+		}
+		if _, err := strconv.ParseBool(value); err != nil {
+			return s.errorf(key, "invalid value %q of %q, expected \"true\" or \"false\"", value, key)
+		}
+	}
+	if _, err := s.resources(); err != nil {
+		return err
+	}
+	if value, ok := s.Extra[networkAnnotation]; ok && !contains(SupportedNetworkModes(), value) {
+		return s.errorf(networkAnnotation, "invalid network mode %q, supported modes: %v", value, SupportedNetworkModes())
+	}
+	if rootfsFormat != "" {
+		annotation := blockAnnotation
+		if rootfsFormat == RootfsFormatInitrd {
+			annotation = initrdAnnotation
+		}
+		if !contains(support.Annotations, annotation) {
+			return fmt.Errorf("%s rootfs images are not supported by %s unikernels", rootfsFormat, s.Type)
+		}
+	}
+	return nil
+}
+
+// errorf returns an error about the value of an annotation,
+// pointing to the LABEL instruction that set it
+func (s UnikernelSpec) errorf(key string, format string, args ...interface{}) error {
+	return fmt.Errorf("%s - %s", s.labels[key].source(), fmt.Sprintf(format, args...))
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,479 @@
+// Copyright 2023 Nubificus LTD.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// elfSectionAction is what rewriteELF does with a section
+type elfSectionAction int
+
+const (
+	// keepSection keeps the section and its content
+	keepSection elfSectionAction = iota
+	// dropSection removes the section
+	dropSection
+	// emptySection keeps the section header as SHT_NOBITS, without its content
+	emptySection
+)
+
+// gnuBuildIDNote is the type of the GNU build-id note
+const gnuBuildIDNote = 3
+
+// debugSectionPrefixes are the name prefixes of the sections removed by "strip --strip-debug"
+var debugSectionPrefixes = []string{".debug", ".zdebug", ".stab", ".gdb_index", ".line"}
+
+// strippedELF holds a binary stripped of its debug sections,
+// along with a debug file holding them
+type strippedELF struct {
+	stripped []byte
+	debug    []byte
+	// buildID is the hex GNU build-id of the binary, empty if it has none
+	buildID string
+}
+
+// rawSection is an ELF section header, for both classes
+type rawSection struct {
+	name      uint32
+	shType    uint32
+	flags     uint64
+	addr      uint64
+	offset    uint64
+	size      uint64
+	link      uint32
+	info      uint32
+	addralign uint64
+	entsize   uint64
+}
+
+// elfLayout holds the fields of the ELF header that locate the other headers
+type elfLayout struct {
+	class     elf.Class
+	order     binary.ByteOrder
+	ehsize    uint64
+	phoff     uint64
+	phentsize uint64
+	phnum     uint64
+	shoff     uint64
+	shentsize uint64
+	shnum     uint64
+	shstrndx  uint64
+}
+
+// stripDebug splits the debug sections of an ELF binary from the rest of it,
+// like "objcopy --only-keep-debug" followed by "strip --strip-debug". The
+// loadable segments of the stripped binary are left at their file offsets.
+// It returns nil if the binary is not an ELF file or has no debug sections.
+func stripDebug(data []byte) (*strippedELF, error) {
+	if len(data) < 4 || string(data[:4]) != elf.ELFMAG {
+		return nil, nil
+	}
+	f, err := elf.NewFile(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	debug := make([]bool, len(f.Sections))
+	found := false
+	for idx, s := range f.Sections {
+		if s.Flags&elf.SHF_ALLOC == 0 && isDebugSection(s.Name) {
+			debug[idx] = true
+			found = true
+		}
+	}
+	if !found {
+		return nil, nil
+	}
+	// relocations of debug sections go along with them
+	for idx, s := range f.Sections {
+		if (s.Type == elf.SHT_REL || s.Type == elf.SHT_RELA) && int(s.Info) < len(debug) && debug[s.Info] {
+			debug[idx] = true
+		}
+	}
+	stripped, err := rewriteELF(data, true, func(idx int, s *elf.Section) elfSectionAction {
+		if debug[idx] {
+			return dropSection
+		}
+		return keepSection
+	})
+	if err != nil {
+		return nil, err
+	}
+	debugFile, err := rewriteELF(data, false, func(idx int, s *elf.Section) elfSectionAction {
+		if s.Flags&elf.SHF_ALLOC != 0 && s.Type != elf.SHT_NOTE {
+			return emptySection
+		}
+		return keepSection
+	})
+	if err != nil {
+		return nil, err
+	}
+	buildID, err := elfBuildID(f)
+	if err != nil {
+		return nil, err
+	}
+	return &strippedELF{stripped: stripped, debug: debugFile, buildID: buildID}, nil
+}
+
+// isDebugSection reports whether the section name is the one of a debug section
+func isDebugSection(name string) bool {
+	for _, prefix := range debugSectionPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// elfBuildID returns the hex GNU build-id of f, or an empty string if it has none
+func elfBuildID(f *elf.File) (string, error) {
+	for _, s := range f.Sections {
+		if s.Type != elf.SHT_NOTE {
+			continue
+		}
+		data, err := s.Data()
+		if err != nil {
+			return "", err
+		}
+		notes, err := parseNotes(data, f.ByteOrder)
+		if err != nil {
+			return "", fmt.Errorf("section %q - %v", s.Name, err)
+		}
+		for _, note := range notes {
+			if note.name == "GNU" && note.noteType == gnuBuildIDNote {
+				return hex.EncodeToString(note.desc), nil
+			}
+		}
+	}
+	return "", nil
+}
+
+// rewriteELF rewrites an ELF file, applying the action returned for each of its
+// sections. If keepSegments is set, the file is kept up to the end of its
+// program headers, segments and allocated sections, so they stay at the same
+// offsets, and the remaining sections are appended. Otherwise, the program
+// headers are removed and the contents of all sections are laid out anew.
+func rewriteELF(data []byte, keepSegments bool, action func(idx int, s *elf.Section) elfSectionAction) ([]byte, error) {
+	f, err := elf.NewFile(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	l, err := readELFLayout(data, f)
+	if err != nil {
+		return nil, err
+	}
+	sections, err := readSections(data, l)
+	if err != nil {
+		return nil, err
+	}
+
+	// the null section is always kept, as well as the section names
+	actions := make([]elfSectionAction, len(sections))
+	index := make([]uint32, len(sections))
+	kept := uint32(0)
+	for idx := range sections {
+		if idx != 0 && uint64(idx) != l.shstrndx {
+			actions[idx] = action(idx, f.Sections[idx])
+		}
+		if actions[idx] != dropSection {
+			index[idx] = kept
+			kept++
+		}
+	}
+
+	// the symbols of the symbol tables refer to the sections by index
+	contents := make(map[int][]byte)
+	for idx, s := range sections {
+		if actions[idx] != keepSection || (s.shType != uint32(elf.SHT_SYMTAB) && s.shType != uint32(elf.SHT_DYNSYM)) {
+			continue
+		}
+		content, firstGlobal, err := rewriteSymbols(data, l, idx, sections, index, actions)
+		if err != nil {
+			return nil, fmt.Errorf("section %q - %v", f.Sections[idx].Name, err)
+		}
+		contents[idx] = content
+		sections[idx].size = uint64(len(content))
+		sections[idx].info = firstGlobal
+	}
+
+	out := &bytes.Buffer{}
+	end := l.ehsize
+	if keepSegments {
+		end = max64(end, l.phoff+l.phnum*l.phentsize)
+		for _, p := range f.Progs {
+			end = max64(end, p.Off+p.Filesz)
+		}
+		for idx, s := range sections {
+			if actions[idx] == keepSection && s.flags&uint64(elf.SHF_ALLOC) != 0 && s.shType != uint32(elf.SHT_NOBITS) {
+				end = max64(end, s.offset+s.size)
+			}
+		}
+	}
+	if end > uint64(len(data)) {
+		return nil, fmt.Errorf("truncated ELF file")
+	}
+	out.Write(data[:end])
+
+	headers := []rawSection{}
+	for idx, s := range sections {
+		switch actions[idx] {
+		case dropSection:
+			continue
+		case emptySection:
+			s.shType = uint32(elf.SHT_NOBITS)
+			s.offset = uint64(out.Len())
+		case keepSection:
+			hasData := idx != 0 && s.shType != uint32(elf.SHT_NOBITS)
+			if !hasData {
+				break
+			}
+			content, rewritten := contents[idx]
+			if !rewritten {
+				if s.offset+s.size > uint64(len(data)) {
+					return nil, fmt.Errorf("section %q exceeds the file size", f.Sections[idx].Name)
+				}
+				content = data[s.offset : s.offset+s.size]
+			}
+			// sections within the kept part of the file stay in place,
+			// where rewritten symbol tables are never larger than before
+			if s.offset+s.size > end {
+				padTo(out, s.addralign)
+				s.offset = uint64(out.Len())
+				out.Write(content)
+			} else if rewritten {
+				copy(out.Bytes()[s.offset:], content)
+			}
+		}
+		s.link = remapSection(s.link, index, actions)
+		if s.shType == uint32(elf.SHT_REL) || s.shType == uint32(elf.SHT_RELA) || s.flags&uint64(elf.SHF_INFO_LINK) != 0 {
+			s.info = remapSection(s.info, index, actions)
+		}
+		headers = append(headers, s)
+	}
+
+	padTo(out, 8)
+	l.shoff = uint64(out.Len())
+	l.shnum = uint64(len(headers))
+	l.shstrndx = uint64(index[l.shstrndx])
+	if !keepSegments {
+		l.phoff, l.phnum = 0, 0
+	}
+	for _, s := range headers {
+		writeSection(out, l, s)
+	}
+	result := out.Bytes()
+	writeELFLayout(result, l)
+	return result, nil
+}
+
+// rewriteSymbols returns the content of the symbol table at idx, with the
+// section indices of its symbols remapped to the kept sections, along with
+// the index of its first non-local symbol. The symbols of dropped sections,
+// such as the section symbols of debug sections, are removed, which is only
+// possible for a symbol table that no kept relocation section refers to.
+func rewriteSymbols(data []byte, l elfLayout, idx int, sections []rawSection, index []uint32, actions []elfSectionAction) ([]byte, uint32, error) {
+	s := sections[idx]
+	entsize, shndxOff, infoOff := uint64(24), uint64(6), uint64(4)
+	if l.class == elf.ELFCLASS32 {
+		entsize, shndxOff, infoOff = 16, 14, 12
+	}
+	if s.entsize != entsize || s.size%entsize != 0 || s.offset+s.size > uint64(len(data)) {
+		return nil, 0, fmt.Errorf("invalid symbol table")
+	}
+	referenced := false
+	for rel, r := range sections {
+		switch {
+		case r.shType == uint32(elf.SHT_SYMTAB_SHNDX):
+			return nil, 0, fmt.Errorf("extended section indices are not supported")
+		case (r.shType == uint32(elf.SHT_REL) || r.shType == uint32(elf.SHT_RELA)) && r.link == uint32(idx) && actions[rel] != dropSection:
+			referenced = true
+		}
+	}
+	content := []byte{}
+	firstGlobal := uint32(0)
+	for off := uint64(0); off < s.size; off += entsize {
+		sym := append([]byte{}, data[s.offset+off:s.offset+off+entsize]...)
+		shndx := l.order.Uint16(sym[shndxOff:])
+		if shndx != uint16(elf.SHN_UNDEF) && shndx < uint16(elf.SHN_LORESERVE) {
+			if int(shndx) >= len(index) {
+				return nil, 0, fmt.Errorf("symbol %d refers to invalid section %d", off/entsize, shndx)
+			}
+			if actions[shndx] == dropSection {
+				if referenced || s.shType == uint32(elf.SHT_DYNSYM) {
+					return nil, 0, fmt.Errorf("symbol %d of dropped section %d can not be removed", off/entsize, shndx)
+				}
+				continue
+			}
+			l.order.PutUint16(sym[shndxOff:], uint16(index[shndx]))
+		}
+		if elf.ST_BIND(sym[infoOff]) == elf.STB_LOCAL {
+			firstGlobal = uint32(uint64(len(content))/entsize) + 1
+		}
+		content = append(content, sym...)
+	}
+	return content, firstGlobal, nil
+}
+
+// remapSection returns the new index of the section at idx, or 0 if it was dropped
+func remapSection(idx uint32, index []uint32, actions []elfSectionAction) uint32 {
+	if int(idx) >= len(index) || actions[idx] == dropSection {
+		return 0
+	}
+	return index[idx]
+}
+
+// padTo pads out with zeros up to the given alignment
+func padTo(out *bytes.Buffer, align uint64) {
+	if align <= 1 {
+		return
+	}
+	for uint64(out.Len())%align != 0 {
+		out.WriteByte(0)
+	}
+}
+
+func max64(a, b uint64) uint64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// readELFLayout reads the header fields locating the program and section headers
+func readELFLayout(data []byte, f *elf.File) (elfLayout, error) {
+	l := elfLayout{class: f.Class, order: f.ByteOrder}
+	o := f.ByteOrder
+	switch f.Class {
+	case elf.ELFCLASS64:
+		if len(data) < 64 {
+			return l, fmt.Errorf("truncated ELF header")
+		}
+		l.ehsize = 64
+		l.phoff = o.Uint64(data[0x20:])
+		l.shoff = o.Uint64(data[0x28:])
+		l.phentsize = uint64(o.Uint16(data[0x36:]))
+		l.phnum = uint64(o.Uint16(data[0x38:]))
+		l.shentsize = uint64(o.Uint16(data[0x3a:]))
+		l.shnum = uint64(o.Uint16(data[0x3c:]))
+		l.shstrndx = uint64(o.Uint16(data[0x3e:]))
+	case elf.ELFCLASS32:
+		if len(data) < 52 {
+			return l, fmt.Errorf("truncated ELF header")
+		}
+		l.ehsize = 52
+		l.phoff = uint64(o.Uint32(data[0x1c:]))
+		l.shoff = uint64(o.Uint32(data[0x20:]))
+		l.phentsize = uint64(o.Uint16(data[0x2a:]))
+		l.phnum = uint64(o.Uint16(data[0x2c:]))
+		l.shentsize = uint64(o.Uint16(data[0x2e:]))
+		l.shnum = uint64(o.Uint16(data[0x30:]))
+		l.shstrndx = uint64(o.Uint16(data[0x32:]))
+	default:
+		return l, fmt.Errorf("unsupported ELF class %v", f.Class)
+	}
+	// more than SHN_LORESERVE sections are counted in the first section header
+	if l.shnum == 0 || l.shstrndx >= uint64(elf.SHN_LORESERVE) || l.phnum >= 0xffff {
+		return l, fmt.Errorf("ELF files with extended section numbering are not supported")
+	}
+	if l.shstrndx >= l.shnum {
+		return l, fmt.Errorf("invalid section name table index %d", l.shstrndx)
+	}
+	return l, nil
+}
+
+// writeELFLayout updates the header fields locating the program and section headers
+func writeELFLayout(data []byte, l elfLayout) {
+	o := l.order
+	if l.class == elf.ELFCLASS64 {
+		o.PutUint64(data[0x20:], l.phoff)
+		o.PutUint64(data[0x28:], l.shoff)
+		o.PutUint16(data[0x38:], uint16(l.phnum))
+		o.PutUint16(data[0x3c:], uint16(l.shnum))
+		o.PutUint16(data[0x3e:], uint16(l.shstrndx))
+		return
+	}
+	o.PutUint32(data[0x1c:], uint32(l.phoff))
+	o.PutUint32(data[0x20:], uint32(l.shoff))
+	o.PutUint16(data[0x2c:], uint16(l.phnum))
+	o.PutUint16(data[0x30:], uint16(l.shnum))
+	o.PutUint16(data[0x32:], uint16(l.shstrndx))
+}
+
+// readSections reads the raw section headers
+func readSections(data []byte, l elfLayout) ([]rawSection, error) {
+	size := uint64(64)
+	if l.class == elf.ELFCLASS32 {
+		size = 40
+	}
+	if l.shentsize < size || l.shoff+l.shnum*l.shentsize > uint64(len(data)) {
+		return nil, fmt.Errorf("invalid section header table")
+	}
+	o := l.order
+	sections := make([]rawSection, l.shnum)
+	for idx := range sections {
+		h := data[l.shoff+uint64(idx)*l.shentsize:]
+		if l.class == elf.ELFCLASS64 {
+			sections[idx] = rawSection{
+				name: o.Uint32(h), shType: o.Uint32(h[4:]), flags: o.Uint64(h[8:]),
+				addr: o.Uint64(h[16:]), offset: o.Uint64(h[24:]), size: o.Uint64(h[32:]),
+				link: o.Uint32(h[40:]), info: o.Uint32(h[44:]), addralign: o.Uint64(h[48:]), entsize: o.Uint64(h[56:]),
+			}
+			continue
+		}
+		sections[idx] = rawSection{
+			name: o.Uint32(h), shType: o.Uint32(h[4:]), flags: uint64(o.Uint32(h[8:])),
+			addr: uint64(o.Uint32(h[12:])), offset: uint64(o.Uint32(h[16:])), size: uint64(o.Uint32(h[20:])),
+			link: o.Uint32(h[24:]), info: o.Uint32(h[28:]), addralign: uint64(o.Uint32(h[32:])), entsize: uint64(o.Uint32(h[36:])),
+		}
+	}
+	return sections, nil
+}
+
+// writeSection appends a section header to out, in the entry size of the file
+func writeSection(out *bytes.Buffer, l elfLayout, s rawSection) {
+	h := make([]byte, l.shentsize)
+	o := l.order
+	if l.class == elf.ELFCLASS64 {
+		o.PutUint32(h, s.name)
+		o.PutUint32(h[4:], s.shType)
+		o.PutUint64(h[8:], s.flags)
+		o.PutUint64(h[16:], s.addr)
+		o.PutUint64(h[24:], s.offset)
+		o.PutUint64(h[32:], s.size)
+		o.PutUint32(h[40:], s.link)
+		o.PutUint32(h[44:], s.info)
+		o.PutUint64(h[48:], s.addralign)
+		o.PutUint64(h[56:], s.entsize)
+	} else {
+		o.PutUint32(h, s.name)
+		o.PutUint32(h[4:], s.shType)
+		o.PutUint32(h[8:], uint32(s.flags))
+		o.PutUint32(h[12:], uint32(s.addr))
+		o.PutUint32(h[16:], uint32(s.offset))
+		o.PutUint32(h[20:], uint32(s.size))
+		o.PutUint32(h[24:], s.link)
+		o.PutUint32(h[28:], s.info)
+		o.PutUint32(h[32:], uint32(s.addralign))
+		o.PutUint32(h[36:], uint32(s.entsize))
+	}
+	out.Write(h)
+}
@@ -0,0 +1,247 @@
+// Copyright 2023 Nubificus LTD.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// testELF builds a 64-bit ELF file whose debug section comes before sections
+// that symbols refer to, so that stripping it renumbers them, and whose symbol
+// table holds a section symbol of the debug section.
+func testELF() []byte {
+	o := binary.LittleEndian
+	shstrtab := []byte("\x00.text\x00.debug_info\x00.data\x00.symtab\x00.strtab\x00.shstrtab\x00")
+	strtab := []byte("\x00counter\x00main\x00")
+	name := func(table []byte, s string) uint32 {
+		return uint32(bytes.Index(table, []byte("\x00"+s+"\x00")) + 1)
+	}
+	symbol := func(nameIdx uint32, info elf.SymType, bind elf.SymBind, shndx uint16, value uint64) []byte {
+		sym := make([]byte, 24)
+		o.PutUint32(sym, nameIdx)
+		sym[4] = byte(bind)<<4 | byte(info)
+		o.PutUint16(sym[6:], shndx)
+		o.PutUint64(sym[8:], value)
+		return sym
+	}
+	symtab := bytes.Join([][]byte{
+		make([]byte, 24),
+		symbol(0, elf.STT_SECTION, elf.STB_LOCAL, 2, 0),
+		symbol(name(strtab, "counter"), elf.STT_OBJECT, elf.STB_LOCAL, 3, 0x2000),
+		symbol(name(strtab, "main"), elf.STT_FUNC, elf.STB_GLOBAL, 1, 0x1000),
+		symbol(0, elf.STT_NOTYPE, elf.STB_GLOBAL, uint16(elf.SHN_ABS), 42),
+	}, nil)
+	contents := [][]byte{
+		nil,
+		bytes.Repeat([]byte{0x90}, 16),
+		[]byte("debug information of the binary"),
+		{1, 2, 3, 4, 5, 6, 7, 8},
+		symtab,
+		strtab,
+		shstrtab,
+	}
+	headers := []rawSection{
+		{},
+		{name: name(shstrtab, ".text"), shType: uint32(elf.SHT_PROGBITS), flags: uint64(elf.SHF_ALLOC | elf.SHF_EXECINSTR), addr: 0x1000, addralign: 16},
+		{name: name(shstrtab, ".debug_info"), shType: uint32(elf.SHT_PROGBITS), addralign: 1},
+		{name: name(shstrtab, ".data"), shType: uint32(elf.SHT_PROGBITS), flags: uint64(elf.SHF_ALLOC | elf.SHF_WRITE), addr: 0x2000, addralign: 8},
+		{name: name(shstrtab, ".symtab"), shType: uint32(elf.SHT_SYMTAB), link: 5, info: 3, addralign: 8, entsize: 24},
+		{name: name(shstrtab, ".strtab"), shType: uint32(elf.SHT_STRTAB), addralign: 1},
+		{name: name(shstrtab, ".shstrtab"), shType: uint32(elf.SHT_STRTAB), addralign: 1},
+	}
+	out := &bytes.Buffer{}
+	out.Write(make([]byte, 64))
+	for idx, content := range contents {
+		if idx == 0 {
+			continue
+		}
+		padTo(out, headers[idx].addralign)
+		headers[idx].offset = uint64(out.Len())
+		headers[idx].size = uint64(len(content))
+		out.Write(content)
+	}
+	padTo(out, 8)
+	l := elfLayout{class: elf.ELFCLASS64, order: o, shentsize: 64}
+	shoff := out.Len()
+	for _, h := range headers {
+		writeSection(out, l, h)
+	}
+	data := out.Bytes()
+	copy(data, elf.ELFMAG)
+	data[elf.EI_CLASS] = byte(elf.ELFCLASS64)
+	data[elf.EI_DATA] = byte(elf.ELFDATA2LSB)
+	data[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+	o.PutUint16(data[0x10:], uint16(elf.ET_EXEC))
+	o.PutUint16(data[0x12:], uint16(elf.EM_X86_64))
+	o.PutUint32(data[0x14:], uint32(elf.EV_CURRENT))
+	o.PutUint64(data[0x18:], 0x1000)
+	o.PutUint64(data[0x28:], uint64(shoff))
+	o.PutUint16(data[0x34:], 64)
+	o.PutUint16(data[0x3a:], 64)
+	o.PutUint16(data[0x3c:], uint16(len(headers)))
+	o.PutUint16(data[0x3e:], uint16(len(headers)-1))
+	return data
+}
+
+// symbolSections returns the section names of the named symbols of f
+func symbolSections(t *testing.T, f *elf.File) map[string]string {
+	syms, err := f.Symbols()
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := make(map[string]string)
+	for _, sym := range syms {
+		if sym.Name == "" {
+			continue
+		}
+		section := sym.Section.String()
+		if sym.Section > elf.SHN_UNDEF && sym.Section < elf.SHN_LORESERVE {
+			if int(sym.Section) >= len(f.Sections) {
+				t.Fatalf("symbol %q refers to missing section %d", sym.Name, sym.Section)
+			}
+			section = f.Sections[sym.Section].Name
+		}
+		res[sym.Name] = section
+	}
+	return res
+}
+
+// checkStripped re-parses the outputs of stripDebug for the ELF file data
+func checkStripped(t *testing.T, data []byte) {
+	orig, err := elf.NewFile(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := stripDebug(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res == nil {
+		t.Fatal("binary was not stripped")
+	}
+	stripped, err := elf.NewFile(bytes.NewReader(res.stripped))
+	if err != nil {
+		t.Fatalf("failed to parse the stripped binary: %v", err)
+	}
+	debug, err := elf.NewFile(bytes.NewReader(res.debug))
+	if err != nil {
+		t.Fatalf("failed to parse the debug file: %v", err)
+	}
+
+	origSymbols := symbolSections(t, orig)
+	for name, f := range map[string]*elf.File{"stripped binary": stripped, "debug file": debug} {
+		for sym, section := range symbolSections(t, f) {
+			if origSymbols[sym] != section {
+				t.Errorf("%s: symbol %q is in section %q, expected %q", name, sym, section, origSymbols[sym])
+			}
+		}
+	}
+	for _, s := range orig.Sections {
+		if s.Type == elf.SHT_NOBITS || s.Type == elf.SHT_SYMTAB || s.Type == elf.SHT_NULL {
+			continue
+		}
+		content, err := s.Data()
+		if err != nil {
+			t.Fatal(err)
+		}
+		inStripped := stripped.Section(s.Name)
+		if isDebugSection(s.Name) {
+			if inStripped != nil {
+				t.Errorf("debug section %q was not stripped", s.Name)
+			}
+		} else if inStripped == nil {
+			t.Errorf("section %q was stripped", s.Name)
+		} else if got, err := inStripped.Data(); err != nil || !bytes.Equal(got, content) {
+			t.Errorf("section %q of the stripped binary differs", s.Name)
+		}
+		inDebug := debug.Section(s.Name)
+		if inDebug == nil {
+			t.Errorf("section %q is missing from the debug file", s.Name)
+			continue
+		}
+		if s.Flags&elf.SHF_ALLOC != 0 && s.Type != elf.SHT_NOTE {
+			if inDebug.Type != elf.SHT_NOBITS {
+				t.Errorf("allocated section %q of the debug file has content", s.Name)
+			}
+		} else if got, err := inDebug.Data(); err != nil || !bytes.Equal(got, content) {
+			t.Errorf("section %q of the debug file differs", s.Name)
+		}
+	}
+}
+
+func TestStripDebug(t *testing.T) {
+	data := testELF()
+	checkStripped(t, data)
+
+	res, err := stripDebug(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stripped, err := elf.NewFile(bytes.NewReader(res.stripped))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the section symbol of the debug section is removed
+	symtab := stripped.Section(".symtab")
+	if count := symtab.Size / symtab.Entsize; count != 4 {
+		t.Errorf("stripped symbol table holds %d symbols, expected 4", count)
+	}
+	if symtab.Info != 2 {
+		t.Errorf("first global symbol of the stripped symbol table is %d, expected 2", symtab.Info)
+	}
+}
+
+func TestStripDebugGoBinary(t *testing.T) {
+	if testing.Short() {
+		t.Skip("building a Go binary is skipped in short mode")
+	}
+	goTool, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("go tool not found")
+	}
+	dir := t.TempDir()
+	src := filepath.Join(dir, "main.go")
+	if err := os.WriteFile(src, []byte("package main\n\nfunc main() { println(\"hello\") }\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	bin := filepath.Join(dir, "hello")
+	cmd := exec.Command(goTool, "build", "-o", bin, src)
+	cmd.Env = append(os.Environ(), "GOOS=linux", "CGO_ENABLED=0", "GOFLAGS=")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("failed to build test binary: %v\n%s", err, out)
+	}
+	data, err := os.ReadFile(bin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkStripped(t, data)
+	res, err := stripDebug(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	debug, err := elf.NewFile(bytes.NewReader(res.debug))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := debug.DWARF(); err != nil {
+		t.Errorf("failed to read the DWARF data of the debug file: %v", err)
+	}
+}
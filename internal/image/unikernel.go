@@ -14,15 +14,24 @@
 
 package image
 
+// uruncJSONPath is the path of the urunc configuration file inside the image rootfs
+const uruncJSONPath = "/urunc.json"
+
+// hypervisorAnnotation defines the hypervisor urunc uses to run the unikernel
+const hypervisorAnnotation = "com.urunc.unikernel.hypervisor"
+
+// kernelVersionAnnotation holds the version of Linux kernel unikernel binaries
+const kernelVersionAnnotation = "com.urunc.unikernel.kernelVersion"
+
 func RequiredUnikernelAnnotations() []string {
 	return []string{
-		"com.urunc.unikernel.unikernelType",
-		"com.urunc.unikernel.hypervisor",
-		"com.urunc.unikernel.binary",
-		"com.urunc.unikernel.cmdline",
+		unikernelTypeAnnotation,
+		hypervisorAnnotation,
+		binaryAnnotation,
+		cmdlineAnnotation,
 	}
 }
 
 func cmdAnnotation() string {
-	return "com.urunc.unikernel.binary"
+	return binaryAnnotation
 }
@@ -0,0 +1,221 @@
+// Copyright 2023 Nubificus LTD.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/nubificus/bima/internal/utils"
+)
+
+// Supported schemas of urunc.json. The legacy schema, which is the default,
+// is the flat map of base64 encoded labels read by urunc releases, while the
+// versioned schema is opt-in.
+const (
+	UruncJSONSchemaLegacy = "legacy"
+	UruncJSONSchemaV1     = "1"
+)
+
+// uruncJSONSchemaVersion is the schemaVersion of the versioned urunc.json
+const uruncJSONSchemaVersion = 1
+
+// Annotations of the resources and network of the unikernel
+const (
+	// memoryAnnotation holds the guest memory, as a size with a unit (e.g. "256MiB")
+	memoryAnnotation = "com.urunc.unikernel.memory"
+	// vcpusAnnotation holds the number of guest vCPUs
+	vcpusAnnotation = "com.urunc.unikernel.vcpus"
+	// networkAnnotation hints how the unikernel configures its network
+	networkAnnotation = "com.urunc.unikernel.network"
+)
+
+// Supported values of the network annotation
+const (
+	NetworkNone   = "none"
+	NetworkStatic = "static"
+	NetworkDHCP   = "dhcp"
+)
+
+// SupportedUruncJSONSchemas returns a list of all supported urunc.json schemas
+func SupportedUruncJSONSchemas() []string {
+	return []string{UruncJSONSchemaLegacy, UruncJSONSchemaV1}
+}
+
+// SupportedNetworkModes returns a list of all supported values of the network annotation
+func SupportedNetworkModes() []string {
+	return []string{NetworkNone, NetworkStatic, NetworkDHCP}
+}
+
+// uruncConfigAnnotations are the annotations stored in typed fields of urunc.json
+var uruncConfigAnnotations = []string{
+	unikernelTypeAnnotation,
+	hypervisorAnnotation,
+	binaryAnnotation,
+	cmdlineAnnotation,
+	unikernelVersionAnnotation,
+	kernelVersionAnnotation,
+	initrdAnnotation,
+	blockAnnotation,
+	blockFsTypeAnnotation,
+	blockReadOnlyAnnotation,
+	blkMntPointAnnotation,
+	useDMBlockAnnotation,
+	memoryAnnotation,
+	vcpusAnnotation,
+	networkAnnotation,
+	kernelCmdlineAnnotation,
+	mountRootfsAnnotation,
+	launchConfigAnnotation,
+}
+
+// UruncConfig is the versioned urunc.json document. Values are stored
+// decoded, with the optional fields omitted if their labels are not set.
+type UruncConfig struct {
+	SchemaVersion    int             `json:"schemaVersion"`
+	UnikernelType    string          `json:"unikernelType"`
+	Hypervisor       string          `json:"hypervisor"`
+	Binary           string          `json:"binary"`
+	Cmdline          string          `json:"cmdline"`
+	UnikernelVersion string          `json:"unikernelVersion,omitempty"`
+	KernelVersion    string          `json:"kernelVersion,omitempty"`
+	Initrd           string          `json:"initrd,omitempty"`
+	Block            *UruncBlock     `json:"block,omitempty"`
+	Resources        *UruncResources `json:"resources,omitempty"`
+	Network          *UruncNetwork   `json:"network,omitempty"`
+	Linux            *UruncLinux     `json:"linux,omitempty"`
+	// LaunchConfig is the path of the generated launch configuration
+	LaunchConfig string `json:"launchConfig,omitempty"`
+	// Annotations holds the labels without a typed field
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// UruncBlock is the block device urunc attaches to the unikernel
+type UruncBlock struct {
+	Path       string `json:"path,omitempty"`
+	FsType     string `json:"fsType,omitempty"`
+	ReadOnly   bool   `json:"readOnly,omitempty"`
+	MountPoint string `json:"mountPoint,omitempty"`
+	UseDMBlock bool   `json:"useDMBlock,omitempty"`
+}
+
+// UruncResources are the resources of the unikernel guest
+type UruncResources struct {
+	MemoryMiB int64 `json:"memoryMiB,omitempty"`
+	VCPUs     int   `json:"vcpus,omitempty"`
+}
+
+// UruncNetwork holds the network hints of the unikernel
+type UruncNetwork struct {
+	Mode string `json:"mode"`
+}
+
+// UruncConfig builds the versioned urunc.json document from the labels of the image
+func (i *BimaImage) UruncConfig() (UruncConfig, error) {
+	spec, err := i.UnikernelSpec()
+	if err != nil {
+		return UruncConfig{}, err
+	}
+	config := UruncConfig{
+		SchemaVersion:    uruncJSONSchemaVersion,
+		UnikernelType:    spec.Type,
+		Hypervisor:       spec.Hypervisor,
+		Binary:           spec.Binary,
+		Cmdline:          spec.Cmdline,
+		UnikernelVersion: spec.Extra[unikernelVersionAnnotation],
+		KernelVersion:    spec.Extra[kernelVersionAnnotation],
+		Initrd:           spec.Initrd,
+		LaunchConfig:     spec.Extra[launchConfigAnnotation],
+		Annotations:      make(map[string]string),
+	}
+
+	block := UruncBlock{Path: spec.Block, FsType: spec.Extra[blockFsTypeAnnotation], MountPoint: spec.BlkMntPoint}
+	block.ReadOnly, _ = strconv.ParseBool(spec.Extra[blockReadOnlyAnnotation])
+	block.UseDMBlock, _ = strconv.ParseBool(spec.Extra[useDMBlockAnnotation])
+	if block != (UruncBlock{}) {
+		config.Block = &block
+	}
+
+	resources, err := spec.resources()
+	if err != nil {
+		return UruncConfig{}, err
+	}
+	if resources != (UruncResources{}) {
+		config.Resources = &resources
+	}
+	if mode, ok := spec.Extra[networkAnnotation]; ok {
+		config.Network = &UruncNetwork{Mode: mode}
+	}
+	config.Linux, err = linuxConfig(spec)
+	if err != nil {
+		return UruncConfig{}, err
+	}
+	for _, label := range i.labels {
+		if contains(uruncConfigAnnotations, label.Key) {
+			continue
+		}
+		value, err := utils.Base64Decode(label.Value)
+		if err != nil {
+			return UruncConfig{}, fmt.Errorf("%s - failed to decode label value", label.source())
+		}
+		config.Annotations[label.Key] = value
+	}
+	return config, nil
+}
+
+// resources parses the memory and vCPUs of the unikernel
+func (s UnikernelSpec) resources() (UruncResources, error) {
+	var resources UruncResources
+	if value, ok := s.Extra[memoryAnnotation]; ok {
+		size, err := utils.ParseSize(value)
+		if err != nil {
+			return UruncResources{}, s.errorf(memoryAnnotation, "invalid memory %q - %v", value, err)
+		}
+		if size <= 0 || size%(1<<20) != 0 {
+			return UruncResources{}, s.errorf(memoryAnnotation, "invalid memory %q, expected a positive multiple of 1MiB", value)
+		}
+		resources.MemoryMiB = size >> 20
+	}
+	if value, ok := s.Extra[vcpusAnnotation]; ok {
+		vcpus, err := strconv.Atoi(value)
+		if err != nil || vcpus <= 0 {
+			return UruncResources{}, s.errorf(vcpusAnnotation, "invalid number of vCPUs %q, expected a positive integer", value)
+		}
+		resources.VCPUs = vcpus
+	}
+	return resources, nil
+}
+
+// uruncJSON returns the content of urunc.json in the given schema
+func (i *BimaImage) uruncJSON(schema string) ([]byte, error) {
+	switch schema {
+	case "", UruncJSONSchemaLegacy:
+		uruncMap := make(map[string]string)
+		currentAnnotationMap := i.getLabelMap()
+		for _, key := range i.getLabelKeys() {
+			uruncMap[key] = currentAnnotationMap[key]
+		}
+		return json.Marshal(uruncMap)
+	case UruncJSONSchemaV1:
+		config, err := i.UruncConfig()
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(config)
+	default:
+		return nil, fmt.Errorf("unsupported urunc.json schema %q", schema)
+	}
+}
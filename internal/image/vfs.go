@@ -0,0 +1,116 @@
+// Copyright 2023 Nubificus LTD.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package image
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// vfsEntry is a file placed in the image rootfs by a layer
+type vfsEntry struct {
+	// source is the local path of the file
+	source string
+	// createdBy is the instruction of the layer that placed the file
+	createdBy string
+	// op is the index of the operation of the layer that placed the file
+	op int
+}
+
+// virtualFS tracks which local file each layer places at each path of the
+// image rootfs, with later layers hiding the files of earlier ones. The base
+// image is empty, so the filesystem starts empty.
+type virtualFS struct {
+	files map[string]vfsEntry
+}
+
+func newVirtualFS() *virtualFS {
+	return &virtualFS{files: make(map[string]vfsEntry)}
+}
+
+// add places the local files of placements, keyed by their paths. Like an
+// overlay filesystem, a file hides any directory at its path, as well as any
+// earlier file at a parent of its path.
+func (v *virtualFS) add(placements map[string]string, createdBy string, op int) {
+	files := make(map[string]string)
+	for p, source := range placements {
+		files[filepath.Clean(p)] = source
+	}
+	for existing := range v.files {
+		if hiddenBy(existing, files) {
+			delete(v.files, existing)
+		}
+	}
+	for p, source := range files {
+		for dir := filepath.Dir(p); dir != "/" && dir != "."; dir = filepath.Dir(dir) {
+			delete(v.files, dir)
+		}
+		v.files[p] = vfsEntry{source: source, createdBy: createdBy, op: op}
+	}
+}
+
+// hiddenBy reports whether any parent of path p is a file of files
+func hiddenBy(p string, files map[string]string) bool {
+	for dir := filepath.Dir(p); dir != "/" && dir != "."; dir = filepath.Dir(dir) {
+		if _, ok := files[dir]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// addCopy places the files of a COPY operation, applied at the given index
+func (v *virtualFS) addCopy(o CopyOperation, op int) error {
+	placements, err := o.placements()
+	if err != nil {
+		return err
+	}
+	v.add(placements, o.line, op)
+	return nil
+}
+
+// isDir reports whether any file is placed under path p
+func (v *virtualFS) isDir(p string) bool {
+	prefix := strings.TrimSuffix(p, "/") + "/"
+	for existing := range v.files {
+		if strings.HasPrefix(existing, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolve returns the local file placed at the exact path p,
+// failing if p does not exist or is not a regular file
+func (v *virtualFS) resolve(p string) (vfsEntry, error) {
+	p = filepath.Join("/", p)
+	entry, ok := v.files[p]
+	if !ok {
+		if v.isDir(p) {
+			return vfsEntry{}, fmt.Errorf("%q is a directory in the image rootfs, not a regular file", p)
+		}
+		return vfsEntry{}, fmt.Errorf("%q was not copied in the image rootfs", p)
+	}
+	info, err := os.Stat(entry.source)
+	if err != nil {
+		return vfsEntry{}, fmt.Errorf("%q copied by %q - %v", p, entry.createdBy, err)
+	}
+	if !info.Mode().IsRegular() {
+		return vfsEntry{}, fmt.Errorf("%q copied by %q is not a regular file", p, entry.createdBy)
+	}
+	return entry, nil
+}
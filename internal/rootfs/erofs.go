@@ -0,0 +1,225 @@
+// Copyright 2023 Nubificus LTD.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rootfs
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// EROFS layout constants. The image uses 4KiB blocks and stores all data
+// uncompressed in contiguous blocks. The inodes start at the block after the
+// superblock, followed by the data of files and directories.
+const (
+	erofsMagic            = 0xe0f5e1e2
+	erofsBlockSize        = 4096
+	erofsBlockSizeBits    = 12
+	erofsSuperblockOffset = 1024
+	erofsMetaBlock        = 1
+	erofsSlotSize         = 32
+	erofsCompactSize      = 32
+	erofsExtendedSize     = 64
+	erofsDirentSize       = 12
+
+	erofsInodeExtended   = 1
+	erofsFileTypeRegular = 1
+	erofsFileTypeDir     = 2
+	erofsModeDir         = 0x4000
+	erofsModeRegular     = 0x8000
+)
+
+// erofsInode is a node of the tree along with its place in the image
+type erofsInode struct {
+	*node
+	ino    uint32
+	parent *erofsInode
+	// children of a directory, in the order of their names
+	children []*erofsInode
+	nlink    uint32
+	// nid locates the inode in the metadata area, in 32 byte slots
+	nid      uint64
+	extended bool
+	// data holds the content of the inode, which for directories are their entries
+	data    []byte
+	blkaddr uint32
+}
+
+// EROFS creates a read-only EROFS filesystem image holding the given files,
+// keyed by their absolute path. All files and directories are owned by root.
+func EROFS(files map[string][]byte) ([]byte, error) {
+	root, err := buildTree(files)
+	if err != nil {
+		return nil, err
+	}
+	inodes := erofsInodes(root)
+
+	// the metadata area holds the inodes, without crossing block boundaries
+	var metaSize uint64
+	for _, inode := range inodes {
+		size := uint64(erofsCompactSize)
+		if inode.extended {
+			size = erofsExtendedSize
+			if metaSize%erofsBlockSize+size > erofsBlockSize {
+				metaSize += erofsBlockSize - metaSize%erofsBlockSize
+			}
+		}
+		inode.nid = metaSize / erofsSlotSize
+		metaSize += size
+	}
+	for _, inode := range inodes {
+		if inode.isDir {
+			inode.data = erofsDirEntries(inode)
+		} else {
+			inode.data = inode.content
+		}
+	}
+	next := uint64(erofsMetaBlock) + erofsBlocks(metaSize)
+	for _, inode := range inodes {
+		if len(inode.data) == 0 {
+			continue
+		}
+		inode.blkaddr = uint32(next)
+		next += erofsBlocks(uint64(len(inode.data)))
+	}
+	if next > math.MaxUint32 {
+		return nil, fmt.Errorf("image exceeds %d blocks", uint32(math.MaxUint32))
+	}
+	log.Debugf("Creating EROFS image with %d blocks and %d inodes", next, len(inodes))
+
+	img := make([]byte, next*erofsBlockSize)
+	meta := img[erofsMetaBlock*erofsBlockSize:]
+	for _, inode := range inodes {
+		erofsWriteInode(meta[inode.nid*erofsSlotSize:], inode)
+		copy(img[uint64(inode.blkaddr)*erofsBlockSize:], inode.data)
+	}
+
+	sb := img[erofsSuperblockOffset:]
+	binary.LittleEndian.PutUint32(sb[0:], erofsMagic)
+	sb[12] = erofsBlockSizeBits
+	binary.LittleEndian.PutUint16(sb[14:], uint16(inodes[0].nid))
+	binary.LittleEndian.PutUint64(sb[16:], uint64(len(inodes)))
+	binary.LittleEndian.PutUint32(sb[36:], uint32(next))
+	binary.LittleEndian.PutUint32(sb[40:], erofsMetaBlock)
+	id := uuid(files)
+	copy(sb[48:64], id[:])
+	copy(sb[64:80], "rootfs")
+	return img, nil
+}
+
+// erofsInodes numbers the inodes of the tree, with the root directory first
+// so that its nid, which the superblock holds in 16 bits, is always 0.
+func erofsInodes(root *node) []*erofsInode {
+	inodes := []*erofsInode{}
+	byNode := make(map[*node]*erofsInode)
+	walk(root, func(n *node, parent *node) {
+		inode := &erofsInode{node: n, parent: byNode[parent], ino: uint32(len(inodes)) + 1, nlink: 1}
+		if n == root {
+			inode.parent = inode
+		} else {
+			inode.parent.children = append(inode.parent.children, inode)
+		}
+		if n.isDir {
+			inode.nlink = 2
+			if n != root {
+				inode.parent.nlink++
+			}
+		}
+		byNode[n] = inode
+		inodes = append(inodes, inode)
+	})
+	for _, inode := range inodes {
+		inode.extended = uint64(len(inode.content)) > math.MaxUint32 || inode.nlink > math.MaxUint16
+	}
+	return inodes
+}
+
+// erofsDirEntries returns the directory blocks of a directory inode. Each
+// block holds its entries, sorted by name, followed by their names.
+func erofsDirEntries(dir *erofsInode) []byte {
+	type entry struct {
+		name     string
+		nid      uint64
+		fileType uint8
+	}
+	entries := []entry{
+		{name: ".", nid: dir.nid, fileType: erofsFileTypeDir},
+		{name: "..", nid: dir.parent.nid, fileType: erofsFileTypeDir},
+	}
+	for _, child := range dir.children {
+		fileType := uint8(erofsFileTypeRegular)
+		if child.isDir {
+			fileType = erofsFileTypeDir
+		}
+		entries = append(entries, entry{name: child.name, nid: child.nid, fileType: fileType})
+	}
+	sort.Slice(entries, func(a, b int) bool {
+		return strings.Compare(entries[a].name, entries[b].name) < 0
+	})
+
+	var data []byte
+	for len(entries) > 0 {
+		// fill the block with as many entries as fit along with their names
+		count, used := 0, 0
+		for count < len(entries) && used+erofsDirentSize+len(entries[count].name) <= erofsBlockSize {
+			used += erofsDirentSize + len(entries[count].name)
+			count++
+		}
+		block := make([]byte, erofsBlockSize)
+		nameOff := count * erofsDirentSize
+		for e, ent := range entries[:count] {
+			binary.LittleEndian.PutUint64(block[e*erofsDirentSize:], ent.nid)
+			binary.LittleEndian.PutUint16(block[e*erofsDirentSize+8:], uint16(nameOff))
+			block[e*erofsDirentSize+10] = ent.fileType
+			nameOff += copy(block[nameOff:], ent.name)
+		}
+		entries = entries[count:]
+		if len(entries) == 0 {
+			// the size of the directory marks the end of the last name
+			block = block[:used]
+		}
+		data = append(data, block...)
+	}
+	return data
+}
+
+// erofsWriteInode serializes an inode with the flat plain data layout
+func erofsWriteInode(b []byte, inode *erofsInode) {
+	mode := uint16(erofsModeRegular | fileMode)
+	if inode.isDir {
+		mode = erofsModeDir | dirMode
+	}
+	if inode.extended {
+		binary.LittleEndian.PutUint16(b[0:], erofsInodeExtended)
+		binary.LittleEndian.PutUint16(b[4:], mode)
+		binary.LittleEndian.PutUint64(b[8:], uint64(len(inode.data)))
+		binary.LittleEndian.PutUint32(b[16:], inode.blkaddr)
+		binary.LittleEndian.PutUint32(b[20:], inode.ino)
+		binary.LittleEndian.PutUint32(b[44:], inode.nlink)
+		return
+	}
+	binary.LittleEndian.PutUint16(b[4:], mode)
+	binary.LittleEndian.PutUint16(b[6:], uint16(inode.nlink))
+	binary.LittleEndian.PutUint32(b[8:], uint32(len(inode.data)))
+	binary.LittleEndian.PutUint32(b[16:], inode.blkaddr)
+	binary.LittleEndian.PutUint32(b[20:], inode.ino)
+}
+
+// erofsBlocks returns the number of blocks needed to hold size bytes
+func erofsBlocks(size uint64) uint64 {
+	return (size + erofsBlockSize - 1) / erofsBlockSize
+}
@@ -0,0 +1,253 @@
+// Copyright 2023 Nubificus LTD.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rootfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// On-disk values of the EROFS format, as defined by erofs_fs.h of the Linux
+// kernel. They are not taken from the writer, so that a wrong value in the
+// writer fails the test.
+const (
+	erofsDiskMagic          = 0xe0f5e1e2
+	erofsDiskSuperblock     = 1024
+	erofsDiskBlockSize      = 4096
+	erofsDiskBlockSizeBits  = 12
+	erofsDiskSlotSize       = 32
+	erofsDiskFormatExtended = 0x1
+	erofsDiskDirentSize     = 12
+	erofsDiskFileTypeDir    = 2
+)
+
+// erofsReader reads back the inodes and directories of an EROFS image
+type erofsReader struct {
+	t         *testing.T
+	img       []byte
+	metaStart uint64
+}
+
+// inode returns the mode, the nlink and the data of the inode at nid
+func (r *erofsReader) inode(nid uint64) (uint16, uint32, []byte) {
+	b := r.img[r.metaStart+nid*erofsDiskSlotSize:]
+	format := binary.LittleEndian.Uint16(b[0:])
+	if layout := format >> 1 & 0x7; layout != 0 {
+		r.t.Fatalf("inode %d: data layout %d, expected flat plain", nid, layout)
+	}
+	mode := binary.LittleEndian.Uint16(b[4:])
+	var size uint64
+	var nlink uint32
+	if format&erofsDiskFormatExtended != 0 {
+		size = binary.LittleEndian.Uint64(b[8:])
+		nlink = binary.LittleEndian.Uint32(b[44:])
+	} else {
+		size = uint64(binary.LittleEndian.Uint32(b[8:]))
+		nlink = uint32(binary.LittleEndian.Uint16(b[6:]))
+	}
+	start := uint64(binary.LittleEndian.Uint32(b[16:])) * erofsDiskBlockSize
+	if size == 0 {
+		return mode, nlink, []byte{}
+	}
+	return mode, nlink, r.img[start : start+size]
+}
+
+// walk reads the inode at nid and adds the files under it to files
+func (r *erofsReader) walk(nid uint64, parent uint64, dir string, files map[string][]byte) {
+	mode, nlink, data := r.inode(nid)
+	if mode&0xf000 == 0x8000 {
+		files[dir] = data
+		return
+	}
+	if mode&0xf000 != 0x4000 {
+		r.t.Fatalf("%s: unexpected mode %#o", dir, mode)
+	}
+	subdirs := uint32(0)
+	for block := 0; block < len(data); block += erofsDiskBlockSize {
+		end := block + erofsDiskBlockSize
+		if end > len(data) {
+			end = len(data)
+		}
+		dirents := data[block:end]
+		count := int(binary.LittleEndian.Uint16(dirents[8:])) / erofsDiskDirentSize
+		prev := ""
+		for e := 0; e < count; e++ {
+			dirent := dirents[e*erofsDiskDirentSize:]
+			childNid := binary.LittleEndian.Uint64(dirent[0:])
+			nameOff := int(binary.LittleEndian.Uint16(dirent[8:]))
+			nameEnd := len(dirents)
+			if e+1 < count {
+				nameEnd = int(binary.LittleEndian.Uint16(dirents[(e+1)*erofsDiskDirentSize+8:]))
+			}
+			name := string(bytes.TrimRight(dirents[nameOff:nameEnd], "\x00"))
+			if name <= prev {
+				r.t.Errorf("%s: entry %q is not sorted after %q", dir, name, prev)
+			}
+			prev = name
+			switch name {
+			case ".":
+				if childNid != nid {
+					r.t.Errorf("%s: \".\" points to nid %d, expected %d", dir, childNid, nid)
+				}
+			case "..":
+				if childNid != parent {
+					r.t.Errorf("%s: \"..\" points to nid %d, expected %d", dir, childNid, parent)
+				}
+			default:
+				if dirent[10] == erofsDiskFileTypeDir {
+					subdirs++
+				}
+				r.walk(childNid, nid, path.Join(dir, name), files)
+			}
+		}
+	}
+	if nlink != 2+subdirs {
+		r.t.Errorf("%s: nlink %d, expected %d", dir, nlink, 2+subdirs)
+	}
+}
+
+func TestEROFS(t *testing.T) {
+	files := testFiles()
+	img, err := EROFS(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(img)%erofsDiskBlockSize != 0 {
+		t.Errorf("image size %d is not a multiple of the block size", len(img))
+	}
+	sb := img[erofsDiskSuperblock:]
+	if magic := binary.LittleEndian.Uint32(sb[0:]); magic != erofsDiskMagic {
+		t.Fatalf("magic %#x, expected %#x", magic, erofsDiskMagic)
+	}
+	if bits := sb[12]; bits != erofsDiskBlockSizeBits {
+		t.Errorf("block size bits %d, expected %d", bits, erofsDiskBlockSizeBits)
+	}
+	if blocks := binary.LittleEndian.Uint32(sb[36:]); uint64(blocks)*erofsDiskBlockSize != uint64(len(img)) {
+		t.Errorf("%d blocks do not match image size %d", blocks, len(img))
+	}
+	// the files, the root directory and its 5 subdirectories
+	if inos, expected := binary.LittleEndian.Uint64(sb[16:]), uint64(len(files)+6); inos != expected {
+		t.Errorf("inode count %d, expected %d", inos, expected)
+	}
+
+	r := &erofsReader{t: t, img: img, metaStart: uint64(binary.LittleEndian.Uint32(sb[40:])) * erofsDiskBlockSize}
+	rootNid := uint64(binary.LittleEndian.Uint16(sb[14:]))
+	if mode, _, data := r.inode(rootNid); mode&0xf000 != 0x4000 {
+		t.Fatalf("root inode mode %#o, expected a directory", mode)
+	} else if len(data) == 0 {
+		t.Fatal("root directory has no entries")
+	}
+	got := make(map[string][]byte)
+	r.walk(rootNid, rootNid, "/", got)
+	if len(got) != len(files) {
+		t.Errorf("read %d files, expected %d", len(got), len(files))
+	}
+	for name, content := range files {
+		if !bytes.Equal(got[name], content) {
+			t.Errorf("%s: read %d bytes that differ from the %d bytes written", name, len(got[name]), len(content))
+		}
+	}
+	checkExtracted(t, img, files, "fsck.erofs", "--extract={dir}", "{image}")
+}
+
+// checkExtracted extracts img with tool, if it is installed, and compares
+// the extracted files to the given ones. In the arguments, {image} and {dir}
+// stand for the path of the image and of the directory to extract to.
+func checkExtracted(t *testing.T, img []byte, files map[string][]byte, tool string, args ...string) {
+	toolPath, err := exec.LookPath(tool)
+	if err != nil {
+		t.Logf("%s not found, skipping", tool)
+		return
+	}
+	dir := t.TempDir()
+	image := filepath.Join(dir, "rootfs.img")
+	root := filepath.Join(dir, "root")
+	if err := os.WriteFile(image, img, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	replacer := strings.NewReplacer("{image}", image, "{dir}", root)
+	for idx, arg := range args {
+		args[idx] = replacer.Replace(arg)
+	}
+	if out, err := exec.Command(toolPath, args...).CombinedOutput(); err != nil {
+		t.Fatalf("%s failed: %v\n%s", tool, err, out)
+	}
+	for name, content := range files {
+		extracted, err := os.ReadFile(filepath.Join(root, name))
+		if err != nil || !bytes.Equal(extracted, content) {
+			t.Errorf("%s: %s differs (%v)", tool, name, err)
+		}
+	}
+}
+
+// unhex decodes hex bytes, ignoring whitespace
+func unhex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(strings.Join(strings.Fields(s), ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// TestEROFSKnownImage pins the bytes of a minimal image, decoded by hand
+// against the EROFS on-disk format
+func TestEROFSKnownImage(t *testing.T) {
+	img, err := EROFS(map[string][]byte{"/a": []byte("hi")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(img) != 4*4096 {
+		t.Fatalf("image size %d, expected 4 blocks", len(img))
+	}
+	for _, pinned := range []struct {
+		what   string
+		offset int
+		bytes  string
+	}{
+		// magic, checksum, feature_compat, blkszbits 12, sb_extslots,
+		// root_nid 0, inos 2, build time, blocks 4, meta_blkaddr 1, xattr_blkaddr
+		{"superblock", 1024, `
+			e2e1f5e0 00000000 00000000 0c 00 0000
+			0200000000000000 0000000000000000 00000000
+			04000000 01000000 00000000`},
+		// volume_name "rootfs" and feature_incompat 0
+		{"volume name", 1024 + 64, "726f6f7466730000 0000000000000000 00000000"},
+		// compact inode of the root directory: i_format 0 (compact, flat
+		// plain), i_mode 040755, i_nlink 2, i_size 40, i_u block 2, i_ino 1
+		{"root inode", 4096, "0000 0000 ed41 0200 28000000 00000000 02000000 01000000 0000 0000 00000000"},
+		// compact inode of /a: i_mode 0100755, i_nlink 1, i_size 2, i_u block 3, i_ino 2
+		{"file inode", 4096 + 32, "0000 0000 ed81 0100 02000000 00000000 03000000 02000000 0000 0000 00000000"},
+		// dirents of ".", ".." and "a", with nid, nameoff and file_type,
+		// followed by the names
+		{"root directory", 2 * 4096, `
+			0000000000000000 2400 02 00
+			0000000000000000 2500 02 00
+			0100000000000000 2700 01 00
+			2e 2e2e 61`},
+		{"file data", 3 * 4096, "6869"},
+	} {
+		expected := unhex(t, pinned.bytes)
+		if got := img[pinned.offset : pinned.offset+len(expected)]; !bytes.Equal(got, expected) {
+			t.Errorf("%s: got\n%x\nexpected\n%x", pinned.what, got, expected)
+		}
+	}
+}
@@ -0,0 +1,469 @@
+// Copyright 2023 Nubificus LTD.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rootfs
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+// ext2 revision 1 layout constants. The image uses 4KiB blocks and 128 byte
+// inodes, without sparse superblocks, so every block group starts with a copy
+// of the superblock and the group descriptors.
+const (
+	ext2BlockSize      = 4096
+	ext2InodeSize      = 128
+	ext2BlocksPerGroup = 8 * ext2BlockSize
+	ext2InodesPerBlock = ext2BlockSize / ext2InodeSize
+	ext2PtrsPerBlock   = ext2BlockSize / 4
+	ext2DirectBlocks   = 12
+	ext2GroupDescSize  = 32
+	ext2RootIno        = 2
+	ext2FirstIno       = 11
+	ext2Magic          = 0xef53
+	// ext2FreeInodes and ext2FreeBlocksMin are kept free for use at run time
+	ext2FreeInodes    = 64
+	ext2FreeBlocksMin = 256
+
+	ext2FeatureIncompatFiletype = 0x2
+	ext2FeatureROCompatLarge    = 0x2
+	ext2FileTypeRegular         = 1
+	ext2FileTypeDir             = 2
+	ext2ModeDir                 = 0x4000
+	ext2ModeRegular             = 0x8000
+)
+
+// ext2Inode is a node of the tree along with the blocks allocated for it
+type ext2Inode struct {
+	*node
+	ino    uint32
+	parent *ext2Inode
+	// data holds the content of the inode, which for directories are their entries
+	data   []byte
+	blocks []uint32
+	// pointers holds the i_block array, including any indirect blocks
+	pointers [15]uint32
+	// sectors is the number of 512 byte sectors used, including indirect blocks
+	sectors uint32
+	subdirs uint16
+}
+
+// ext2Builder lays out an ext2 filesystem image in memory
+type ext2Builder struct {
+	img            []byte
+	totalBlocks    uint32
+	groups         uint32
+	inodesPerGroup uint32
+	gdtBlocks      uint32
+	inodeTable     uint32
+	overhead       uint32
+	// next is the next block the allocator hands out
+	next   uint32
+	inodes []*ext2Inode
+}
+
+// Ext2 creates an ext2 filesystem image holding the given files, keyed by
+// their absolute path. All files and directories are owned by root.
+func Ext2(files map[string][]byte) ([]byte, error) {
+	root, err := buildTree(files)
+	if err != nil {
+		return nil, err
+	}
+	b := &ext2Builder{}
+	b.addInodes(root)
+	b.layout()
+	log.Debugf("Creating ext2 image with %d blocks in %d groups and %d inodes", b.totalBlocks, b.groups, b.groups*b.inodesPerGroup)
+	b.img = make([]byte, uint64(b.totalBlocks)*ext2BlockSize)
+	b.next = b.overhead
+	for _, inode := range b.inodes {
+		err := b.allocate(inode)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, inode := range b.inodes {
+		b.writeInode(inode)
+	}
+	b.writeGroups(uuid(files))
+	return b.img, nil
+}
+
+// addInodes assigns inode numbers to the tree and serializes its directories
+func (b *ext2Builder) addInodes(root *node) {
+	byNode := make(map[*node]*ext2Inode)
+	next := uint32(ext2FirstIno)
+	walk(root, func(n *node, parent *node) {
+		inode := &ext2Inode{node: n, parent: byNode[parent]}
+		if n == root {
+			inode.ino = ext2RootIno
+			inode.parent = inode
+		} else {
+			inode.ino = next
+			next++
+		}
+		if n.isDir && n != root {
+			inode.parent.subdirs++
+		}
+		byNode[n] = inode
+		b.inodes = append(b.inodes, inode)
+	})
+	for _, inode := range b.inodes {
+		if inode.isDir {
+			inode.data = ext2DirEntries(inode, byNode)
+		} else {
+			inode.data = inode.content
+		}
+	}
+}
+
+// ext2DirEntries returns the directory blocks of a directory inode
+func ext2DirEntries(dir *ext2Inode, byNode map[*node]*ext2Inode) []byte {
+	type entry struct {
+		name     string
+		ino      uint32
+		fileType byte
+	}
+	entries := []entry{
+		{".", dir.ino, ext2FileTypeDir},
+		{"..", dir.parent.ino, ext2FileTypeDir},
+	}
+	for _, child := range dir.children {
+		fileType := byte(ext2FileTypeRegular)
+		if child.isDir {
+			fileType = ext2FileTypeDir
+		}
+		entries = append(entries, entry{child.name, byNode[child].ino, fileType})
+	}
+	data := []byte{}
+	block := make([]byte, 0, ext2BlockSize)
+	// last points to the rec_len of the last entry of the block, which spans the rest of it
+	last := -1
+	flush := func() {
+		binary.LittleEndian.PutUint16(block[last:], uint16(ext2BlockSize-(last-4)))
+		data = append(data, block[:ext2BlockSize]...)
+		block = make([]byte, 0, ext2BlockSize)
+	}
+	for _, e := range entries {
+		recLen := (8 + len(e.name) + 3) &^ 3
+		if len(block)+recLen > ext2BlockSize {
+			flush()
+		}
+		start := len(block)
+		block = append(block, make([]byte, recLen)...)
+		binary.LittleEndian.PutUint32(block[start:], e.ino)
+		binary.LittleEndian.PutUint16(block[start+4:], uint16(recLen))
+		block[start+6] = byte(len(e.name))
+		block[start+7] = e.fileType
+		copy(block[start+8:], e.name)
+		last = start + 4
+	}
+	flush()
+	return data
+}
+
+// ext2BlockCount returns the number of data and indirect blocks
+// needed for size bytes
+func ext2BlockCount(size int) uint32 {
+	n := uint32((size + ext2BlockSize - 1) / ext2BlockSize)
+	total := n
+	if n <= ext2DirectBlocks {
+		return total
+	}
+	n -= ext2DirectBlocks
+	// single indirect
+	total++
+	if n <= ext2PtrsPerBlock {
+		return total
+	}
+	n -= ext2PtrsPerBlock
+	// double indirect
+	double := n
+	if double > ext2PtrsPerBlock*ext2PtrsPerBlock {
+		double = ext2PtrsPerBlock * ext2PtrsPerBlock
+	}
+	total += 1 + (double+ext2PtrsPerBlock-1)/ext2PtrsPerBlock
+	n -= double
+	if n == 0 {
+		return total
+	}
+	// triple indirect
+	perDouble := uint32(ext2PtrsPerBlock * ext2PtrsPerBlock)
+	total += 1 + (n+perDouble-1)/perDouble + (n+ext2PtrsPerBlock-1)/ext2PtrsPerBlock
+	return total
+}
+
+// layout computes the geometry of the filesystem
+func (b *ext2Builder) layout() {
+	usedInodes := uint32(ext2FirstIno - 1 + len(b.inodes) - 1)
+	neededInodes := usedInodes + ext2FreeInodes
+	dataBlocks := uint32(0)
+	for _, inode := range b.inodes {
+		dataBlocks += ext2BlockCount(len(inode.data))
+	}
+	freeBlocks := dataBlocks / 10
+	if freeBlocks < ext2FreeBlocksMin {
+		freeBlocks = ext2FreeBlocksMin
+	}
+	b.groups = 1
+	for {
+		b.inodesPerGroup = (neededInodes + b.groups - 1) / b.groups
+		b.inodesPerGroup = (b.inodesPerGroup + ext2InodesPerBlock - 1) / ext2InodesPerBlock * ext2InodesPerBlock
+		if b.inodesPerGroup > ext2BlocksPerGroup {
+			b.groups++
+			continue
+		}
+		b.gdtBlocks = (b.groups*ext2GroupDescSize + ext2BlockSize - 1) / ext2BlockSize
+		b.inodeTable = b.inodesPerGroup / ext2InodesPerBlock
+		b.overhead = 1 + b.gdtBlocks + 2 + b.inodeTable
+		b.totalBlocks = b.groups*b.overhead + dataBlocks + freeBlocks
+		needed := (b.totalBlocks + ext2BlocksPerGroup - 1) / ext2BlocksPerGroup
+		if needed > b.groups {
+			b.groups = needed
+			continue
+		}
+		// the last group must fit its metadata and at least one data block
+		if minBlocks := (b.groups-1)*ext2BlocksPerGroup + b.overhead + 1; b.totalBlocks < minBlocks {
+			b.totalBlocks = minBlocks
+		}
+		return
+	}
+}
+
+// alloc returns the next free data block, skipping the metadata of block groups
+func (b *ext2Builder) alloc() (uint32, error) {
+	if b.next%ext2BlocksPerGroup == 0 {
+		b.next += b.overhead
+	}
+	if b.next >= b.totalBlocks {
+		return 0, fmt.Errorf("ext2 image is out of space")
+	}
+	block := b.next
+	b.next++
+	b.markBlock(block)
+	return block, nil
+}
+
+// markBlock marks block as used in the bitmap of its group
+func (b *ext2Builder) markBlock(block uint32) {
+	group := block / ext2BlocksPerGroup
+	bitmap := b.groupStart(group) + 1 + b.gdtBlocks
+	bit := block % ext2BlocksPerGroup
+	b.img[uint64(bitmap)*ext2BlockSize+uint64(bit/8)] |= 1 << (bit % 8)
+}
+
+func (b *ext2Builder) groupStart(group uint32) uint32 {
+	return group * ext2BlocksPerGroup
+}
+
+// allocate allocates the data and indirect blocks of an inode and writes its data
+func (b *ext2Builder) allocate(inode *ext2Inode) error {
+	n := (len(inode.data) + ext2BlockSize - 1) / ext2BlockSize
+	for i := 0; i < n; i++ {
+		block, err := b.alloc()
+		if err != nil {
+			return err
+		}
+		inode.blocks = append(inode.blocks, block)
+		end := (i + 1) * ext2BlockSize
+		if end > len(inode.data) {
+			end = len(inode.data)
+		}
+		copy(b.img[uint64(block)*ext2BlockSize:], inode.data[i*ext2BlockSize:end])
+	}
+	inode.sectors = uint32(n) * (ext2BlockSize / 512)
+	blocks := inode.blocks
+	for i := 0; i < ext2DirectBlocks && len(blocks) > 0; i++ {
+		inode.pointers[i] = blocks[0]
+		blocks = blocks[1:]
+	}
+	for level := 1; level <= 3 && len(blocks) > 0; level++ {
+		var err error
+		inode.pointers[ext2DirectBlocks+level-1], blocks, err = b.indirect(inode, level, blocks)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// indirect allocates an indirect block of the given level, pointing to as
+// many of blocks as it can hold, and returns the blocks left.
+func (b *ext2Builder) indirect(inode *ext2Inode, level int, blocks []uint32) (uint32, []uint32, error) {
+	block, err := b.alloc()
+	if err != nil {
+		return 0, nil, err
+	}
+	inode.sectors += ext2BlockSize / 512
+	offset := uint64(block) * ext2BlockSize
+	for i := 0; i < ext2PtrsPerBlock && len(blocks) > 0; i++ {
+		ptr := blocks[0]
+		if level == 1 {
+			blocks = blocks[1:]
+		} else {
+			ptr, blocks, err = b.indirect(inode, level-1, blocks)
+			if err != nil {
+				return 0, nil, err
+			}
+		}
+		binary.LittleEndian.PutUint32(b.img[offset+uint64(i)*4:], ptr)
+	}
+	return block, blocks, nil
+}
+
+// inodeOffset returns the offset of an inode in the image
+func (b *ext2Builder) inodeOffset(ino uint32) uint64 {
+	group := (ino - 1) / b.inodesPerGroup
+	index := (ino - 1) % b.inodesPerGroup
+	table := b.groupStart(group) + 1 + b.gdtBlocks + 2
+	return uint64(table)*ext2BlockSize + uint64(index)*ext2InodeSize
+}
+
+func (b *ext2Builder) writeInode(inode *ext2Inode) {
+	raw := b.img[b.inodeOffset(inode.ino):][:ext2InodeSize]
+	mode := uint16(ext2ModeRegular | fileMode)
+	links := uint16(1)
+	if inode.isDir {
+		mode = ext2ModeDir | dirMode
+		links = 2 + inode.subdirs
+	}
+	size := uint64(len(inode.data))
+	binary.LittleEndian.PutUint16(raw[0:], mode)
+	binary.LittleEndian.PutUint32(raw[4:], uint32(size))
+	binary.LittleEndian.PutUint16(raw[26:], links)
+	binary.LittleEndian.PutUint32(raw[28:], inode.sectors)
+	for i, ptr := range inode.pointers {
+		binary.LittleEndian.PutUint32(raw[40+4*i:], ptr)
+	}
+	if !inode.isDir {
+		binary.LittleEndian.PutUint32(raw[108:], uint32(size>>32))
+	}
+}
+
+// writeGroups writes the bitmaps, the group descriptors and the superblock
+// copies of every block group.
+func (b *ext2Builder) writeGroups(uuid [16]byte) {
+	usedInodes := uint32(ext2FirstIno - 1 + len(b.inodes) - 1)
+	dirsPerGroup := make([]uint16, b.groups)
+	largeFiles := false
+	for _, inode := range b.inodes {
+		if inode.isDir {
+			dirsPerGroup[(inode.ino-1)/b.inodesPerGroup]++
+		}
+		if uint64(len(inode.data)) > 1<<31-1 {
+			largeFiles = true
+		}
+	}
+	gdt := make([]byte, b.gdtBlocks*ext2BlockSize)
+	totalFreeBlocks, totalFreeInodes := uint32(0), uint32(0)
+	for g := uint32(0); g < b.groups; g++ {
+		start := b.groupStart(g)
+		blockBitmap := start + 1 + b.gdtBlocks
+		inodeBitmap := blockBitmap + 1
+		for block := start; block < start+b.overhead; block++ {
+			b.markBlock(block)
+		}
+		groupBlocks := b.totalBlocks - start
+		if groupBlocks > ext2BlocksPerGroup {
+			groupBlocks = ext2BlocksPerGroup
+		}
+		// blocks past the end of the filesystem are marked as used
+		bitmap := b.img[uint64(blockBitmap)*ext2BlockSize:][:ext2BlockSize]
+		for bit := groupBlocks; bit < ext2BlocksPerGroup; bit++ {
+			bitmap[bit/8] |= 1 << (bit % 8)
+		}
+		freeBlocks := uint32(0)
+		for bit := uint32(0); bit < groupBlocks; bit++ {
+			if bitmap[bit/8]&(1<<(bit%8)) == 0 {
+				freeBlocks++
+			}
+		}
+		bitmap = b.img[uint64(inodeBitmap)*ext2BlockSize:][:ext2BlockSize]
+		freeInodes := uint32(0)
+		for bit := uint32(0); bit < 8*ext2BlockSize; bit++ {
+			ino := g*b.inodesPerGroup + bit + 1
+			if bit >= b.inodesPerGroup || ino <= usedInodes {
+				bitmap[bit/8] |= 1 << (bit % 8)
+			} else {
+				freeInodes++
+			}
+		}
+		desc := gdt[g*ext2GroupDescSize:]
+		binary.LittleEndian.PutUint32(desc[0:], blockBitmap)
+		binary.LittleEndian.PutUint32(desc[4:], inodeBitmap)
+		binary.LittleEndian.PutUint32(desc[8:], inodeBitmap+1)
+		binary.LittleEndian.PutUint16(desc[12:], uint16(freeBlocks))
+		binary.LittleEndian.PutUint16(desc[14:], uint16(freeInodes))
+		binary.LittleEndian.PutUint16(desc[16:], dirsPerGroup[g])
+		totalFreeBlocks += freeBlocks
+		totalFreeInodes += freeInodes
+	}
+	sb := make([]byte, 1024)
+	binary.LittleEndian.PutUint32(sb[0:], b.groups*b.inodesPerGroup)
+	binary.LittleEndian.PutUint32(sb[4:], b.totalBlocks)
+	binary.LittleEndian.PutUint32(sb[12:], totalFreeBlocks)
+	binary.LittleEndian.PutUint32(sb[16:], totalFreeInodes)
+	// s_log_block_size and s_log_frag_size are relative to 1KiB
+	binary.LittleEndian.PutUint32(sb[24:], 2)
+	binary.LittleEndian.PutUint32(sb[28:], 2)
+	binary.LittleEndian.PutUint32(sb[32:], ext2BlocksPerGroup)
+	binary.LittleEndian.PutUint32(sb[36:], ext2BlocksPerGroup)
+	binary.LittleEndian.PutUint32(sb[40:], b.inodesPerGroup)
+	binary.LittleEndian.PutUint16(sb[54:], 0xffff)
+	binary.LittleEndian.PutUint16(sb[56:], ext2Magic)
+	// clean state, continue on errors
+	binary.LittleEndian.PutUint16(sb[58:], 1)
+	binary.LittleEndian.PutUint16(sb[60:], 1)
+	binary.LittleEndian.PutUint32(sb[76:], 1)
+	binary.LittleEndian.PutUint32(sb[84:], ext2FirstIno)
+	binary.LittleEndian.PutUint16(sb[88:], ext2InodeSize)
+	binary.LittleEndian.PutUint32(sb[96:], ext2FeatureIncompatFiletype)
+	if largeFiles {
+		binary.LittleEndian.PutUint32(sb[100:], ext2FeatureROCompatLarge)
+	}
+	copy(sb[104:], uuid[:])
+	copy(sb[120:], "rootfs")
+	for g := uint32(0); g < b.groups; g++ {
+		offset := uint64(b.groupStart(g)) * ext2BlockSize
+		if g == 0 {
+			// the primary superblock follows the 1KiB boot sector
+			offset += 1024
+		}
+		binary.LittleEndian.PutUint16(sb[90:], uint16(g))
+		copy(b.img[offset:], sb)
+		copy(b.img[uint64(b.groupStart(g)+1)*ext2BlockSize:], gdt)
+	}
+}
+
+// uuid derives the filesystem UUID from the files, so that images are reproducible
+func uuid(files map[string][]byte) [16]byte {
+	paths := []string{}
+	for p := range files {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	h := sha256.New()
+	for _, p := range paths {
+		fmt.Fprintf(h, "%s\x00%d\x00", p, len(files[p]))
+		h.Write(files[p])
+	}
+	var id [16]byte
+	copy(id[:], h.Sum(nil))
+	// version 4 and RFC 4122 variant
+	id[6] = id[6]&0x0f | 0x40
+	id[8] = id[8]&0x3f | 0x80
+	return id
+}
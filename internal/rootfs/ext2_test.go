@@ -0,0 +1,309 @@
+// Copyright 2023 Nubificus LTD.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rootfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"testing"
+)
+
+// ext2Reader reads back an ext2 image, following the on-disk format
+// rather than the constants of the writer
+type ext2Reader struct {
+	t              *testing.T
+	img            []byte
+	blockSize      uint64
+	blocksPerGroup uint32
+	inodesPerGroup uint32
+	inodeSize      uint64
+	// used holds the blocks referenced by inodes, to find blocks used twice
+	used map[uint32]string
+	// blockCounts holds the number of data and indirect blocks of each file
+	blockCounts map[string][2]int
+}
+
+func newExt2Reader(t *testing.T, img []byte) *ext2Reader {
+	sb := img[1024:]
+	if magic := binary.LittleEndian.Uint16(sb[56:]); magic != 0xef53 {
+		t.Fatalf("magic %#x, expected 0xef53", magic)
+	}
+	if rev := binary.LittleEndian.Uint32(sb[76:]); rev != 1 {
+		t.Errorf("revision %d, expected 1", rev)
+	}
+	if incompat := binary.LittleEndian.Uint32(sb[96:]); incompat != 0x2 {
+		t.Errorf("incompatible features %#x, expected filetype (0x2) only", incompat)
+	}
+	r := &ext2Reader{
+		t:              t,
+		img:            img,
+		blockSize:      1024 << binary.LittleEndian.Uint32(sb[24:]),
+		blocksPerGroup: binary.LittleEndian.Uint32(sb[32:]),
+		inodesPerGroup: binary.LittleEndian.Uint32(sb[40:]),
+		inodeSize:      uint64(binary.LittleEndian.Uint16(sb[88:])),
+		used:           make(map[uint32]string),
+		blockCounts:    make(map[string][2]int),
+	}
+	if r.blockSize != 4096 {
+		t.Errorf("block size %d, expected 4096", r.blockSize)
+	}
+	if first := binary.LittleEndian.Uint32(sb[20:]); first != 0 {
+		t.Errorf("first data block %d, expected 0 for 4KiB blocks", first)
+	}
+	if blocks := uint64(binary.LittleEndian.Uint32(sb[4:])); blocks*r.blockSize != uint64(len(img)) {
+		t.Errorf("%d blocks do not match the image size %d", blocks, len(img))
+	}
+	return r
+}
+
+func (r *ext2Reader) block(n uint32) []byte {
+	return r.img[uint64(n)*r.blockSize:][:r.blockSize]
+}
+
+// groupDesc returns the block bitmap, the inode bitmap and the inode table of a group
+func (r *ext2Reader) groupDesc(group uint32) (uint32, uint32, uint32) {
+	desc := r.img[r.blockSize+uint64(group)*32:]
+	return binary.LittleEndian.Uint32(desc[0:]), binary.LittleEndian.Uint32(desc[4:]), binary.LittleEndian.Uint32(desc[8:])
+}
+
+func (r *ext2Reader) inode(ino uint32) []byte {
+	_, _, table := r.groupDesc((ino - 1) / r.inodesPerGroup)
+	index := uint64((ino - 1) % r.inodesPerGroup)
+	return r.img[uint64(table)*r.blockSize+index*r.inodeSize:][:r.inodeSize]
+}
+
+// use records that block is used by name, failing if it is already in use
+// or if it is not marked as used in the block bitmap
+func (r *ext2Reader) use(block uint32, name string) {
+	if other, ok := r.used[block]; ok {
+		r.t.Fatalf("%s: block %d is also used by %s", name, block, other)
+	}
+	r.used[block] = name
+	bitmap, _, _ := r.groupDesc(block / r.blocksPerGroup)
+	bit := block % r.blocksPerGroup
+	if r.block(bitmap)[bit/8]&(1<<(bit%8)) == 0 {
+		r.t.Errorf("%s: block %d is not marked as used", name, block)
+	}
+}
+
+// blocks returns the data blocks of an inode, following its indirect blocks,
+// and the number of blocks used, indirect blocks included
+func (r *ext2Reader) blocks(raw []byte, count int, name string) ([]uint32, int) {
+	res := []uint32{}
+	used := 0
+	var follow func(block uint32, level int)
+	follow = func(block uint32, level int) {
+		if len(res) == count {
+			return
+		}
+		if block == 0 {
+			r.t.Fatalf("%s: missing block %d", name, len(res))
+		}
+		r.use(block, name)
+		used++
+		if level == 0 {
+			res = append(res, block)
+			return
+		}
+		ptrs := r.block(block)
+		for i := uint64(0); i < r.blockSize/4 && len(res) < count; i++ {
+			follow(binary.LittleEndian.Uint32(ptrs[4*i:]), level-1)
+		}
+	}
+	for i := 0; i < 15 && len(res) < count; i++ {
+		level := 0
+		if i >= 12 {
+			level = i - 11
+		}
+		follow(binary.LittleEndian.Uint32(raw[40+4*i:]), level)
+	}
+	return res, used
+}
+
+// walk reads the inode ino and adds the files under it to files
+func (r *ext2Reader) walk(ino uint32, parent uint32, name string, files map[string][]byte) {
+	raw := r.inode(ino)
+	mode := binary.LittleEndian.Uint16(raw[0:])
+	size := uint64(binary.LittleEndian.Uint32(raw[4:]))
+	if mode&0xf000 == 0x8000 {
+		size |= uint64(binary.LittleEndian.Uint32(raw[108:])) << 32
+	}
+	links := binary.LittleEndian.Uint16(raw[26:])
+	count := int((size + r.blockSize - 1) / r.blockSize)
+	blocks, used := r.blocks(raw, count, name)
+	r.blockCounts[name] = [2]int{count, used}
+	if sectors := binary.LittleEndian.Uint32(raw[28:]); uint64(sectors) != uint64(used)*r.blockSize/512 {
+		r.t.Errorf("%s: %d sectors, expected %d", name, sectors, uint64(used)*r.blockSize/512)
+	}
+	data := make([]byte, 0, size)
+	for _, block := range blocks {
+		data = append(data, r.block(block)...)
+	}
+	data = data[:size]
+
+	switch mode & 0xf000 {
+	case 0x8000:
+		if links != 1 {
+			r.t.Errorf("%s: %d links, expected 1", name, links)
+		}
+		files[name] = data
+		return
+	case 0x4000:
+	default:
+		r.t.Fatalf("%s: unexpected mode %#o", name, mode)
+	}
+	subdirs := uint16(0)
+	for pos := uint64(0); pos < size; pos += r.blockSize {
+		dirBlock := data[pos : pos+r.blockSize]
+		for off := 0; off < len(dirBlock); {
+			childIno := binary.LittleEndian.Uint32(dirBlock[off:])
+			recLen := int(binary.LittleEndian.Uint16(dirBlock[off+4:]))
+			nameLen := int(dirBlock[off+6])
+			fileType := dirBlock[off+7]
+			if recLen < 8+nameLen || recLen%4 != 0 || off+recLen > len(dirBlock) {
+				r.t.Fatalf("%s: invalid directory entry at offset %d", name, pos+uint64(off))
+			}
+			childName := string(dirBlock[off+8 : off+8+nameLen])
+			off += recLen
+			switch childName {
+			case ".":
+				if childIno != ino {
+					r.t.Errorf("%s: \".\" points to inode %d, expected %d", name, childIno, ino)
+				}
+			case "..":
+				if childIno != parent {
+					r.t.Errorf("%s: \"..\" points to inode %d, expected %d", name, childIno, parent)
+				}
+			default:
+				childMode := binary.LittleEndian.Uint16(r.inode(childIno)[0:])
+				if (fileType == 2) != (childMode&0xf000 == 0x4000) {
+					r.t.Errorf("%s: file type %d does not match mode %#o", childName, fileType, childMode)
+				}
+				if fileType == 2 {
+					subdirs++
+				}
+				r.walk(childIno, ino, path.Join(name, childName), files)
+			}
+		}
+	}
+	if links != 2+subdirs {
+		r.t.Errorf("%s: %d links, expected %d", name, links, 2+subdirs)
+	}
+}
+
+// checkExt2 reads back an ext2 image, comparing its files to the given ones
+func checkExt2(t *testing.T, img []byte, files map[string][]byte) *ext2Reader {
+	r := newExt2Reader(t, img)
+	got := make(map[string][]byte)
+	r.walk(2, 2, "/", got)
+	if len(got) != len(files) {
+		t.Errorf("read %d files, expected %d", len(got), len(files))
+	}
+	for name, content := range files {
+		if !bytes.Equal(got[name], content) {
+			t.Errorf("%s: read %d bytes that differ from the %d bytes written", name, len(got[name]), len(content))
+		}
+	}
+
+	// every group holds a copy of the superblock, as sparse superblocks are not used
+	sb := img[1024 : 1024+1024]
+	groups := uint32((uint64(len(img))/r.blockSize + uint64(r.blocksPerGroup) - 1) / uint64(r.blocksPerGroup))
+	var freeBlocks uint32
+	for g := uint32(0); g < groups; g++ {
+		if g > 0 {
+			backup := r.block(g * r.blocksPerGroup)[:1024]
+			if !bytes.Equal(backup[:90], sb[:90]) || binary.LittleEndian.Uint16(backup[90:]) != uint16(g) {
+				t.Errorf("group %d: invalid superblock backup", g)
+			}
+		}
+		desc := img[r.blockSize+uint64(g)*32:]
+		freeBlocks += uint32(binary.LittleEndian.Uint16(desc[12:]))
+	}
+	if total := binary.LittleEndian.Uint32(sb[12:]); total != freeBlocks {
+		t.Errorf("superblock counts %d free blocks, the groups %d", total, freeBlocks)
+	}
+
+	// e2fsck checks the image independently, if it is installed
+	if e2fsck, err := exec.LookPath("e2fsck"); err == nil {
+		image := filepath.Join(t.TempDir(), "rootfs.ext2")
+		if err := os.WriteFile(image, img, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if out, err := exec.Command(e2fsck, "-fn", image).CombinedOutput(); err != nil {
+			t.Errorf("e2fsck failed: %v\n%s", err, out)
+		}
+	}
+	return r
+}
+
+func TestExt2(t *testing.T) {
+	files := testFiles()
+	img, err := Ext2(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the image fits a single group
+	if len(img) > 32768*4096 {
+		t.Errorf("image of %d bytes spans several groups", len(img))
+	}
+	r := checkExt2(t, img, files)
+	// the 300 entries of /many do not fit a single directory block
+	if counts := r.blockCounts["/many"]; counts[0] < 2 {
+		t.Errorf("/many has %d directory blocks, expected more than one", counts[0])
+	}
+	// the 300KiB file needs a single indirect block
+	if counts := r.blockCounts["/lib/modules/a.ko"]; counts[1] != counts[0]+1 {
+		t.Errorf("/lib/modules/a.ko uses %d blocks for %d data blocks, expected one indirect block", counts[1], counts[0])
+	}
+
+	img, err = Ext2(map[string][]byte{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkExt2(t, img, map[string][]byte{})
+}
+
+func TestExt2MultipleGroups(t *testing.T) {
+	if testing.Short() {
+		t.Skip("creating a 130MiB image is skipped in short mode")
+	}
+	// a file larger than a group, which needs double indirect blocks,
+	// with the number of each block at its start
+	large := make([]byte, 130<<20)
+	for block := 0; block < len(large)/4096; block++ {
+		binary.LittleEndian.PutUint32(large[block*4096:], uint32(block))
+	}
+	files := map[string][]byte{
+		"/disk.img":  large,
+		"/after.txt": []byte("after"),
+	}
+	img, err := Ext2(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(img) <= 32768*4096 {
+		t.Fatalf("image of %d bytes fits a single group", len(img))
+	}
+	r := checkExt2(t, img, files)
+	// a single indirect block, a double indirect block and its indirect blocks
+	counts := r.blockCounts["/disk.img"]
+	if expected := counts[0] + 2 + (counts[0]-12-1024+1023)/1024; counts[1] != expected {
+		t.Errorf("/disk.img uses %d blocks for %d data blocks, expected %d", counts[1], counts[0], expected)
+	}
+}
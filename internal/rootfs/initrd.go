@@ -0,0 +1,133 @@
+// Copyright 2023 Nubificus LTD.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rootfs
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"path"
+
+	"github.com/pierrec/lz4/v4"
+)
+
+// Supported compressions of initrd images
+const (
+	CompressionNone = "none"
+	CompressionGzip = "gzip"
+	CompressionLZ4  = "lz4"
+)
+
+const (
+	cpioMagic   = "070701"
+	cpioTrailer = "TRAILER!!!"
+	cpioModeDir = 0040000
+	cpioModeReg = 0100000
+)
+
+// Initrd creates an initramfs image holding the given files, keyed by their
+// absolute path. The image is a newc cpio archive, optionally compressed
+// with gzip or with the legacy lz4 format the Linux kernel expects.
+func Initrd(files map[string][]byte, compression string) ([]byte, error) {
+	root, err := buildTree(files)
+	if err != nil {
+		return nil, err
+	}
+	b := &bytes.Buffer{}
+	var w io.Writer = b
+	var closer io.Closer
+	switch compression {
+	case CompressionNone, "":
+	case CompressionGzip:
+		gz := gzip.NewWriter(b)
+		w, closer = gz, gz
+	case CompressionLZ4:
+		lw := lz4.NewWriter(b)
+		err := lw.Apply(lz4.LegacyOption(true))
+		if err != nil {
+			return nil, err
+		}
+		w, closer = lw, lw
+	default:
+		return nil, fmt.Errorf("unsupported initrd compression %q", compression)
+	}
+	cw := &cpioWriter{w: w, ino: 1}
+	paths := map[*node]string{root: "."}
+	walk(root, func(n *node, parent *node) {
+		if cw.err != nil || n == root {
+			return
+		}
+		p := path.Join(paths[parent], n.name)
+		paths[n] = p
+		if n.isDir {
+			cw.writeEntry(p, cpioModeDir|dirMode, 2, nil)
+		} else {
+			cw.writeEntry(p, cpioModeReg|fileMode, 1, n.content)
+		}
+	})
+	cw.writeEntry(cpioTrailer, 0, 1, nil)
+	if cw.err != nil {
+		return nil, cw.err
+	}
+	if closer != nil {
+		if err := closer.Close(); err != nil {
+			return nil, err
+		}
+	}
+	return b.Bytes(), nil
+}
+
+// cpioWriter writes newc cpio entries, keeping the first error
+type cpioWriter struct {
+	w   io.Writer
+	ino uint32
+	// written is the number of bytes written, used for padding
+	written int64
+	err     error
+}
+
+func (c *cpioWriter) write(data []byte) {
+	if c.err != nil {
+		return
+	}
+	n, err := c.w.Write(data)
+	c.written += int64(n)
+	c.err = err
+}
+
+// pad aligns the archive to 4 bytes
+func (c *cpioWriter) pad() {
+	if rem := c.written % 4; rem != 0 {
+		c.write(make([]byte, 4-rem))
+	}
+}
+
+// writeEntry writes a cpio entry. Names are relative to the archive root,
+// as the kernel expects, and all entries are owned by root.
+func (c *cpioWriter) writeEntry(name string, mode uint32, nlink uint32, content []byte) {
+	ino := c.ino
+	if name == cpioTrailer {
+		ino = 0
+	}
+	c.ino++
+	header := fmt.Sprintf("%s%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x",
+		cpioMagic, ino, mode, 0, 0, nlink, 0, len(content), 0, 0, 0, 0, len(name)+1, 0)
+	c.write([]byte(header))
+	c.write(append([]byte(name), 0))
+	c.pad()
+	c.write(content)
+	c.pad()
+}
@@ -0,0 +1,197 @@
+// Copyright 2023 Nubificus LTD.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rootfs
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/pierrec/lz4/v4"
+)
+
+// readCpio reads back a newc cpio archive, checking its headers and padding,
+// and returns its regular files, keyed by their absolute path
+func readCpio(t *testing.T, archive []byte) map[string][]byte {
+	files := make(map[string][]byte)
+	dirs := map[string]bool{"/": true}
+	inodes := make(map[uint64]string)
+	pos := 0
+	// skip pads the archive offset to 4 bytes, checking the padding is zeros
+	skip := func(what string) {
+		for ; pos%4 != 0; pos++ {
+			if archive[pos] != 0 {
+				t.Fatalf("%s: non-zero padding at offset %d", what, pos)
+			}
+		}
+	}
+	for {
+		if pos+110 > len(archive) {
+			t.Fatalf("archive ends at offset %d without a trailer", pos)
+		}
+		header := archive[pos : pos+110]
+		if magic := string(header[:6]); magic != "070701" {
+			t.Fatalf("magic %q at offset %d, expected \"070701\"", magic, pos)
+		}
+		fields := make([]uint64, 13)
+		for i := range fields {
+			value, err := strconv.ParseUint(string(header[6+8*i:14+8*i]), 16, 32)
+			if err != nil {
+				t.Fatalf("invalid header field %d at offset %d: %v", i, pos, err)
+			}
+			fields[i] = value
+		}
+		ino, mode, uid, gid, nlink, size, nameSize, check := fields[0], fields[1], fields[2], fields[3], fields[4], fields[6], fields[11], fields[12]
+		pos += 110
+		name := string(archive[pos : pos+int(nameSize)])
+		if name[len(name)-1] != 0 {
+			t.Fatalf("name %q is not NUL terminated", name)
+		}
+		name = name[:len(name)-1]
+		pos += int(nameSize)
+		skip(name)
+		data := archive[pos : pos+int(size)]
+		pos += int(size)
+		skip(name)
+		if name == "TRAILER!!!" {
+			if size != 0 {
+				t.Errorf("trailer holds %d bytes", size)
+			}
+			break
+		}
+		if uid != 0 || gid != 0 || check != 0 {
+			t.Errorf("%s: uid %d, gid %d and check %d, expected zeros", name, uid, gid, check)
+		}
+		if other, ok := inodes[ino]; ino == 0 || ok {
+			t.Errorf("%s: inode %d is zero or also used by %s", name, ino, other)
+		}
+		inodes[ino] = name
+		if path.IsAbs(name) {
+			t.Errorf("%s: name is not relative to the archive root", name)
+		}
+		p := path.Join("/", name)
+		if !dirs[path.Dir(p)] {
+			t.Errorf("%s: parent directory is not archived before it", name)
+		}
+		switch mode & 0170000 {
+		case 0040000:
+			if nlink != 2 || size != 0 {
+				t.Errorf("%s: directory with %d links and %d bytes", name, nlink, size)
+			}
+			dirs[p] = true
+		case 0100000:
+			if nlink != 1 {
+				t.Errorf("%s: %d links, expected 1", name, nlink)
+			}
+			files[p] = data
+		default:
+			t.Errorf("%s: unexpected mode %#o", name, mode)
+		}
+	}
+	if rest := archive[pos:]; len(bytes.Trim(rest, "\x00")) != 0 {
+		t.Errorf("%d bytes follow the trailer", len(rest))
+	}
+	return files
+}
+
+func TestInitrd(t *testing.T) {
+	files := testFiles()
+	for _, compression := range []string{CompressionNone, CompressionGzip, CompressionLZ4} {
+		img, err := Initrd(files, compression)
+		if err != nil {
+			t.Fatal(err)
+		}
+		archive := img
+		switch compression {
+		case CompressionGzip:
+			zr, err := gzip.NewReader(bytes.NewReader(img))
+			if err != nil {
+				t.Fatal(err)
+			}
+			archive, err = io.ReadAll(zr)
+			if err != nil {
+				t.Fatal(err)
+			}
+		case CompressionLZ4:
+			// the kernel only reads the legacy lz4 format
+			if magic := binary.LittleEndian.Uint32(img); magic != 0x184c2102 {
+				t.Fatalf("lz4 magic %#x, expected the legacy magic 0x184c2102", magic)
+			}
+			archive, err = io.ReadAll(lz4.NewReader(bytes.NewReader(img)))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		got := readCpio(t, archive)
+		if len(got) != len(files) {
+			t.Errorf("%s: read %d files, expected %d", compression, len(got), len(files))
+		}
+		for name, content := range files {
+			if !bytes.Equal(got[name], content) {
+				t.Errorf("%s: %s: read %d bytes that differ from the %d bytes written", compression, name, len(got[name]), len(content))
+			}
+		}
+		checkInitrdTools(t, img, compression, files)
+	}
+	if _, err := Initrd(files, "xz"); err == nil {
+		t.Error("unsupported compression did not fail")
+	}
+}
+
+// checkInitrdTools extracts the image with the tools that are installed
+func checkInitrdTools(t *testing.T, img []byte, compression string, files map[string][]byte) {
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "initrd")
+	if compression == CompressionLZ4 {
+		lz4Tool, err := exec.LookPath("lz4")
+		if err != nil {
+			return
+		}
+		if err := os.WriteFile(archive+".lz4", img, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if out, err := exec.Command(lz4Tool, "-d", "-f", archive+".lz4", archive).CombinedOutput(); err != nil {
+			t.Errorf("lz4 failed to decompress the image: %v\n%s", err, out)
+			return
+		}
+	} else if err := os.WriteFile(archive, img, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	bsdtar, err := exec.LookPath("bsdtar")
+	if err != nil {
+		return
+	}
+	root := filepath.Join(dir, "root")
+	if err := os.Mkdir(root, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := exec.Command(bsdtar, "-xf", archive, "-C", root).CombinedOutput(); err != nil {
+		t.Errorf("%s: bsdtar failed to extract the image: %v\n%s", compression, err, out)
+		return
+	}
+	for name, content := range files {
+		extracted, err := os.ReadFile(filepath.Join(root, name))
+		if err != nil || !bytes.Equal(extracted, content) {
+			t.Errorf("%s: bsdtar: %s differs (%v)", compression, name, err)
+		}
+	}
+}
@@ -0,0 +1,341 @@
+// Copyright 2023 Nubificus LTD.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rootfs
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"math"
+)
+
+// squashfs 4.0 layout constants. Data and metadata blocks are compressed
+// with zlib, and file tails are stored in full blocks instead of fragments.
+const (
+	sqfsMagic          = 0x73717368
+	sqfsSuperblockSize = 96
+	sqfsBlockSize      = 128 * 1024
+	sqfsBlockLog       = 17
+	sqfsMetadataSize   = 8192
+	sqfsCompressorZlib = 1
+	sqfsPadding        = 4096
+	sqfsNoTable        = math.MaxUint64
+	sqfsNoFragment     = math.MaxUint32
+	sqfsNoXattr        = math.MaxUint32
+
+	sqfsFlagNoFragments = 0x0010
+	sqfsFlagNoXattrs    = 0x0200
+
+	// sqfsUncompressedMetadata and sqfsUncompressedData mark blocks
+	// stored as is, because compression did not make them smaller
+	sqfsUncompressedMetadata = 0x8000
+	sqfsUncompressedData     = 1 << 24
+
+	sqfsTypeDir     = 1
+	sqfsTypeFile    = 2
+	sqfsTypeLDir    = 8
+	sqfsTypeLFile   = 9
+	sqfsDirMaxCount = 256
+)
+
+// sqfsInode is a node of the tree along with its place in the inode table
+type sqfsInode struct {
+	*node
+	ino    uint32
+	parent *sqfsInode
+	// children of a directory, in the order of their names
+	children []*sqfsInode
+	subdirs  uint32
+	// ref is the reference of the inode in the inode table
+	ref uint64
+	// start and sizes locate the data blocks of a file
+	start uint64
+	sizes []uint32
+}
+
+// sqfsMetadata writes a squashfs metadata table, which is split in 8KiB
+// blocks that are compressed independently.
+type sqfsMetadata struct {
+	out     []byte
+	pending []byte
+}
+
+// ref returns the location of the next byte written, as the offset of its
+// compressed block in the table and its offset in the uncompressed block.
+func (m *sqfsMetadata) ref() (uint32, uint16) {
+	return uint32(len(m.out)), uint16(len(m.pending))
+}
+
+func (m *sqfsMetadata) write(data []byte) {
+	m.pending = append(m.pending, data...)
+	for len(m.pending) >= sqfsMetadataSize {
+		m.flush(m.pending[:sqfsMetadataSize])
+		m.pending = m.pending[sqfsMetadataSize:]
+	}
+}
+
+// bytes returns the table, flushing any pending partial block
+func (m *sqfsMetadata) bytes() []byte {
+	if len(m.pending) > 0 {
+		m.flush(m.pending)
+		m.pending = nil
+	}
+	return m.out
+}
+
+func (m *sqfsMetadata) flush(block []byte) {
+	header := make([]byte, 2)
+	compressed := zlibCompress(block)
+	if len(compressed) < len(block) {
+		binary.LittleEndian.PutUint16(header, uint16(len(compressed)))
+		m.out = append(append(m.out, header...), compressed...)
+		return
+	}
+	binary.LittleEndian.PutUint16(header, uint16(len(block))|sqfsUncompressedMetadata)
+	m.out = append(append(m.out, header...), block...)
+}
+
+// Squashfs creates a read-only squashfs filesystem image holding the given
+// files, keyed by their absolute path. All files and directories are owned
+// by root and blocks of zeros are stored as holes.
+func Squashfs(files map[string][]byte) ([]byte, error) {
+	root, err := buildTree(files)
+	if err != nil {
+		return nil, err
+	}
+	img := make([]byte, sqfsSuperblockSize)
+	inodes := sqfsInodes(root)
+	for _, inode := range inodes {
+		if inode.isDir {
+			continue
+		}
+		inode.start = uint64(len(img))
+		for offset := 0; offset < len(inode.content); offset += sqfsBlockSize {
+			end := offset + sqfsBlockSize
+			if end > len(inode.content) {
+				end = len(inode.content)
+			}
+			block := inode.content[offset:end]
+			if isZero(block) {
+				inode.sizes = append(inode.sizes, 0)
+				continue
+			}
+			compressed := zlibCompress(block)
+			if len(compressed) < len(block) {
+				inode.sizes = append(inode.sizes, uint32(len(compressed)))
+				img = append(img, compressed...)
+			} else {
+				inode.sizes = append(inode.sizes, uint32(len(block))|sqfsUncompressedData)
+				img = append(img, block...)
+			}
+		}
+	}
+	inodeTable := &sqfsMetadata{}
+	dirTable := &sqfsMetadata{}
+	for _, inode := range inodes {
+		block, offset := inodeTable.ref()
+		inode.ref = uint64(block)<<16 | uint64(offset)
+		if inode.isDir {
+			inodeTable.write(sqfsDirInode(inode, dirTable))
+		} else {
+			inodeTable.write(sqfsFileInode(inode))
+		}
+	}
+	rootInode := inodes[len(inodes)-1]
+	log.Debugf("Creating squashfs image with %d inodes", len(inodes))
+
+	inodeTableStart := uint64(len(img))
+	img = append(img, inodeTable.bytes()...)
+	dirTableStart := uint64(len(img))
+	img = append(img, dirTable.bytes()...)
+	// there are no fragments, but like mksquashfs an empty fragment
+	// table is placed before the id table for readers that expect one
+	fragmentTableStart := uint64(len(img))
+	// all files and directories use the single id 0, for root
+	ids := &sqfsMetadata{}
+	ids.write(make([]byte, 4))
+	idBlock := uint64(len(img))
+	img = append(img, ids.bytes()...)
+	idTableStart := uint64(len(img))
+	img = binary.LittleEndian.AppendUint64(img, idBlock)
+	bytesUsed := uint64(len(img))
+	if pad := len(img) % sqfsPadding; pad != 0 {
+		img = append(img, make([]byte, sqfsPadding-pad)...)
+	}
+
+	sb := img[:sqfsSuperblockSize]
+	binary.LittleEndian.PutUint32(sb[0:], sqfsMagic)
+	binary.LittleEndian.PutUint32(sb[4:], uint32(len(inodes)))
+	binary.LittleEndian.PutUint32(sb[12:], sqfsBlockSize)
+	binary.LittleEndian.PutUint16(sb[20:], sqfsCompressorZlib)
+	binary.LittleEndian.PutUint16(sb[22:], sqfsBlockLog)
+	binary.LittleEndian.PutUint16(sb[24:], sqfsFlagNoFragments|sqfsFlagNoXattrs)
+	binary.LittleEndian.PutUint16(sb[26:], 1)
+	binary.LittleEndian.PutUint16(sb[28:], 4)
+	binary.LittleEndian.PutUint16(sb[30:], 0)
+	binary.LittleEndian.PutUint64(sb[32:], rootInode.ref)
+	binary.LittleEndian.PutUint64(sb[40:], bytesUsed)
+	binary.LittleEndian.PutUint64(sb[48:], idTableStart)
+	binary.LittleEndian.PutUint64(sb[56:], sqfsNoTable)
+	binary.LittleEndian.PutUint64(sb[64:], inodeTableStart)
+	binary.LittleEndian.PutUint64(sb[72:], dirTableStart)
+	binary.LittleEndian.PutUint64(sb[80:], fragmentTableStart)
+	binary.LittleEndian.PutUint64(sb[88:], sqfsNoTable)
+	return img, nil
+}
+
+// sqfsInodes numbers the inodes of the tree in the order they are written to
+// the inode table, children before their parent directory, since directory
+// entries refer to the inodes of their children.
+func sqfsInodes(root *node) []*sqfsInode {
+	inodes := []*sqfsInode{}
+	var visit func(n *node, parent *sqfsInode) *sqfsInode
+	visit = func(n *node, parent *sqfsInode) *sqfsInode {
+		inode := &sqfsInode{node: n, parent: parent}
+		for _, child := range n.children {
+			inode.children = append(inode.children, visit(child, inode))
+			if child.isDir {
+				inode.subdirs++
+			}
+		}
+		inodes = append(inodes, inode)
+		inode.ino = uint32(len(inodes))
+		return inode
+	}
+	visit(root, nil)
+	return inodes
+}
+
+// sqfsInodeHeader returns the header shared by all inode types
+func sqfsInodeHeader(inodeType uint16, mode uint16, ino uint32) []byte {
+	header := make([]byte, 16)
+	binary.LittleEndian.PutUint16(header[0:], inodeType)
+	binary.LittleEndian.PutUint16(header[2:], mode)
+	binary.LittleEndian.PutUint32(header[12:], ino)
+	return header
+}
+
+// sqfsFileInode returns the inode of a regular file
+func sqfsFileInode(inode *sqfsInode) []byte {
+	var data []byte
+	size := uint64(len(inode.content))
+	if size > math.MaxUint32 || inode.start > math.MaxUint32 {
+		data = sqfsInodeHeader(sqfsTypeLFile, fileMode, inode.ino)
+		data = binary.LittleEndian.AppendUint64(data, inode.start)
+		data = binary.LittleEndian.AppendUint64(data, size)
+		data = binary.LittleEndian.AppendUint64(data, 0)
+		data = binary.LittleEndian.AppendUint32(data, 1)
+		data = binary.LittleEndian.AppendUint32(data, sqfsNoFragment)
+		data = binary.LittleEndian.AppendUint32(data, 0)
+		data = binary.LittleEndian.AppendUint32(data, sqfsNoXattr)
+	} else {
+		data = sqfsInodeHeader(sqfsTypeFile, fileMode, inode.ino)
+		data = binary.LittleEndian.AppendUint32(data, uint32(inode.start))
+		data = binary.LittleEndian.AppendUint32(data, sqfsNoFragment)
+		data = binary.LittleEndian.AppendUint32(data, 0)
+		data = binary.LittleEndian.AppendUint32(data, uint32(size))
+	}
+	for _, size := range inode.sizes {
+		data = binary.LittleEndian.AppendUint32(data, size)
+	}
+	return data
+}
+
+// sqfsDirInode writes the entries of a directory to the directory table
+// and returns its inode. The inodes of its children must be already written.
+func sqfsDirInode(inode *sqfsInode, dirTable *sqfsMetadata) []byte {
+	block, offset := dirTable.ref()
+	listing := sqfsDirEntries(inode)
+	dirTable.write(listing)
+	parentIno := inode.ino + 1
+	if inode.parent != nil {
+		parentIno = inode.parent.ino
+	}
+	// the size includes the implicit "." and ".." entries
+	size := uint32(len(listing)) + 3
+	links := 2 + inode.subdirs
+	var data []byte
+	if size > math.MaxUint16 {
+		data = sqfsInodeHeader(sqfsTypeLDir, dirMode, inode.ino)
+		data = binary.LittleEndian.AppendUint32(data, links)
+		data = binary.LittleEndian.AppendUint32(data, size)
+		data = binary.LittleEndian.AppendUint32(data, block)
+		data = binary.LittleEndian.AppendUint32(data, parentIno)
+		data = binary.LittleEndian.AppendUint16(data, 0)
+		data = binary.LittleEndian.AppendUint16(data, offset)
+		data = binary.LittleEndian.AppendUint32(data, sqfsNoXattr)
+	} else {
+		data = sqfsInodeHeader(sqfsTypeDir, dirMode, inode.ino)
+		data = binary.LittleEndian.AppendUint32(data, block)
+		data = binary.LittleEndian.AppendUint32(data, links)
+		data = binary.LittleEndian.AppendUint16(data, uint16(size))
+		data = binary.LittleEndian.AppendUint16(data, offset)
+		data = binary.LittleEndian.AppendUint32(data, parentIno)
+	}
+	return data
+}
+
+// sqfsDirEntries returns the directory table listing of a directory. Entries
+// are grouped under headers, each covering up to 256 entries whose inodes
+// are in the same metadata block and have nearby inode numbers.
+func sqfsDirEntries(dir *sqfsInode) []byte {
+	var listing []byte
+	// header is the offset of the current header in the listing
+	header := -1
+	var count, base uint32
+	var block uint64
+	for _, child := range dir.children {
+		diff := int64(child.ino) - int64(base)
+		if header < 0 || count == sqfsDirMaxCount || child.ref>>16 != block || diff < math.MinInt16 || diff > math.MaxInt16 {
+			header = len(listing)
+			count, base, block, diff = 0, child.ino, child.ref>>16, 0
+			listing = append(listing, make([]byte, 12)...)
+			binary.LittleEndian.PutUint32(listing[header+4:], uint32(block))
+			binary.LittleEndian.PutUint32(listing[header+8:], base)
+		}
+		count++
+		binary.LittleEndian.PutUint32(listing[header:], count-1)
+		entryType := uint16(sqfsTypeFile)
+		if child.isDir {
+			entryType = sqfsTypeDir
+		}
+		listing = binary.LittleEndian.AppendUint16(listing, uint16(child.ref&0xffff))
+		listing = binary.LittleEndian.AppendUint16(listing, uint16(int16(diff)))
+		listing = binary.LittleEndian.AppendUint16(listing, entryType)
+		listing = binary.LittleEndian.AppendUint16(listing, uint16(len(child.name)-1))
+		listing = append(listing, child.name...)
+	}
+	return listing
+}
+
+// zlibCompress returns the zlib stream of data
+func zlibCompress(data []byte) []byte {
+	var buf bytes.Buffer
+	zw := zlib.NewWriter(&buf)
+	// writes to a bytes.Buffer never fail
+	_, _ = zw.Write(data)
+	_ = zw.Close()
+	return buf.Bytes()
+}
+
+// isZero reports whether data holds only zero bytes
+func isZero(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
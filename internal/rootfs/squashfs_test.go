@@ -0,0 +1,299 @@
+// Copyright 2023 Nubificus LTD.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rootfs
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/rand"
+	"path"
+	"testing"
+)
+
+// testFiles returns a small tree with a file spanning several blocks and
+// holding a hole, an empty file and a directory whose entries and inodes
+// do not fit in a single metadata or directory block.
+func testFiles() map[string][]byte {
+	large := make([]byte, 300*1024)
+	rnd := rand.New(rand.NewSource(1))
+	rnd.Read(large[:sqfsBlockSize])
+	copy(large[2*sqfsBlockSize:], "tail")
+	files := map[string][]byte{
+		"/urunc.json":        []byte(`{"version":"1"}`),
+		"/lib/modules/a.ko":  large,
+		"/etc/empty":         {},
+		"/unikernel/app.elf": []byte("\x7fELF"),
+	}
+	for n := 0; n < 300; n++ {
+		files[fmt.Sprintf("/many/file-%03d", n)] = []byte(fmt.Sprintf("file %d", n))
+	}
+	return files
+}
+
+// On-disk values of the squashfs 4.0 format, as defined by squashfs_fs.h of
+// the Linux kernel. They are not taken from the writer, so that a wrong value
+// in the writer fails the test.
+const (
+	sqfsDiskMagic                = 0x73717368
+	sqfsDiskSuperblockSize       = 96
+	sqfsDiskPadding              = 4096
+	sqfsDiskCompressorZlib       = 1
+	sqfsDiskUncompressedMetadata = 1 << 15
+	sqfsDiskUncompressedData     = 1 << 24
+	sqfsDiskTypeDir              = 1
+	sqfsDiskTypeFile             = 2
+	sqfsDiskTypeLDir             = 8
+	sqfsDiskTypeLFile            = 9
+)
+
+// sqfsReader reads back the tables of a squashfs image
+type sqfsReader struct {
+	t          *testing.T
+	img        []byte
+	blockSize  uint32
+	inodeTable []byte
+	dirTable   []byte
+	// inodeBlocks and dirBlocks map the offsets of the compressed metadata
+	// blocks to their offsets in the uncompressed tables
+	inodeBlocks map[uint32]int
+	dirBlocks   map[uint32]int
+}
+
+func (r *sqfsReader) metadata(start uint64, end uint64) ([]byte, map[uint32]int) {
+	var table []byte
+	blocks := make(map[uint32]int)
+	for pos := start; pos < end; {
+		header := binary.LittleEndian.Uint16(r.img[pos:])
+		size := uint64(header &^ sqfsDiskUncompressedMetadata)
+		block := r.img[pos+2 : pos+2+size]
+		if header&sqfsDiskUncompressedMetadata == 0 {
+			block = r.decompress(block)
+		}
+		blocks[uint32(pos-start)] = len(table)
+		table = append(table, block...)
+		pos += 2 + size
+	}
+	return table, blocks
+}
+
+func (r *sqfsReader) decompress(data []byte) []byte {
+	zr, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		r.t.Fatalf("invalid zlib block: %v", err)
+	}
+	res, err := io.ReadAll(zr)
+	if err != nil {
+		r.t.Fatalf("invalid zlib block: %v", err)
+	}
+	return res
+}
+
+// inode returns the inode at the given reference of the inode table
+func (r *sqfsReader) inode(ref uint64) []byte {
+	start, ok := r.inodeBlocks[uint32(ref>>16)]
+	if !ok {
+		r.t.Fatalf("inode reference %#x does not point to a metadata block", ref)
+	}
+	return r.inodeTable[start+int(ref&0xffff):]
+}
+
+// walk reads the inode at ref and adds the files under it to files
+func (r *sqfsReader) walk(ref uint64, dir string, ino uint32, files map[string][]byte) {
+	inode := r.inode(ref)
+	inodeType := binary.LittleEndian.Uint16(inode[0:])
+	if got := binary.LittleEndian.Uint32(inode[12:]); got != ino {
+		r.t.Errorf("%s: inode number %d, expected %d", dir, got, ino)
+	}
+	switch inodeType {
+	case sqfsDiskTypeFile:
+		start := uint64(binary.LittleEndian.Uint32(inode[16:]))
+		size := uint64(binary.LittleEndian.Uint32(inode[28:]))
+		files[dir] = r.fileData(start, size, inode[32:])
+	case sqfsDiskTypeLFile:
+		start := binary.LittleEndian.Uint64(inode[16:])
+		size := binary.LittleEndian.Uint64(inode[24:])
+		files[dir] = r.fileData(start, size, inode[56:])
+	case sqfsDiskTypeDir:
+		block := binary.LittleEndian.Uint32(inode[16:])
+		size := binary.LittleEndian.Uint16(inode[24:])
+		offset := binary.LittleEndian.Uint16(inode[26:])
+		r.walkDir(block, offset, uint32(size), dir, files)
+	case sqfsDiskTypeLDir:
+		size := binary.LittleEndian.Uint32(inode[20:])
+		block := binary.LittleEndian.Uint32(inode[24:])
+		offset := binary.LittleEndian.Uint16(inode[34:])
+		r.walkDir(block, offset, size, dir, files)
+	default:
+		r.t.Fatalf("%s: unexpected inode type %d", dir, inodeType)
+	}
+}
+
+func (r *sqfsReader) walkDir(block uint32, offset uint16, size uint32, dir string, files map[string][]byte) {
+	start, ok := r.dirBlocks[block]
+	if !ok {
+		r.t.Fatalf("%s: directory block %#x does not exist", dir, block)
+	}
+	// the size includes the implicit "." and ".." entries
+	listing := r.dirTable[start+int(offset) : start+int(offset)+int(size)-3]
+	for len(listing) > 0 {
+		count := binary.LittleEndian.Uint32(listing[0:]) + 1
+		inodeBlock := binary.LittleEndian.Uint32(listing[4:])
+		base := binary.LittleEndian.Uint32(listing[8:])
+		listing = listing[12:]
+		for e := uint32(0); e < count; e++ {
+			inodeOffset := binary.LittleEndian.Uint16(listing[0:])
+			diff := int16(binary.LittleEndian.Uint16(listing[2:]))
+			nameSize := int(binary.LittleEndian.Uint16(listing[6:])) + 1
+			name := string(listing[8 : 8+nameSize])
+			listing = listing[8+nameSize:]
+			ref := uint64(inodeBlock)<<16 | uint64(inodeOffset)
+			r.walk(ref, path.Join(dir, name), uint32(int64(base)+int64(diff)), files)
+		}
+	}
+}
+
+// fileData reads the blocks of a file, whose sizes are listed in sizes
+func (r *sqfsReader) fileData(start uint64, size uint64, sizes []byte) []byte {
+	var data []byte
+	pos := start
+	for len(data) < int(size) {
+		blockSize := binary.LittleEndian.Uint32(sizes)
+		sizes = sizes[4:]
+		expected := int(size) - len(data)
+		if expected > int(r.blockSize) {
+			expected = int(r.blockSize)
+		}
+		switch {
+		case blockSize == 0:
+			data = append(data, make([]byte, expected)...)
+		case blockSize&sqfsDiskUncompressedData != 0:
+			blockSize &^= sqfsDiskUncompressedData
+			data = append(data, r.img[pos:pos+uint64(blockSize)]...)
+		default:
+			data = append(data, r.decompress(r.img[pos:pos+uint64(blockSize)])...)
+		}
+		pos += uint64(blockSize)
+	}
+	return data
+}
+
+func TestSquashfs(t *testing.T) {
+	files := testFiles()
+	img, err := Squashfs(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(img)%sqfsDiskPadding != 0 {
+		t.Errorf("image size %d is not padded to %d", len(img), sqfsDiskPadding)
+	}
+	sb := img[:sqfsDiskSuperblockSize]
+	if magic := binary.LittleEndian.Uint32(sb[0:]); magic != sqfsDiskMagic {
+		t.Fatalf("magic %#x, expected %#x", magic, sqfsDiskMagic)
+	}
+	if major, minor := binary.LittleEndian.Uint16(sb[28:]), binary.LittleEndian.Uint16(sb[30:]); major != 4 || minor != 0 {
+		t.Errorf("version %d.%d, expected 4.0", major, minor)
+	}
+	if compressor := binary.LittleEndian.Uint16(sb[20:]); compressor != sqfsDiskCompressorZlib {
+		t.Errorf("compressor %d, expected zlib", compressor)
+	}
+	blockSize := binary.LittleEndian.Uint32(sb[12:])
+	if blockLog := binary.LittleEndian.Uint16(sb[22:]); 1<<blockLog != blockSize {
+		t.Errorf("block log %d does not match block size %d", blockLog, blockSize)
+	}
+	if used := binary.LittleEndian.Uint64(sb[40:]); used > uint64(len(img)) {
+		t.Errorf("bytes used %d exceed image size %d", used, len(img))
+	}
+	// the files, the root directory and its 5 subdirectories
+	inodeCount := binary.LittleEndian.Uint32(sb[4:])
+	if expected := uint32(len(files) + 6); inodeCount != expected {
+		t.Errorf("inode count %d, expected %d", inodeCount, expected)
+	}
+
+	r := &sqfsReader{t: t, img: img, blockSize: blockSize}
+	inodeTableStart := binary.LittleEndian.Uint64(sb[64:])
+	dirTableStart := binary.LittleEndian.Uint64(sb[72:])
+	fragmentTableStart := binary.LittleEndian.Uint64(sb[80:])
+	r.inodeTable, r.inodeBlocks = r.metadata(inodeTableStart, dirTableStart)
+	r.dirTable, r.dirBlocks = r.metadata(dirTableStart, fragmentTableStart)
+	if len(r.inodeBlocks) < 2 {
+		t.Errorf("inode table holds %d metadata blocks, the test expects several", len(r.inodeBlocks))
+	}
+
+	rootRef := binary.LittleEndian.Uint64(sb[32:])
+	if inodeType := binary.LittleEndian.Uint16(r.inode(rootRef)); inodeType != sqfsDiskTypeDir && inodeType != sqfsDiskTypeLDir {
+		t.Fatalf("root inode type %d, expected a directory", inodeType)
+	}
+	got := make(map[string][]byte)
+	r.walk(rootRef, "/", inodeCount, got)
+	if len(got) != len(files) {
+		t.Errorf("read %d files, expected %d", len(got), len(files))
+	}
+	for name, content := range files {
+		if !bytes.Equal(got[name], content) {
+			t.Errorf("%s: read %d bytes that differ from the %d bytes written", name, len(got[name]), len(content))
+		}
+	}
+	checkExtracted(t, img, files, "unsquashfs", "-no-xattrs", "-d", "{dir}", "{image}")
+}
+
+// TestSquashfsKnownImage pins the bytes of a minimal image, decoded by hand
+// against the squashfs 4.0 on-disk format
+func TestSquashfsKnownImage(t *testing.T) {
+	img, err := Squashfs(map[string][]byte{"/a": []byte("hi")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := unhex(t, `
+		68737173 02000000 00000000 00000200
+		00000000 0100 1100 1002 0100 0400 0000
+		2400000000000000 cd00000000000000 c500000000000000 ffffffffffffffff
+		6200000000000000 a800000000000000 bf00000000000000 ffffffffffffffff
+
+		6869
+
+		4480
+		0200 ed01 0000 0000 00000000 01000000
+		60000000 ffffffff 00000000 02000000 02000001
+		0100 ed01 0000 0000 00000000 02000000
+		00000000 02000000 1800 0000 03000000
+
+		1580
+		00000000 00000000 01000000
+		0000 0000 0200 0000 61
+
+		0480 00000000
+		bf00000000000000`)
+	// superblock: magic, 2 inodes, mkfs_time, block size 128KiB, no
+	// fragments, zlib, block_log 17, no fragments and no xattrs flags,
+	// 1 id, version 4.0, root inode at offset 0x24 of the first inode
+	// block, 205 bytes used and the table offsets.
+	// data: the uncompressed block of /a.
+	// inode table: an uncompressed metadata block of 68 bytes, holding the
+	// basic file inode of /a, with its uncompressed block of 2 bytes at 0x60,
+	// and the basic directory inode of the root, with 2 links, a listing
+	// of 24 bytes and parent inode 3.
+	// directory table: a header of a single entry at inode number 1, and
+	// the entry of /a, a file.
+	// id table: uid 0, and the offset of its metadata block.
+	if !bytes.Equal(img[:len(expected)], expected) {
+		t.Errorf("got\n%x\nexpected\n%x", img[:len(expected)], expected)
+	}
+	if len(img) != 4096 || len(bytes.Trim(img[len(expected):], "\x00")) != 0 {
+		t.Errorf("image of %d bytes is not padded with zeros to 4096 bytes", len(img))
+	}
+}
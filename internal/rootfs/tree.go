@@ -0,0 +1,122 @@
+// Copyright 2023 Nubificus LTD.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package rootfs builds filesystem images from the files of a bima image,
+// without relying on external tools or root privileges.
+package rootfs
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	l "github.com/nubificus/bima/internal/log"
+)
+
+var log = l.Logger()
+
+const (
+	// dirMode is the permission of all directories
+	dirMode = 0755
+	// fileMode is the permission of all regular files. The source permissions
+	// are not tracked, so files are kept executable for init binaries.
+	fileMode = 0755
+)
+
+// node is a file or directory of the filesystem tree
+type node struct {
+	name    string
+	isDir   bool
+	content []byte
+	// children of a directory, sorted by name
+	children []*node
+}
+
+// buildTree creates the filesystem tree of the given files, keyed by their
+// absolute path, adding any missing parent directories.
+func buildTree(files map[string][]byte) (*node, error) {
+	root := &node{isDir: true}
+	dirs := map[string]*node{"/": root}
+	regular := make(map[string]bool)
+	paths := []string{}
+	for p := range files {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	for _, p := range paths {
+		clean := path.Clean("/" + p)
+		if clean == "/" {
+			return nil, fmt.Errorf("invalid file path %q", p)
+		}
+		parent, err := mkdirAll(dirs, regular, path.Dir(clean))
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := dirs[clean]; ok {
+			return nil, fmt.Errorf("%q is both a file and a directory", clean)
+		}
+		if regular[clean] {
+			return nil, fmt.Errorf("duplicate file %q", clean)
+		}
+		regular[clean] = true
+		parent.children = append(parent.children, &node{
+			name:    path.Base(clean),
+			content: files[p],
+		})
+	}
+	sortChildren(root)
+	return root, nil
+}
+
+// mkdirAll returns the directory node of dir, creating it and its parents if needed
+func mkdirAll(dirs map[string]*node, regular map[string]bool, dir string) (*node, error) {
+	if n, ok := dirs[dir]; ok {
+		return n, nil
+	}
+	if regular[dir] {
+		return nil, fmt.Errorf("%q is both a file and a directory", dir)
+	}
+	parent, err := mkdirAll(dirs, regular, path.Dir(dir))
+	if err != nil {
+		return nil, err
+	}
+	n := &node{name: path.Base(dir), isDir: true}
+	parent.children = append(parent.children, n)
+	dirs[dir] = n
+	return n, nil
+}
+
+func sortChildren(n *node) {
+	sort.Slice(n.children, func(a, b int) bool {
+		return strings.Compare(n.children[a].name, n.children[b].name) < 0
+	})
+	for _, child := range n.children {
+		if child.isDir {
+			sortChildren(child)
+		}
+	}
+}
+
+// walk calls fn for n and all of its descendants, parents before their children
+func walk(n *node, fn func(n *node, parent *node)) {
+	var visit func(n *node, parent *node)
+	visit = func(n *node, parent *node) {
+		fn(n, parent)
+		for _, child := range n.children {
+			visit(child, n)
+		}
+	}
+	visit(n, n)
+}
@@ -17,7 +17,12 @@ package utils
 import (
 	"bufio"
 	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
 	"os"
+	"strconv"
+	"strings"
 )
 
 // FileExists checks if a file exists and is indeed a file.
@@ -64,20 +69,42 @@ func DirExists(dirname string) (bool, error) {
 // It takes the file path as input and returns a slice of strings representing each non-empty line,
 // along with an error if an error occurs while reading the file.
 func SplitFileToLines(file string) ([]string, error) {
+	numbered, err := SplitFileToNumberedLines(file)
+	if err != nil {
+		return nil, err
+	}
+	var lines []string
+	for _, line := range numbered {
+		lines = append(lines, line.Text)
+	}
+	return lines, nil
+}
+
+// NumberedLine is a line of a file along with its line number, starting from 1
+type NumberedLine struct {
+	Number int
+	Text   string
+}
+
+// SplitFileToNumberedLines reads a file and splits its contents into individual
+// lines, excluding empty lines, keeping the line number of each line.
+func SplitFileToNumberedLines(file string) ([]NumberedLine, error) {
 	readFile, err := os.Open(file)
 	if err != nil {
 		return nil, err
 	}
 	defer readFile.Close()
-	var lines []string
+	var lines []NumberedLine
 	fileScanner := bufio.NewScanner(readFile)
 
+	number := 0
 	for fileScanner.Scan() {
+		number++
 		if fileScanner.Text() != "" {
-			lines = append(lines, fileScanner.Text())
+			lines = append(lines, NumberedLine{Number: number, Text: fileScanner.Text()})
 		}
 	}
-	return lines, nil
+	return lines, fileScanner.Err()
 }
 
 // Base64Encode encodes the given string data to Base64 format.
@@ -97,3 +124,218 @@ func Base64Decode(encodedData string) (string, error) {
 
 	return string(decodedBytes), nil
 }
+
+// sizeUnits maps the supported size suffixes to their multipliers
+var sizeUnits = map[string]int64{
+	"":    1,
+	"B":   1,
+	"K":   1 << 10,
+	"KB":  1000,
+	"KIB": 1 << 10,
+	"M":   1 << 20,
+	"MB":  1000 * 1000,
+	"MIB": 1 << 20,
+	"G":   1 << 30,
+	"GB":  1000 * 1000 * 1000,
+	"GIB": 1 << 30,
+}
+
+// ParseSize parses a size in bytes, optionally followed by a unit.
+// Units ending in "B" without "i" are decimal, all others are binary,
+// so "10M" and "10MiB" are 10485760 bytes, while "10MB" is 10000000 bytes.
+func ParseSize(size string) (int64, error) {
+	size = strings.TrimSpace(size)
+	digits := strings.TrimRightFunc(size, func(r rune) bool {
+		return r < '0' || r > '9'
+	})
+	multiplier, ok := sizeUnits[strings.ToUpper(strings.TrimSpace(size[len(digits):]))]
+	if !ok || digits == "" {
+		return 0, fmt.Errorf("invalid size %q", size)
+	}
+	value, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q", size)
+	}
+	if value > math.MaxInt64/multiplier {
+		return 0, fmt.Errorf("size %q is too large", size)
+	}
+	return value * multiplier, nil
+}
+
+// ParseCmdline splits a command line into its arguments. A JSON array of
+// strings is taken as is, like the exec form of CMD, while any other command
+// line is split following the POSIX shell quoting rules.
+func ParseCmdline(cmdline string) ([]string, error) {
+	trimmed := strings.TrimSpace(cmdline)
+	if strings.HasPrefix(trimmed, "[") {
+		var args []string
+		if err := json.Unmarshal([]byte(trimmed), &args); err == nil {
+			return args, nil
+		}
+	}
+	return SplitShellWords(cmdline)
+}
+
+// NormalizeCmdline converts a JSON array of strings, like the exec form of
+// CMD, to the equivalent shell-quoted command line. Any other command line
+// is returned as is.
+func NormalizeCmdline(cmdline string) string {
+	trimmed := strings.TrimSpace(cmdline)
+	if !strings.HasPrefix(trimmed, "[") {
+		return cmdline
+	}
+	var args []string
+	if err := json.Unmarshal([]byte(trimmed), &args); err != nil {
+		return cmdline
+	}
+	return JoinShellWords(args)
+}
+
+// JoinShellWords joins words into a string that SplitShellWords splits back
+// to the same words, quoting the words that hold shell special characters.
+func JoinShellWords(words []string) string {
+	quoted := make([]string, len(words))
+	for i, word := range words {
+		quoted[i] = shellQuote(word)
+	}
+	return strings.Join(quoted, " ")
+}
+
+// shellQuote single-quotes word, unless it only holds characters
+// without a special meaning to the shell
+func shellQuote(word string) string {
+	if word != "" && strings.Trim(word, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_@%+=:,./-") == "" {
+		return word
+	}
+	return "'" + strings.ReplaceAll(word, "'", `'\''`) + "'"
+}
+
+// SplitShellWords splits s into words following the POSIX shell quoting rules,
+// without any expansion. Single quotes keep their content as is, while inside
+// double quotes a backslash only escapes "$", "`", "\"", "\\" and newlines.
+func SplitShellWords(s string) ([]string, error) {
+	words := []string{}
+	var word strings.Builder
+	inWord := false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		case c == '\\':
+			i++
+			if i == len(s) {
+				return nil, fmt.Errorf("unterminated escape at the end of %q", s)
+			}
+			// an escaped newline joins the lines, without starting a word
+			if s[i] != '\n' {
+				inWord = true
+				word.WriteByte(s[i])
+			}
+		case c == '\'':
+			inWord = true
+			end := strings.IndexByte(s[i+1:], '\'')
+			if end < 0 {
+				return nil, fmt.Errorf("unbalanced single quote at offset %d of %q", i, s)
+			}
+			word.WriteString(s[i+1 : i+1+end])
+			i += end + 1
+		case c == '"':
+			inWord = true
+			start := i
+			closed := false
+			for i++; i < len(s); i++ {
+				if s[i] == '"' {
+					closed = true
+					break
+				}
+				if s[i] == '\\' && i+1 < len(s) && strings.IndexByte("$`\"\\\n", s[i+1]) >= 0 {
+					i++
+					if s[i] == '\n' {
+						continue
+					}
+				}
+				word.WriteByte(s[i])
+			}
+			if !closed {
+				return nil, fmt.Errorf("unbalanced double quote at offset %d of %q", start, s)
+			}
+		default:
+			inWord = true
+			word.WriteByte(c)
+		}
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
+
+// CollapseSpaces replaces each run of spaces and tabs of line with a single
+// space, except inside quotes or after a backslash, where the whitespace is
+// part of a word and is kept as is.
+func CollapseSpaces(line string) string {
+	var res strings.Builder
+	var quote byte
+	space := false
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote == 0 && (c == ' ' || c == '\t'):
+			space = true
+			continue
+		case quote == 0 && (c == '\'' || c == '"'):
+			quote = c
+		case c == quote:
+			quote = 0
+		case c == '\\' && quote != '\'' && i+1 < len(line):
+			if space {
+				res.WriteByte(' ')
+				space = false
+			}
+			res.WriteByte(c)
+			i++
+			c = line[i]
+		}
+		if space {
+			res.WriteByte(' ')
+			space = false
+		}
+		res.WriteByte(c)
+	}
+	return res.String()
+}
+
+// Unquote removes one pair of matching quotes around s, as a Dockerfile
+// LABEL does with its keys and values. Inside double quotes, a backslash
+// escapes "\"", "\\" and "$". If s is not a single quoted string, it is
+// returned as is.
+func Unquote(s string) string {
+	if len(s) < 2 || (s[0] != '"' && s[0] != '\'') || s[len(s)-1] != s[0] {
+		return s
+	}
+	inner := s[1 : len(s)-1]
+	if s[0] == '\'' {
+		if strings.IndexByte(inner, '\'') >= 0 {
+			return s
+		}
+		return inner
+	}
+	var res strings.Builder
+	for i := 0; i < len(inner); i++ {
+		c := inner[i]
+		if c == '"' || (c == '\\' && i+1 == len(inner)) {
+			return s
+		}
+		if c == '\\' && i+1 < len(inner) && strings.IndexByte("\"\\$", inner[i+1]) >= 0 {
+			i++
+			c = inner[i]
+		}
+		res.WriteByte(c)
+	}
+	return res.String()
+}
@@ -0,0 +1,104 @@
+// Copyright 2023 Nubificus LTD.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package utils
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitShellWords(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+	}{
+		{"redis-server /data/conf/redis.conf", []string{"redis-server", "/data/conf/redis.conf"}},
+		{"a \\\n b", []string{"a", "b"}},
+		{"a\\\nb", []string{"ab"}},
+		{"a \\  b", []string{"a", " ", "b"}},
+		{`a 'b c' "d \"e\" \n"`, []string{"a", "b c", `d "e" \n`}},
+		{`'' ""`, []string{"", ""}},
+	}
+	for _, test := range tests {
+		got, err := SplitShellWords(test.in)
+		if err != nil {
+			t.Errorf("SplitShellWords(%q) failed: %v", test.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("SplitShellWords(%q) = %q, expected %q", test.in, got, test.want)
+		}
+	}
+	for _, in := range []string{`a\`, `'a`, `"a`} {
+		if _, err := SplitShellWords(in); err == nil {
+			t.Errorf("SplitShellWords(%q) did not fail", in)
+		}
+	}
+}
+
+func TestNormalizeCmdline(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"redis-server /data/conf/redis.conf", "redis-server /data/conf/redis.conf"},
+		{`["redis-server", "/data/conf/redis.conf"]`, "redis-server /data/conf/redis.conf"},
+		{`["echo", "a b", "it's", "", "$HOME"]`, `echo 'a b' 'it'\''s' '' '$HOME'`},
+		{"[ -f /data ]", "[ -f /data ]"},
+	}
+	for _, test := range tests {
+		got := NormalizeCmdline(test.in)
+		if got != test.want {
+			t.Errorf("NormalizeCmdline(%q) = %q, expected %q", test.in, got, test.want)
+		}
+		want, _ := ParseCmdline(test.in)
+		words, err := SplitShellWords(got)
+		if err != nil || !reflect.DeepEqual(words, want) {
+			t.Errorf("SplitShellWords(%q) = %q, expected %q", got, words, want)
+		}
+	}
+}
+
+func TestUnquote(t *testing.T) {
+	tests := map[string]string{
+		`"a b"`:           "a b",
+		`'a "b"'`:         `a "b"`,
+		`"a \"b\" \\ \n"`: `a "b" \ \n`,
+		`a "b"`:           `a "b"`,
+		`"a" "b"`:         `"a" "b"`,
+		`'a' 'b'`:         `'a' 'b'`,
+		`"a\"`:            `"a\"`,
+		`"`:               `"`,
+	}
+	for in, want := range tests {
+		if got := Unquote(in); got != want {
+			t.Errorf("Unquote(%q) = %q, expected %q", in, got, want)
+		}
+	}
+}
+
+func TestCollapseSpaces(t *testing.T) {
+	tests := map[string]string{
+		"LABEL  a=b \t c":       "LABEL a=b c",
+		`LABEL a='b  c'  d`:     `LABEL a='b  c' d`,
+		`LABEL a="b  \"  c"  d`: `LABEL a="b  \"  c" d`,
+		`LABEL a=b\  \  c`:      `LABEL a=b\  \  c`,
+	}
+	for in, want := range tests {
+		if got := CollapseSpaces(in); got != want {
+			t.Errorf("CollapseSpaces(%q) = %q, expected %q", in, got, want)
+		}
+	}
+}